@@ -168,7 +168,9 @@ func tryGetIconCache(symbol string) (bool, string) {
     name := filepath.Join(os.ExpandEnv(cfg().Assoc.IconCache), symbol + ".ico")
     _, err := os.Stat(name)
     if err != nil {
+        metrics.iconMisses.Add(1)
         return false, name
     }
+    metrics.iconHits.Add(1)
     return true, name
 }
\ No newline at end of file
@@ -0,0 +1,412 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net"
+    "net/http"
+    "net/netip"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Context keys through which handlers of the HTTP API tell the audit
+// middleware what they did when it cannot be told from the request.
+const (
+    auditPathKey = "audit.path"
+    auditTargetKey = "audit.target"
+    auditBytesKey = "audit.bytes"
+    auditOutcomeKey = "audit.outcome"
+)
+
+type AuditEntry struct {
+    Time    time.Time    `json:"time"`
+    Client    string        `json:"client"`
+    User    string        `json:"user,omitempty"` // SFTP and S3 users only.
+    Via        string        `json:"via"` // http, dav, s3 or sftp.
+    Action    string        `json:"action"`
+    Path    string        `json:"path"`
+    Target    string        `json:"target,omitempty"` // Destination of moves and copies.
+    Flag    string        `json:"flag"`
+    Bytes    int64        `json:"bytes"`
+    Status    int            `json:"status,omitempty"` // HTTP status, if any.
+    Outcome    string        `json:"outcome"` // ok, denied, notfound or error.
+}
+
+type AuditQuery struct {
+    Since    time.Time
+    Path    string // Prefix or glob pattern.
+    Actions    []string
+}
+
+// Audit appends entries as JSON lines to files named after the day they are
+// written, starting a new file whenever one grows past Audit.MaxSize bytes.
+// A nil Audit logs nothing.
+type Audit struct {
+    mu        sync.Mutex
+    tree    *Tree
+    dir        string
+    file    *os.File
+    name    string
+    size    int64
+}
+
+// auditRoutes maps the routes of the HTTP API to the actions they are logged
+// as. Other routes, like icons and static assets, are not logged.
+var auditRoutes = map[string]string{
+    "/tree/*path": "tree",
+    "/watch/*path": "tree",
+    "/file/*path": "file",
+    "/upload/*path": "upload",
+    "/search/content": "search",
+    "/move": "move",
+    "/copy": "copy",
+    "/batch": "batch",
+    "/delete/*path": "delete",
+    "/lock/*path": "lock",
+    "/unlock": "unlock",
+    "/versions/*path": "versions",
+    "/version/:id/*path": "file",
+    "/rollback": "rollback",
+    "/trash": "trash",
+    "/trash/restore": "restore",
+    "/trash/purge": "purge",
+}
+
+var davActions = map[string]string{
+    "GET": "file",
+    "PUT": "upload",
+    "DELETE": "delete",
+    "PROPFIND": "tree",
+    "PROPPATCH": "setstat",
+    "MKCOL": "mkdir",
+    "COPY": "copy",
+    "MOVE": "move",
+    "LOCK": "lock",
+    "UNLOCK": "unlock",
+}
+
+// routeAction tells which server a request to the gin engine is for and the
+// action it is logged as, which is empty for routes that are not logged.
+func routeAction(c *gin.Context) (string, string) {
+    if strings.HasPrefix(c.FullPath(), "/dav/") {
+        return "dav", davActions[c.Request.Method]
+    }
+    return "http", auditRoutes[c.FullPath()]
+}
+
+// auditDir is where the log of the tree served from root is kept.
+func auditDir(root string) string {
+    if !IsNamespace(root) {
+        root, _ = filepath.Abs(root)
+    }
+    return filepath.Join(os.ExpandEnv(cfg().Audit.Location), Hash(root))
+}
+
+func OpenAudit(tree *Tree) (*Audit, error) {
+    if !cfg().Audit.Enabled {
+        return nil, nil
+    }
+    audit := &Audit{ tree: tree, dir: auditDir(tree.Path) }
+    if err := os.MkdirAll(audit.dir, 0o755); err != nil {
+        return nil, err
+    }
+    return audit, nil
+}
+
+// rotate makes sure entries written at now go to the right file. The caller
+// must hold a.mu.
+func (a *Audit) rotate(now time.Time) error {
+    day := now.Format("2006-01-02")
+    maxSize := cfg().Audit.MaxSize
+    if a.file != nil && strings.HasPrefix(a.name, "audit-" + day) && (maxSize <= 0 || a.size < maxSize) {
+        return nil
+    }
+    if a.file != nil {
+        a.file.Close()
+        a.file = nil
+    }
+    for seq := 0; ; seq++ {
+        name := fmt.Sprintf("audit-%s-%03d.jsonl", day, seq)
+        size := int64(0)
+        if info, err := os.Stat(filepath.Join(a.dir, name)); err == nil {
+            size = info.Size()
+        }
+        if maxSize > 0 && size >= maxSize {
+            continue
+        }
+        fp, err := os.OpenFile(filepath.Join(a.dir, name), os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0o600)
+        if err != nil {
+            return err
+        }
+        a.file, a.name, a.size = fp, name, size
+        a.expire(now)
+        return nil
+    }
+}
+
+// expire removes files older than Audit.MaxAge days, unless it is zero.
+func (a *Audit) expire(now time.Time) {
+    if cfg().Audit.MaxAge <= 0 {
+        return
+    }
+    deadline := now.AddDate(0, 0, -cfg().Audit.MaxAge).Format("2006-01-02")
+    for _, name := range auditFiles(a.dir) {
+        if name[6:16] < deadline {
+            os.Remove(filepath.Join(a.dir, name))
+        }
+    }
+}
+
+// flagOf resolves the flag of the entry named by parts for the client,
+// which is empty for the root and for entries below missing directories.
+func (a *Audit) flagOf(parts []string, client string) string {
+    if len(parts) == 0 {
+        return ""
+    }
+    addr, _ := netip.ParseAddr(client)
+    t, _ := a.tree.For(addr).Walk(parts[:len(parts)-1])
+    if t == nil {
+        return ""
+    }
+    flag, _ := t.FlagOf(parts[len(parts)-1])
+    return Flags.Get(flag)
+}
+
+func (a *Audit) Log(entry AuditEntry) {
+    if a == nil {
+        return
+    }
+    if entry.Time.IsZero() {
+        entry.Time = time.Now()
+    }
+    if entry.Flag == "" {
+        entry.Flag = a.flagOf(splitPath(entry.Path), entry.Client)
+    }
+    line, _ := json.Marshal(entry)
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if err := a.rotate(entry.Time); err != nil {
+        fmt.Println("Warning: cannot write audit log:", err)
+        return
+    }
+    n, _ := a.file.Write(append(line, '\n'))
+    a.size += int64(n)
+}
+
+// auditOutcome classifies an HTTP status for the log.
+func auditOutcome(status int) string {
+    switch {
+    case status < 400:
+        return "ok"
+    case status == http.StatusNotFound:
+        return "notfound"
+    case status == http.StatusUnauthorized, status == http.StatusForbidden,
+        status == http.StatusPreconditionFailed, status == http.StatusLocked,
+        status == http.StatusTooManyRequests, status == http.StatusRequestEntityTooLarge,
+        status == http.StatusInsufficientStorage, status == http.StatusUnsupportedMediaType:
+        return "denied"
+    }
+    return "error"
+}
+
+// auditOutcomeOf classifies the error an operation failed with for the log.
+func auditOutcomeOf(err error) string {
+    var serr *SpaceError
+    var terr *TypeError
+    switch {
+    case err == nil:
+        return "ok"
+    case errors.Is(err, ErrNotFound), errors.Is(err, fs.ErrNotExist):
+        return "notfound"
+    case errors.Is(err, ErrForbidden), errors.Is(err, fs.ErrPermission),
+        errors.Is(err, ErrLocked), errors.Is(err, ErrPrecondition),
+        errors.Is(err, ErrTooMany), errors.As(err, &serr), errors.As(err, &terr):
+        return "denied"
+    }
+    return "error"
+}
+
+// auditReader counts the bytes read from a request body.
+type auditReader struct {
+    io.ReadCloser
+    n    int64
+}
+
+func (r *auditReader) Read(p []byte) (int, error) {
+    n, err := r.ReadCloser.Read(p)
+    r.n += int64(n)
+    return n, err
+}
+
+// auditWriter records the status and size of a response.
+type auditWriter struct {
+    http.ResponseWriter
+    status    int
+    n        int64
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(p)
+    w.n += int64(n)
+    return n, err
+}
+
+// remoteHost strips the port from a remote address.
+func remoteHost(addr string) string {
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        return host
+    }
+    return addr
+}
+
+// AuditMiddleware logs the requests to the HTTP API and WebDAV once they are
+// handled. Handlers whose paths are not in the URL, or which transfer data
+// outside of the request and response bodies, report them through the
+// audit.* context keys.
+func AuditMiddleware(audit *Audit) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        via, action := routeAction(c)
+        if audit == nil || action == "" {
+            c.Next()
+            return
+        }
+        start := time.Now()
+        body := &auditReader{ ReadCloser: c.Request.Body }
+        c.Request.Body = body
+        c.Next()
+
+        parts := splitPath(c.Param("path"))
+        if value, ok := c.Get(auditPathKey); ok {
+            parts = value.([]string)
+        }
+        entry := AuditEntry{
+            Time: start,
+            Client: c.ClientIP(),
+            Via: via,
+            Action: action,
+            Path: strings.Join(parts, "/"),
+            Flag: audit.flagOf(parts, c.ClientIP()),
+            Bytes: body.n + int64(max(c.Writer.Size(), 0)),
+            Status: c.Writer.Status(),
+            Outcome: auditOutcome(c.Writer.Status()),
+        }
+        if value, ok := c.Get(auditTargetKey); ok {
+            entry.Target = strings.Join(value.([]string), "/")
+        } else if dest := c.GetHeader("Destination"); via == "dav" && dest != "" {
+            if u, err := url.Parse(dest); err == nil {
+                entry.Target = strings.Join(splitPath(strings.TrimPrefix(u.Path, "/dav")), "/")
+            }
+        }
+        if value, ok := c.Get(auditBytesKey); ok {
+            entry.Bytes = value.(int64)
+        }
+        if outcome := c.GetString(auditOutcomeKey); outcome != "" {
+            entry.Outcome = outcome
+        }
+        audit.Log(entry)
+    }
+}
+
+// auditFiles lists the log files in dir, oldest first.
+func auditFiles(dir string) []string {
+    names := []string{}
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return names
+    }
+    for _, entry := range entries {
+        name := entry.Name()
+        if strings.HasPrefix(name, "audit-") && strings.HasSuffix(name, ".jsonl") && len(name) >= 16 {
+            names = append(names, name)
+        }
+    }
+    slices.Sort(names)
+    return names
+}
+
+// ParseSince accepts a duration back from now, a date or an RFC 3339 time.
+func ParseSince(value string) (time.Time, error) {
+    if value == "" {
+        return time.Time{}, nil
+    }
+    if d, err := time.ParseDuration(value); err == nil {
+        return time.Now().Add(-d), nil
+    }
+    if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+        return t, nil
+    }
+    return time.Parse(time.RFC3339, value)
+}
+
+func matchAuditPath(pattern string, name string) bool {
+    if strings.ContainsAny(pattern, "*?[") {
+        ok, _ := path.Match(pattern, name)
+        return ok
+    }
+    return pattern == "" || name == pattern || strings.HasPrefix(name, pattern + "/")
+}
+
+func (q *AuditQuery) Match(entry *AuditEntry) bool {
+    if entry.Time.Before(q.Since) {
+        return false
+    }
+    if len(q.Actions) > 0 && !slices.Contains(q.Actions, entry.Action) {
+        return false
+    }
+    pattern := strings.Trim(q.Path, "/")
+    return matchAuditPath(pattern, entry.Path) || entry.Target != "" && matchAuditPath(pattern, entry.Target)
+}
+
+// QueryAudit writes the entries logged for the tree served from root that
+// match q, oldest first, as they were logged.
+func QueryAudit(w io.Writer, root string, q AuditQuery) error {
+    dir := auditDir(root)
+    if _, err := os.Stat(dir); err != nil {
+        return fmt.Errorf("no audit log for %s", root)
+    }
+    since := q.Since.Format("2006-01-02")
+    for _, name := range auditFiles(dir) {
+        if !q.Since.IsZero() && name[6:16] < since {
+            continue
+        }
+        fp, err := os.Open(filepath.Join(dir, name))
+        if err != nil {
+            return err
+        }
+        scanner := bufio.NewScanner(fp)
+        scanner.Buffer(nil, 1 << 20)
+        for scanner.Scan() {
+            entry := AuditEntry{}
+            if json.Unmarshal(scanner.Bytes(), &entry) != nil || !q.Match(&entry) {
+                continue
+            }
+            w.Write(scanner.Bytes())
+            io.WriteString(w, "\n")
+        }
+        fp.Close()
+    }
+    return nil
+}
\ No newline at end of file
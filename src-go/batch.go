@@ -0,0 +1,338 @@
+package main
+
+import (
+    "errors"
+    "io/fs"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// maxBatchOps is how many steps a batch may have.
+const maxBatchOps = 1000
+
+// Modes of a batch: stop at the first failed step, run every step, or stop
+// and undo the steps done so far.
+var batchModes = []string{ "stopOnError", "continue", "transaction" }
+
+var ErrNotUndoable = errors.New("cannot be undone")
+
+// BatchOp is a step of a batch. Moves and copies use From and To, deletes
+// and new directories use Path.
+type BatchOp struct {
+    Op            string        `json:"op"` // move, copy, delete or mkdir.
+    From        []string    `json:"from"`
+    To            []string    `json:"to"`
+    Path        []string    `json:"path"`
+    IfMatch        string        `json:"ifMatch"`
+    IfNoneMatch    string        `json:"ifNoneMatch"`
+}
+
+// BatchRequest is the body of /batch.
+type BatchRequest struct {
+    Mode        string        `json:"mode"` // stopOnError, continue or transaction.
+    LockToken    string        `json:"lockToken"`
+    Ops            []BatchOp    `json:"ops"`
+}
+
+// BatchResult tells how a step went, with the status and error it would have
+// had as a request of its own.
+type BatchResult struct {
+    Status    int            `json:"status"`
+    Error    *APIError    `json:"error,omitempty"`
+}
+
+// Batch runs steps on behalf of a client, as seen in its tree. In a
+// transaction every step must be undoable, so files are only deleted or
+// overwritten if the trash or the version history keeps them.
+type Batch struct {
+    tree    *Tree
+    trash    *Trash
+    index    *Index
+    locks    *LockManager
+    audit    *Audit
+    client    string
+    token    string // Lock token of the client, if any.
+    transaction    bool
+}
+
+// batchError is the result of a step that failed with err.
+func batchError(err error) BatchResult {
+    aerr := apiErrorOf(err)
+    return BatchResult{ Status: aerr.Status(), Error: aerr }
+}
+
+// Run runs the steps in order and reports whether all of them succeeded.
+// Steps left out after a failure are skipped, and in a transaction those
+// done before it are undone, latest first.
+func (b *Batch) Run(ops []BatchOp, mode string) ([]BatchResult, bool) {
+    if b.transaction {
+        // What the steps discard must still be there to be put back.
+        release := b.trash.Hold()
+        defer release()
+    }
+    results := make([]BatchResult, len(ops))
+    undos := make([]Undo, len(ops))
+    failed := false
+    for i, op := range ops {
+        if failed && mode != "continue" {
+            results[i] = batchError(NewAPIError("skipped"))
+            continue
+        }
+        undo, err := b.step(op)
+        if err != nil {
+            results[i] = batchError(err)
+            failed = true
+            continue
+        }
+        results[i], undos[i] = BatchResult{ Status: http.StatusOK }, undo
+    }
+    if failed && b.transaction {
+        for i := len(ops) - 1; i >= 0; i-- {
+            if results[i].Status != http.StatusOK {
+                continue
+            }
+            if undos[i] == nil || undos[i]() != nil {
+                results[i] = batchError(NewAPIError("rollback_failed"))
+            } else {
+                results[i] = batchError(NewAPIError("rolled_back"))
+            }
+        }
+    }
+    for i, op := range ops {
+        if results[i].Error == nil || results[i].Error.Code != "skipped" {
+            b.log(op, results[i])
+        }
+    }
+    return results, !failed
+}
+
+func (b *Batch) step(op BatchOp) (Undo, error) {
+    switch op.Op {
+    case "move":
+        if len(op.From) == 0 || len(op.To) == 0 {
+            break
+        }
+        return b.move(op)
+    case "copy":
+        if len(op.From) == 0 || len(op.To) == 0 {
+            break
+        }
+        return b.copy(op)
+    case "delete":
+        if len(op.Path) == 0 {
+            break
+        }
+        return b.delete(op)
+    case "mkdir":
+        if len(op.Path) == 0 {
+            break
+        }
+        return b.mkdir(op)
+    }
+    return nil, NewAPIError("invalid_operation")
+}
+
+// acquire locks the named entries for the duration of a step.
+func (b *Batch) acquire(names ...[]string) (func(), error) {
+    lockNames := []string{}
+    for _, parts := range names {
+        lockNames = append(lockNames, lockName(parts))
+    }
+    return b.locks.Acquire(b.token, lockNames...)
+}
+
+// replace keeps the file at loc before a step overwrites it, and returns how
+// to put it back. Transactions refuse to overwrite files that would be gone
+// for good, which trash.replace leaves in place.
+func (b *Batch) replace(parts []string, loc string) (Undo, error) {
+    info, err := b.tree.Storage().Stat(loc)
+    exists := err == nil && !info.IsDir()
+    undo, err := b.trash.replace(b.tree, parts, loc)
+    if err == nil && exists && undo == nil && b.transaction {
+        return nil, ErrNotUndoable
+    }
+    return undo, err
+}
+
+func (b *Batch) move(op BatchOp) (Undo, error) {
+    t := b.tree
+    _, from, err := t.Locate(op.From, PermDelete, true)
+    if err != nil {
+        return nil, err
+    }
+    _, to, err := t.Locate(op.To, PermWrite, false)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkPreconditions(t.Storage(), to, op.IfMatch, op.IfNoneMatch); err != nil {
+        return nil, err
+    }
+    if err := t.CheckTypeOf(op.To, from); err != nil {
+        return nil, err
+    }
+    if err := t.CheckSpace(op.To, diskUsage(t.Storage(), from), op.From); err != nil {
+        return nil, err
+    }
+    release, err := b.acquire(op.From, op.To)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+    // Moving an entry onto itself, such as to change the case of its name,
+    // replaces nothing.
+    var restore Undo
+    if !sameEntry(t.Storage(), from, to) {
+        if restore, err = b.replace(op.To, to); err != nil {
+            return nil, err
+        }
+    }
+    if err := moveEntry(t.Storage(), from, to, nil); err != nil {
+        if restore != nil {
+            restore()
+        }
+        return nil, err
+    }
+    b.index.Refresh(op.From)
+    b.index.Refresh(op.To)
+    return func() error {
+        if err := moveEntry(t.Storage(), to, from, nil); err != nil {
+            return err
+        }
+        b.index.Refresh(op.From)
+        b.index.Refresh(op.To)
+        if restore != nil {
+            return restore()
+        }
+        return nil
+    }, nil
+}
+
+func (b *Batch) copy(op BatchOp) (Undo, error) {
+    t := b.tree
+    _, from, err := t.Locate(op.From, PermRead, true)
+    if err != nil {
+        return nil, err
+    }
+    _, to, err := t.Locate(op.To, PermWrite, false)
+    if err != nil {
+        return nil, err
+    }
+    info, err := t.Storage().Stat(from)
+    if err != nil {
+        return nil, err
+    } else if info.IsDir() {
+        return nil, &fs.PathError{ Op: "copy", Path: from, Err: ErrIsDirectory }
+    }
+    if sameEntry(t.Storage(), from, to) {
+        return nil, ErrSameEntry
+    }
+    if err := checkPreconditions(t.Storage(), to, op.IfMatch, op.IfNoneMatch); err != nil {
+        return nil, err
+    }
+    if err := t.CheckTypeOf(op.To, from); err != nil {
+        return nil, err
+    }
+    if err := t.CheckSpace(op.To, info.Size(), nil); err != nil {
+        return nil, err
+    }
+    release, err := b.acquire(op.To)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+    restore, err := b.replace(op.To, to)
+    if err != nil {
+        return nil, err
+    }
+    if err := copyFile(t.Storage(), from, to, &transfer{ total: info.Size() }); err != nil {
+        if restore != nil {
+            restore()
+        }
+        return nil, err
+    }
+    b.index.Refresh(op.To)
+    return func() error {
+        if err := t.Storage().Remove(to); err != nil {
+            return err
+        }
+        b.index.Refresh(op.To)
+        if restore != nil {
+            return restore()
+        }
+        return nil
+    }, nil
+}
+
+func (b *Batch) delete(op BatchOp) (Undo, error) {
+    _, loc, err := b.tree.Locate(op.Path, PermDelete, true)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkPreconditions(b.tree.Storage(), loc, op.IfMatch, op.IfNoneMatch); err != nil {
+        return nil, err
+    }
+    if b.transaction && !b.trash.Keeps(b.tree, op.Path) {
+        return nil, ErrNotUndoable
+    }
+    release, err := b.acquire(op.Path)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+    undo, err := b.trash.delete(b.tree, op.Path)
+    if err != nil {
+        return nil, err
+    }
+    b.index.Refresh(op.Path)
+    return func() error {
+        if undo == nil {
+            return ErrNotUndoable
+        }
+        if err := undo(); err != nil {
+            return err
+        }
+        b.index.Refresh(op.Path)
+        return nil
+    }, nil
+}
+
+func (b *Batch) mkdir(op BatchOp) (Undo, error) {
+    t := b.tree
+    _, loc, err := t.Locate(op.Path, PermCreate, false)
+    if err != nil {
+        return nil, err
+    }
+    release, err := b.acquire(op.Path)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+    if err := t.Storage().Mkdir(loc, 0o755); err != nil {
+        return nil, err
+    }
+    return func() error { return t.Storage().Remove(loc) }, nil
+}
+
+// log adds a step to the audit log with its final result.
+func (b *Batch) log(op BatchOp, result BatchResult) {
+    if b.audit == nil {
+        return
+    }
+    entry := AuditEntry{
+        Time: time.Now(),
+        Client: b.client,
+        Via: "http",
+        Action: op.Op,
+        Path: strings.Join(op.Path, "/"),
+        Status: result.Status,
+        Outcome: auditOutcome(result.Status),
+    }
+    parts := op.Path
+    if op.Op == "move" || op.Op == "copy" {
+        parts = op.From
+        entry.Path, entry.Target = strings.Join(op.From, "/"), strings.Join(op.To, "/")
+    }
+    entry.Flag = b.audit.flagOf(parts, b.client)
+    b.audit.Log(entry)
+}
\ No newline at end of file
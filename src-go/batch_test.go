@@ -0,0 +1,115 @@
+package main
+
+import (
+    "net/http"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func newBatch(t *testing.T, edit func(c *Config)) (*Batch, string) {
+    root := t.TempDir()
+    writeFiles(t, root, map[string]string{
+        "a.txt": "a",
+        "b.txt": "b",
+        "c.txt": "c",
+        "dir/d.txt": "d",
+    })
+    useConfig(t, func(c *Config) {
+        c.Tree.DefaultFlag = "readwrite"
+        if edit != nil {
+            edit(c)
+        }
+    })
+    tree := CreateTree(root)
+    return &Batch{ tree: tree, trash: OpenTrash(tree, OpenVersions(tree)), locks: NewLockManager(), transaction: true }, root
+}
+
+func readFiles(t *testing.T, root string, names ...string) map[string]string {
+    contents := map[string]string{}
+    for _, name := range names {
+        if data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name))); err == nil {
+            contents[name] = string(data)
+        }
+    }
+    return contents
+}
+
+func TestBatchKeepsTrashUntilDone(t *testing.T) {
+    // The trash only has room for one of the files.
+    b, root := newBatch(t, func(c *Config) { c.Trash.MaxSize = 1 })
+    ops := []BatchOp{
+        { Op: "delete", Path: []string{ "a.txt" } },
+        { Op: "delete", Path: []string{ "b.txt" } },
+        { Op: "delete", Path: []string{ "missing.txt" } },
+    }
+    results, _ := b.Run(ops, "transaction")
+    if results[0].Error == nil || results[0].Error.Code != "rolled_back" || results[1].Error == nil || results[1].Error.Code != "rolled_back" {
+        t.Fatalf("results: %+v", results)
+    }
+    if contents := readFiles(t, root, "a.txt", "b.txt"); len(contents) != 2 {
+        t.Fatalf("after rollback: %v", contents)
+    }
+
+    if _, ok := b.Run(ops[:2], "transaction"); !ok {
+        t.Fatal("the batch failed")
+    }
+    if items := b.trash.List(b.tree); len(items) != 1 || items[0].Path[0] != "b.txt" {
+        t.Fatalf("the trash was not expired after the batch: %+v", items)
+    }
+}
+
+func TestBatchRollback(t *testing.T) {
+    b, root := newBatch(t, nil)
+    results, ok := b.Run([]BatchOp{
+        { Op: "move", From: []string{ "a.txt" }, To: []string{ "moved.txt" } },
+        { Op: "copy", From: []string{ "b.txt" }, To: []string{ "c.txt" } },
+        { Op: "delete", Path: []string{ "dir" } },
+        { Op: "mkdir", Path: []string{ "new" } },
+        { Op: "move", From: []string{ "missing.txt" }, To: []string{ "x.txt" } },
+        { Op: "delete", Path: []string{ "b.txt" } },
+    }, "transaction")
+    if ok {
+        t.Fatal("the batch succeeded")
+    }
+    for i, want := range []string{ "rolled_back", "rolled_back", "rolled_back", "rolled_back", "not_found", "skipped" } {
+        if results[i].Error == nil || results[i].Error.Code != want {
+            t.Errorf("step %d: %+v, expected %s", i, results[i], want)
+        }
+    }
+    contents := readFiles(t, root, "a.txt", "b.txt", "c.txt", "dir/d.txt", "moved.txt")
+    if len(contents) != 4 || contents["a.txt"] != "a" || contents["b.txt"] != "b" || contents["c.txt"] != "c" || contents["dir/d.txt"] != "d" {
+        t.Fatalf("after rollback: %v", contents)
+    }
+    if _, err := os.Stat(filepath.Join(root, "new")); err == nil {
+        t.Fatal("the new directory was kept")
+    }
+}
+
+func TestBatchCommits(t *testing.T) {
+    b, root := newBatch(t, nil)
+    results, ok := b.Run([]BatchOp{
+        { Op: "move", From: []string{ "a.txt" }, To: []string{ "moved.txt" } },
+        { Op: "delete", Path: []string{ "c.txt" } },
+    }, "transaction")
+    if !ok || results[0].Status != http.StatusOK || results[1].Status != http.StatusOK {
+        t.Fatalf("results: %+v", results)
+    }
+    if contents := readFiles(t, root, "a.txt", "c.txt", "moved.txt"); len(contents) != 1 || contents["moved.txt"] != "a" {
+        t.Fatalf("after commit: %v", contents)
+    }
+}
+
+func TestBatchRefusesLosses(t *testing.T) {
+    b, root := newBatch(t, func(c *Config) { c.Trash.Enabled = false })
+    results, ok := b.Run([]BatchOp{
+        { Op: "delete", Path: []string{ "a.txt" } },
+        { Op: "copy", From: []string{ "b.txt" }, To: []string{ "c.txt" } },
+    }, "continue")
+    if ok || results[0].Status == http.StatusOK || results[1].Status == http.StatusOK {
+        t.Fatalf("results: %+v", results)
+    }
+    if contents := readFiles(t, root, "a.txt", "c.txt"); contents["a.txt"] != "a" || contents["c.txt"] != "c" {
+        t.Fatalf("files were lost: %v", contents)
+    }
+}
\ No newline at end of file
@@ -15,6 +15,8 @@ type AssocSection struct {
 type TreeSection struct {
     DefaultFlag    string
     RulesFile    string
+    PolicyFile    string
+    PolicyMode    string
     ShowHidden    bool
     CachePolicy    string
 }
@@ -23,12 +25,97 @@ type HttpSection struct {
     Host    string
     Port    int
     Debug    bool
+    TrustedProxies    []string
+}
+
+type IndexSection struct {
+    Enabled        bool
+    Location    string
+    Extensions    []string
+    MaxFileSize    int64
+    Interval    int
+}
+
+type SftpSection struct {
+    Enabled            bool
+    Host            string
+    Port            int
+    HostKey            string
+    Users            map[string]string
+    AuthorizedKeys    string
+}
+
+type TrashSection struct {
+    Enabled        bool
+    Location    string
+    MaxAge        int
+    MaxSize        int64
+}
+
+type LimitsSection struct {
+    DownloadRate        int64
+    UploadRate            int64
+    ClientDownloadRate    int64
+    ClientUploadRate    int64
+    MaxClientUploads    int
+    MaxConnections        int
+    MetadataRate        float64
+    MetadataBurst        int
+    MinFreeSpace        int64
+}
+
+type AdminSection struct {
+    Host    string
+    Port    int
+    Token    string
+}
+
+type LocksSection struct {
+    MaxTimeout    int
+}
+
+type AuditSection struct {
+    Enabled        bool
+    Location    string
+    MaxSize        int64
+    MaxAge        int
+}
+
+type S3User struct {
+    AccessKey    string
+    SecretKey    string
+}
+
+type S3Section struct {
+    Enabled    bool
+    Host    string
+    Port    int
+    Region    string
+    Bucket    string
+    Users    map[string]S3User
+}
+
+// Mount publishes a directory as a top-level entry of a namespace.
+type Mount struct {
+    Name        string
+    Path        string
+    DefaultFlag    string // Tree.DefaultFlag if empty.
+    RulesFile    string // Tree.RulesFile if empty.
 }
 
 type Config struct {
     Assoc    AssocSection
     Tree    TreeSection
     Http    HttpSection
+    Index    IndexSection
+    Sftp    SftpSection
+    S3        S3Section
+    Trash    TrashSection
+    Audit    AuditSection
+    Admin    AdminSection
+    Limits    LimitsSection
+    Locks    LocksSection
+    Mounts    []Mount
 }
 
 var cfgCache *Config
@@ -43,6 +130,8 @@ var defConfig = Config{
     Tree: TreeSection{
         DefaultFlag: "readonly",
         RulesFile: ".rules.yml",
+        PolicyFile: "",
+        PolicyMode: "merge",
         ShowHidden: false,
         CachePolicy: "always",
     },
@@ -50,7 +139,67 @@ var defConfig = Config{
         Host: "0.0.0.0",
         Port: 8080,
         Debug: false,
+        TrustedProxies: []string{},
+    },
+    Index: IndexSection{
+        Enabled: false,
+        Location: "${USERPROFILE}\\.sagasu-index",
+        Extensions: []string{
+            ".txt", ".md", ".log", ".csv", ".json", ".xml", ".yml", ".yaml", ".toml", ".ini",
+            ".html", ".css", ".js", ".ts", ".vue", ".go", ".py", ".java", ".c", ".h", ".cpp", ".cs", ".rs",
+            ".docx", ".xlsx", ".pdf",
+        },
+        MaxFileSize: 16 << 20,
+        Interval: 300,
+    },
+    Sftp: SftpSection{
+        Enabled: false,
+        Host: "0.0.0.0",
+        Port: 2022,
+        HostKey: "${USERPROFILE}\\.sagasu-host-key",
+        Users: map[string]string{},
+        AuthorizedKeys: "",
+    },
+    S3: S3Section{
+        Enabled: false,
+        Host: "0.0.0.0",
+        Port: 9000,
+        Region: "us-east-1",
+        Bucket: "sagasu",
+        Users: map[string]S3User{},
+    },
+    Trash: TrashSection{
+        Enabled: true,
+        Location: "",
+        MaxAge: 30,
+        MaxSize: 1 << 30,
+    },
+    Audit: AuditSection{
+        Enabled: false,
+        Location: "${USERPROFILE}\\.sagasu-audit",
+        MaxSize: 64 << 20,
+        MaxAge: 90,
+    },
+    Admin: AdminSection{
+        Host: "127.0.0.1",
+        Port: 0,
+        Token: "",
+    },
+    Limits: LimitsSection{
+        DownloadRate: 0,
+        UploadRate: 0,
+        ClientDownloadRate: 0,
+        ClientUploadRate: 0,
+        MaxClientUploads: 0,
+        MaxConnections: 0,
+        MetadataRate: 0,
+        MetadataBurst: 20,
+        MinFreeSpace: 0,
+    },
+    Locks: LocksSection{
+        MaxTimeout: 86400,
     },
+    Mounts: []Mount{},
 }
 
 func cfg() *Config {
@@ -58,6 +207,13 @@ func cfg() *Config {
         cfgCache = new(Config)
         loaded := false
         for _, path := range strings.Split(cfgPath, ";") {
+            // Start from the defaults so that sections missing from older
+            // config files keep sensible values.
+            *cfgCache = defConfig
+            cfgCache.Assoc.Custom = map[string]Assoc{}
+            cfgCache.Sftp.Users = map[string]string{}
+            cfgCache.S3.Users = map[string]S3User{}
+            cfgCache.Mounts = []Mount{}
             _, err := toml.DecodeFile(path, cfgCache)
             if err == nil { 
                 loaded = true
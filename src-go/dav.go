@@ -0,0 +1,226 @@
+package main
+
+import (
+    "context"
+    "io"
+    "io/fs"
+    "net/http"
+    "net/netip"
+    "os"
+
+    "golang.org/x/net/webdav"
+)
+
+// DavFS exposes a tree as a webdav.FileSystem, resolving every operation
+// through the same rules as the HTTP API.
+type DavFS struct {
+    tree    *Tree
+    index    *Index
+    trash    *Trash
+}
+
+type davDir struct {
+    File
+    tree    *Tree
+    pending    []fs.FileInfo
+    read    bool
+}
+
+type davFile struct {
+    File
+    dav        *DavFS
+    parts    []string
+}
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+func NewDavHandler(tree *Tree, index *Index, trash *Trash, locks *LockManager) http.Handler {
+    return &webdav.Handler{
+        Prefix: "/dav",
+        FileSystem: &DavFS{ tree: tree, index: index, trash: trash },
+        LockSystem: locks,
+    }
+}
+
+// davClientKey holds the address of the client in the context of a request.
+type davClientKey struct{}
+
+// treeOf returns the tree as seen by the client of the request ctx belongs
+// to.
+func (d *DavFS) treeOf(ctx context.Context) *Tree {
+    addr, _ := ctx.Value(davClientKey{}).(netip.Addr)
+    return d.tree.For(addr)
+}
+
+func (d *DavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+    tree := d.treeOf(ctx)
+    parts := splitPath(name)
+    if len(parts) == 0 {
+        return fs.ErrExist
+    }
+    _, loc, err := tree.Locate(parts, PermCreate, false)
+    if err != nil {
+        return fsError(err)
+    }
+    return tree.Storage().Mkdir(loc, perm)
+}
+
+func (d *DavFS) OpenFile(ctx context.Context, name string, oflag int, perm os.FileMode) (webdav.File, error) {
+    tree := d.treeOf(ctx)
+    parts := splitPath(name)
+    if len(parts) == 0 {
+        if oflag & writeFlags != 0 {
+            return nil, fs.ErrPermission
+        }
+        fp, err := tree.Storage().Open(tree.AbsPath())
+        if err != nil {
+            return nil, err
+        }
+        return &davDir{ File: fp, tree: tree }, nil
+    }
+    if oflag & writeFlags != 0 {
+        _, loc, err := tree.Locate(parts, PermWrite, false)
+        if err != nil {
+            return nil, fsError(err)
+        }
+        if oflag & os.O_TRUNC != 0 {
+            if err := d.trash.Replace(tree, parts, loc); err != nil {
+                return nil, err
+            }
+        }
+        fp, err := tree.Storage().OpenFile(loc, oflag, perm)
+        if err != nil {
+            return nil, err
+        }
+        return &davFile{ File: fp, dav: d, parts: parts }, nil
+    }
+    t, loc, err := tree.Locate(parts, 0, true)
+    if err != nil {
+        return nil, fsError(err)
+    }
+    fp, err := tree.Storage().Open(loc)
+    if err != nil {
+        return nil, err
+    }
+    info, err := fp.Stat()
+    if err != nil {
+        fp.Close()
+        return nil, err
+    }
+    if info.IsDir() {
+        sub := t.Next(parts[len(parts)-1])
+        if sub == nil {
+            fp.Close()
+            return nil, fs.ErrNotExist
+        }
+        return &davDir{ File: fp, tree: sub }, nil
+    }
+    if t.PermsOf(parts[len(parts)-1]) & PermRead == 0 {
+        fp.Close()
+        return nil, fs.ErrPermission
+    }
+    return fp, nil
+}
+
+func (d *DavFS) RemoveAll(ctx context.Context, name string) error {
+    tree := d.treeOf(ctx)
+    parts := splitPath(name)
+    if len(parts) == 0 {
+        return fs.ErrPermission
+    }
+    if err := d.trash.Delete(tree, parts); err != nil {
+        return fsError(err)
+    }
+    d.index.Refresh(parts)
+    return nil
+}
+
+func (d *DavFS) Rename(ctx context.Context, oldName string, newName string) error {
+    tree := d.treeOf(ctx)
+    from, to := splitPath(oldName), splitPath(newName)
+    if len(from) == 0 || len(to) == 0 {
+        return fs.ErrPermission
+    }
+    _, fromLoc, err := tree.Locate(from, PermDelete, true)
+    if err != nil {
+        return fsError(err)
+    }
+    _, toLoc, err := tree.Locate(to, PermWrite, false)
+    if err != nil {
+        return fsError(err)
+    }
+    if err := moveEntry(tree.Storage(), fromLoc, toLoc, nil); err != nil {
+        return err
+    }
+    d.index.Refresh(from)
+    d.index.Refresh(to)
+    return nil
+}
+
+func (d *DavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+    tree := d.treeOf(ctx)
+    parts := splitPath(name)
+    if len(parts) == 0 {
+        return tree.Storage().Stat(tree.AbsPath())
+    }
+    _, loc, err := tree.Locate(parts, 0, true)
+    if err != nil {
+        return nil, fsError(err)
+    }
+    return tree.Storage().Stat(loc)
+}
+
+// removable reports whether every entry below t may be deleted, so that
+// recursive deletes cannot take readonly or invisible entries with them.
+func removable(t *Tree) bool {
+    entries, err := t.Storage().ReadDir(t.AbsPath())
+    if err != nil {
+        return false
+    }
+    for _, entry := range entries {
+        if t.PermsOf(entry.Name()) & PermDelete == 0 {
+            return false
+        }
+        if entry.IsDir() {
+            if next := t.Next(entry.Name()); next == nil || !removable(next) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+    if !d.read {
+        infos, err := d.File.Readdir(0)
+        if err != nil {
+            return nil, err
+        }
+        for _, info := range infos {
+            if d.tree.Hidden(info.Name()) { continue }
+            d.pending = append(d.pending, info)
+        }
+        d.read = true
+    }
+    if count <= 0 {
+        infos := d.pending
+        d.pending = nil
+        return infos, nil
+    }
+    if len(d.pending) == 0 {
+        return nil, io.EOF
+    }
+    n := min(count, len(d.pending))
+    infos := d.pending[:n]
+    d.pending = d.pending[n:]
+    return infos, nil
+}
+
+func (f *davFile) Close() error {
+    err := f.File.Close()
+    f.dav.index.Refresh(f.parts)
+    if cfg().Tree.CachePolicy == "upload" {
+        f.dav.tree.Reload()
+    }
+    return err
+}
\ No newline at end of file
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// davRequest sends a WebDAV request to handler and returns the response.
+func davRequest(handler http.Handler, method string, target string, body string, headers ...string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    for i := 0; i + 1 < len(headers); i += 2 {
+        r.Header.Set(headers[i], headers[i+1])
+    }
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    return w
+}
+
+func TestDavRules(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    tree := memTree(t, map[string]string{
+        ".rules.yml": "readonly: [ro.txt]\ninvisible: [secret.txt]\ndropbox: [inbox]",
+        "ro.txt": "ro",
+        "rw.txt": "rw",
+        "secret.txt": "secret",
+        "inbox/theirs.txt": "theirs",
+    })
+    handler := NewDavHandler(tree, nil, OpenTrash(tree, OpenVersions(tree)), NewLockManager())
+    content := func(name string) string {
+        data, _ := readFile(tree.Storage(), name)
+        return string(data)
+    }
+
+    if w := davRequest(handler, "GET", "/dav/ro.txt", ""); w.Code != http.StatusOK || w.Body.String() != "ro" {
+        t.Errorf("reading a readonly file: %d %q", w.Code, w.Body)
+    }
+    for _, target := range []string{ "/dav/secret.txt", "/dav/inbox/theirs.txt" } {
+        if w := davRequest(handler, "GET", target, ""); w.Code != http.StatusNotFound {
+            t.Errorf("reading %s: %d", target, w.Code)
+        }
+    }
+    w := davRequest(handler, "PROPFIND", "/dav/", "", "Depth", "1")
+    if listed, _ := io.ReadAll(w.Body); !strings.Contains(string(listed), "ro.txt") || strings.Contains(string(listed), "secret.txt") || strings.Contains(string(listed), ".rules.yml") {
+        t.Errorf("listing: %s", listed)
+    }
+    w = davRequest(handler, "PROPFIND", "/dav/inbox/", "", "Depth", "1")
+    if listed, _ := io.ReadAll(w.Body); strings.Contains(string(listed), "theirs.txt") {
+        t.Errorf("listing the dropbox: %s", listed)
+    }
+
+    if w := davRequest(handler, "PUT", "/dav/ro.txt", "changed"); w.Code < 400 || content("ro.txt") != "ro" {
+        t.Errorf("writing a readonly file: %d", w.Code)
+    }
+    if w := davRequest(handler, "DELETE", "/dav/ro.txt", ""); w.Code < 400 || content("ro.txt") != "ro" {
+        t.Errorf("deleting a readonly file: %d", w.Code)
+    }
+    if w := davRequest(handler, "MOVE", "/dav/rw.txt", "", "Destination", "/dav/ro.txt"); w.Code < 400 || content("ro.txt") != "ro" || content("rw.txt") != "rw" {
+        t.Errorf("moving onto a readonly file: %d", w.Code)
+    }
+    if w := davRequest(handler, "PUT", "/dav/.rules.yml", "readwrite: [\"*\"]"); w.Code < 400 {
+        t.Errorf("writing the rules file: %d", w.Code)
+    }
+    if w := davRequest(handler, "PUT", "/dav/inbox/theirs.txt", "mine"); w.Code < 400 || content("inbox/theirs.txt") != "theirs" {
+        t.Errorf("overwriting a file of the dropbox: %d", w.Code)
+    }
+
+    if w := davRequest(handler, "PUT", "/dav/inbox/mine.txt", "mine"); w.Code != http.StatusCreated || content("inbox/mine.txt") != "mine" {
+        t.Errorf("dropping a file: %d", w.Code)
+    }
+    if w := davRequest(handler, "MOVE", "/dav/rw.txt", "", "Destination", "/dav/moved.txt"); w.Code != http.StatusCreated || content("moved.txt") != "rw" {
+        t.Errorf("moving a writable file: %d", w.Code)
+    }
+}
+
+func TestDavSpace(t *testing.T) {
+    app, root := newAPI(t, map[string]string{
+        // The rules file takes up 9 of the 25 bytes.
+        ".rules.yml": "quota: 25",
+        "a.txt": "aaaaaaaaaa",
+    }, nil)
+    r := httptest.NewRequest("PUT", "/dav/chunked.txt", strings.NewReader("0123456789"))
+    r.ContentLength = -1
+    w := httptest.NewRecorder()
+    app.ServeHTTP(w, r)
+    if w.Code != http.StatusInsufficientStorage {
+        t.Errorf("putting a chunked body past the quota: %d", w.Code)
+    }
+    if w := davRequest(app, "COPY", "/dav/a.txt", "", "Destination", "/dav/b.txt"); w.Code != http.StatusInsufficientStorage {
+        t.Errorf("copying past the quota: %d", w.Code)
+    }
+    if contents := readFiles(t, root, "chunked.txt", "b.txt"); len(contents) > 0 {
+        t.Fatalf("files were written: %v", contents)
+    }
+
+    if w := davRequest(app, "MOVE", "/dav/a.txt", "", "Destination", "/dav/b.txt"); w.Code != http.StatusCreated {
+        t.Errorf("moving within the quota: %d", w.Code)
+    }
+    r = httptest.NewRequest("PUT", "/dav/chunked.txt", strings.NewReader("0123"))
+    r.ContentLength = -1
+    w = httptest.NewRecorder()
+    app.ServeHTTP(w, r)
+    if contents := readFiles(t, root, "chunked.txt"); w.Code != http.StatusCreated || contents["chunked.txt"] != "0123" {
+        t.Errorf("putting a chunked body within the quota: %d %v", w.Code, contents)
+    }
+}
\ No newline at end of file
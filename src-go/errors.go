@@ -0,0 +1,285 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "golang.org/x/net/webdav"
+)
+
+// languages are those messages are available in, the first being used when
+// a client accepts none of them.
+var languages = []string{ "en", "zh" }
+
+// ErrorCode is a reason requests to the HTTP API fail for, with the status
+// they fail with and a message for each language. Messages may take the
+// arguments of the error, such as a limit or a type.
+type ErrorCode struct {
+    Status        int
+    Messages    map[string]string
+}
+
+// errorCodes are the codes failed requests report. They are part of the API
+// and must not change meaning once published.
+var errorCodes = map[string]ErrorCode{
+    "invalid_request": { http.StatusBadRequest, map[string]string{
+        "en": "The request is malformed.",
+        "zh": "请求格式错误。",
+    } },
+    "invalid_listing": { http.StatusBadRequest, map[string]string{
+        "en": "Invalid listing options: %s.",
+        "zh": "列表参数无效：%s。",
+    } },
+    "invalid_operation": { http.StatusBadRequest, map[string]string{
+        "en": "Unknown operation or missing paths.",
+        "zh": "未知的操作或缺少路径。",
+    } },
+    "invalid_rules": { http.StatusBadRequest, map[string]string{
+        "en": "Invalid rules file: %s.",
+        "zh": "规则配置文件无效：%s。",
+    } },
+    "is_directory": { http.StatusBadRequest, map[string]string{
+        "en": "The source is a directory, which cannot be copied.",
+        "zh": "源为文件夹，无法复制。",
+    } },
+    "unauthorized": { http.StatusUnauthorized, map[string]string{
+        "en": "A valid admin token is required.",
+        "zh": "需要有效的管理令牌。",
+    } },
+    "forbidden": { http.StatusForbidden, map[string]string{
+        "en": "The rules do not allow this operation.",
+        "zh": "访问控制规则不允许该操作。",
+    } },
+    "not_found": { http.StatusNotFound, map[string]string{
+        "en": "The file or folder does not exist.",
+        "zh": "文件或文件夹不存在。",
+    } },
+    "no_such_lock": { http.StatusNotFound, map[string]string{
+        "en": "The lock does not exist or has expired.",
+        "zh": "锁不存在或已过期。",
+    } },
+    "disabled": { http.StatusNotFound, map[string]string{
+        "en": "This feature is not available on this server.",
+        "zh": "服务器未启用该功能。",
+    } },
+    "exists": { http.StatusConflict, map[string]string{
+        "en": "The target already exists.",
+        "zh": "目标已存在。",
+    } },
+    "same_entry": { http.StatusConflict, map[string]string{
+        "en": "The source and the target are the same.",
+        "zh": "源与目标相同。",
+    } },
+    "not_undoable": { http.StatusConflict, map[string]string{
+        "en": "The operation could not be undone, so it was not done in a transaction.",
+        "zh": "该操作无法撤销，因此不能在事务中执行。",
+    } },
+    "precondition_failed": { http.StatusPreconditionFailed, map[string]string{
+        "en": "The target has changed or already exists.",
+        "zh": "目标已被修改或已存在。",
+    } },
+    "max_size": { http.StatusRequestEntityTooLarge, map[string]string{
+        "en": "The file is larger than the limit of %d bytes.",
+        "zh": "文件超出 %d 字节的大小限制。",
+    } },
+    "denied": { http.StatusUnsupportedMediaType, map[string]string{
+        "en": "Files of type %s are denied here.",
+        "zh": "此处禁止 %s 类型的文件。",
+    } },
+    "not_allowed": { http.StatusUnsupportedMediaType, map[string]string{
+        "en": "Files of type %s are not allowed here.",
+        "zh": "此处不允许 %s 类型的文件。",
+    } },
+    "locked": { http.StatusLocked, map[string]string{
+        "en": "The file is locked by someone else.",
+        "zh": "文件已被他人锁定。",
+    } },
+    "skipped": { http.StatusFailedDependency, map[string]string{
+        "en": "Skipped because an earlier operation failed.",
+        "zh": "由于之前的操作失败而未执行。",
+    } },
+    "rolled_back": { http.StatusFailedDependency, map[string]string{
+        "en": "Undone because a later operation failed.",
+        "zh": "由于之后的操作失败而被撤销。",
+    } },
+    "too_many_requests": { http.StatusTooManyRequests, map[string]string{
+        "en": "Too many requests, try again later.",
+        "zh": "请求过多，请稍后再试。",
+    } },
+    "internal": { http.StatusInternalServerError, map[string]string{
+        "en": "Internal server error.",
+        "zh": "服务器内部错误。",
+    } },
+    "mismatch": { http.StatusInternalServerError, map[string]string{
+        "en": "The copy did not match the source and was removed.",
+        "zh": "复制结果与源不一致，已删除。",
+    } },
+    "rollback_failed": { http.StatusInternalServerError, map[string]string{
+        "en": "The operation could not be undone.",
+        "zh": "撤销该操作失败。",
+    } },
+    "not_ready": { http.StatusServiceUnavailable, map[string]string{
+        "en": "Not ready: %s.",
+        "zh": "尚未就绪：%s。",
+    } },
+    "quota": { http.StatusInsufficientStorage, map[string]string{
+        "en": "The directory quota of %d bytes would be exceeded.",
+        "zh": "将超出 %d 字节的文件夹配额。",
+    } },
+    "free_space": { http.StatusInsufficientStorage, map[string]string{
+        "en": "Less than %d bytes of disk space would be left.",
+        "zh": "剩余磁盘空间将少于 %d 字节。",
+    } },
+    "disk_full": { http.StatusInsufficientStorage, map[string]string{
+        "en": "The disk is full.",
+        "zh": "磁盘已满。",
+    } },
+}
+
+// APIError is what failed requests to the HTTP API respond with, as the
+// error field of the body, and what WebSocket connections are closed with.
+type APIError struct {
+    Code    string        `json:"code"`
+    Message    string        `json:"message"`
+    Path    []string    `json:"path,omitempty"` // The entry the error is about, if any.
+    Effect    *Effect        `json:"effect,omitempty"` // The rule that denied access, if any.
+    args    []any
+}
+
+func NewAPIError(code string, args ...any) *APIError {
+    return &APIError{ Code: code, args: args }
+}
+
+func (e *APIError) Error() string {
+    return e.In(languages[0]).Message
+}
+
+// Status is the HTTP status of the error.
+func (e *APIError) Status() int {
+    return errorCodes[e.Code].Status
+}
+
+// In returns the error with its message in lang.
+func (e *APIError) In(lang string) *APIError {
+    localized := *e
+    localized.Message = fmt.Sprintf(errorCodes[e.Code].Messages[lang], e.args...)
+    return &localized
+}
+
+// apiErrorOf tells what the API reports for an error of an operation.
+func apiErrorOf(err error) *APIError {
+    var aerr *APIError
+    var lerr *LocateError
+    var serr *SpaceError
+    var terr *TypeError
+    switch {
+    case errors.As(err, &aerr):
+        return aerr
+    case errors.As(err, &lerr) && errors.Is(lerr.Err, ErrForbidden):
+        return &APIError{ Code: "forbidden", Path: lerr.Path, Effect: lerr.Effect }
+    case errors.As(err, &lerr):
+        return &APIError{ Code: "not_found", Path: lerr.Path }
+    case errors.Is(err, ErrForbidden), errors.Is(err, fs.ErrPermission):
+        return NewAPIError("forbidden")
+    case errors.Is(err, ErrNotFound), errors.Is(err, fs.ErrNotExist):
+        return NewAPIError("not_found")
+    case errors.Is(err, ErrPrecondition):
+        return NewAPIError("precondition_failed")
+    case errors.Is(err, ErrLocked):
+        return NewAPIError("locked")
+    case errors.Is(err, webdav.ErrNoSuchLock):
+        return NewAPIError("no_such_lock")
+    case errors.As(err, &serr):
+        return NewAPIError(serr.Reason, serr.Limit)
+    case errors.As(err, &terr):
+        return NewAPIError(terr.Reason, terr.Type)
+    case isDiskFull(err):
+        return NewAPIError("disk_full")
+    case errors.Is(err, ErrConflict), errors.Is(err, fs.ErrExist):
+        return NewAPIError("exists")
+    case errors.Is(err, ErrSameEntry):
+        return NewAPIError("same_entry")
+    case errors.Is(err, ErrIsDirectory):
+        return NewAPIError("is_directory")
+    case errors.Is(err, ErrMismatch):
+        return NewAPIError("mismatch")
+    case errors.Is(err, ErrNotUndoable):
+        return NewAPIError("not_undoable")
+    case errors.Is(err, ErrTooMany):
+        return NewAPIError("too_many_requests")
+    case errors.Is(err, ErrListOptions):
+        return NewAPIError("invalid_listing", strings.TrimPrefix(err.Error(), ErrListOptions.Error() + ": "))
+    case errors.Is(err, ErrInvalidRules):
+        return NewAPIError("invalid_rules", strings.TrimPrefix(err.Error(), ErrInvalidRules.Error() + ": "))
+    }
+    return NewAPIError("internal")
+}
+
+// languageOf picks the language of messages for a request by the quality
+// values of its Accept-Language header, the earliest winning ties.
+func languageOf(c *gin.Context) string {
+    lang, quality := languages[0], 0.0
+    for _, item := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+        tag, params, _ := strings.Cut(item, ";")
+        q := 1.0
+        if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            var err error
+            if q, err = strconv.ParseFloat(value, 64); err != nil {
+                continue
+            }
+        }
+        primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+        if q > quality && slices.Contains(languages, primary) {
+            lang, quality = primary, q
+        }
+    }
+    return lang
+}
+
+// abortError fails a request with e, adding the given fields to the body.
+func abortError(c *gin.Context, e *APIError, fields ...gin.H) {
+    body := gin.H {
+        "ok": false,
+        "error": e.In(languageOf(c)),
+    }
+    for _, extra := range fields {
+        for key, value := range extra {
+            body[key] = value
+        }
+    }
+    c.AbortWithStatusJSON(e.Status(), body)
+}
+
+// closeReason is the reason a WebSocket connection is closed with for e, in
+// the language of the request. Close frames hold at most 123 bytes, so the
+// message is left out if it does not fit.
+func closeReason(c *gin.Context, e *APIError) string {
+    e = e.In(languageOf(c))
+    reason, _ := json.Marshal(gin.H { "code": e.Code, "message": e.Message })
+    if len(reason) > 123 {
+        reason, _ = json.Marshal(gin.H { "code": e.Code })
+    }
+    return string(reason)
+}
+
+// ErrorCodes returns the error codes in order of their status.
+func ErrorCodes() []string {
+    codes := []string{}
+    for code := range errorCodes {
+        codes = append(codes, code)
+    }
+    slices.SortFunc(codes, func(a string, b string) int {
+        if status := errorCodes[a].Status - errorCodes[b].Status; status != 0 {
+            return status
+        }
+        return strings.Compare(a, b)
+    })
+    return codes
+}
\ No newline at end of file
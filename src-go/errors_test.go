@@ -0,0 +1,18 @@
+package main
+
+import (
+    "io/fs"
+    "net/http"
+    "syscall"
+    "testing"
+)
+
+func TestDiskFull(t *testing.T) {
+    err := &fs.PathError{ Op: "write", Path: "a.txt", Err: syscall.ENOSPC }
+    if aerr := apiErrorOf(err); aerr.Code != "disk_full" || aerr.Status() != http.StatusInsufficientStorage {
+        t.Fatalf("%+v", aerr)
+    }
+    if aerr := apiErrorOf(err).In("zh"); aerr.Message != "磁盘已满。" {
+        t.Fatalf("%+v", aerr)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "strings"
+)
+
+var ErrPrecondition = errors.New("precondition failed")
+
+// fileETag is the strong validator of a file, derived from its modification
+// time and size. It contains a dash so that S3 clients do not mistake it for
+// an MD5 sum.
+func fileETag(info fs.FileInfo) string {
+    return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match style conditions
+// against the file at loc in st. Empty conditions always hold, and "*"
+// matches any existing file.
+func checkPreconditions(st Storage, loc string, ifMatch string, ifNoneMatch string) error {
+    etag := ""
+    if info, err := st.Stat(loc); err == nil && !info.IsDir() {
+        etag = fileETag(info)
+    }
+    if ifMatch != "" && !matchETag(ifMatch, etag) {
+        return ErrPrecondition
+    }
+    if ifNoneMatch != "" && matchETag(ifNoneMatch, etag) {
+        return ErrPrecondition
+    }
+    return nil
+}
+
+// matchETag reports whether etag is in the comma-separated list, using the
+// strong comparison, so weak validators never match.
+func matchETag(list string, etag string) bool {
+    if etag == "" {
+        return false
+    }
+    for _, candidate := range strings.Split(list, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" || candidate == etag {
+            return true
+        }
+    }
+    return false
+}
\ No newline at end of file
@@ -0,0 +1,309 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "compress/zlib"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "unicode/utf16"
+    "unicode/utf8"
+
+    "golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// ExtractText returns at most limit bytes of plain text from the file at path.
+func ExtractText(path string, limit int64) (string, error) {
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".docx":
+        return extractZipXml(path, limit, "word/document.xml")
+    case ".xlsx":
+        return extractZipXml(path, limit, "xl/sharedStrings.xml", "xl/worksheets/")
+    case ".pdf":
+        return extractPdf(path, limit)
+    default:
+        return extractPlain(path, limit)
+    }
+}
+
+func extractPlain(path string, limit int64) (string, error) {
+    fp, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer fp.Close()
+    data, err := io.ReadAll(io.LimitReader(fp, limit))
+    if err != nil {
+        return "", err
+    }
+    if bytes.IndexByte(data, 0) >= 0 {
+        return "", fmt.Errorf("binary content in %s", path)
+    }
+    valid := utf8.Valid(data)
+    // The limit may have split the last rune.
+    for i := 1; i <= 3 && !valid && int64(len(data)) == limit && i < len(data); i++ {
+        valid = utf8.Valid(data[:len(data)-i])
+    }
+    if valid {
+        return strings.ToValidUTF8(string(data), ""), nil
+    }
+    // Most non-UTF-8 text on Chinese Windows systems is GBK.
+    decoded, err := simplifiedchinese.GB18030.NewDecoder().Bytes(data)
+    if err != nil {
+        return "", err
+    }
+    return string(decoded), nil
+}
+
+func extractZipXml(path string, limit int64, names ...string) (string, error) {
+    archive, err := zip.OpenReader(path)
+    if err != nil {
+        return "", err
+    }
+    defer archive.Close()
+    sb := strings.Builder{}
+    for _, file := range archive.File {
+        matched := false
+        for _, name := range names {
+            if file.Name == name || strings.HasSuffix(name, "/") && strings.HasPrefix(file.Name, name) {
+                matched = true
+                break
+            }
+        }
+        if !matched {
+            continue
+        }
+        rc, err := file.Open()
+        if err != nil {
+            return "", err
+        }
+        err = xmlText(rc, &sb, limit)
+        rc.Close()
+        if err != nil {
+            return "", err
+        }
+        if int64(sb.Len()) >= limit {
+            break
+        }
+    }
+    return sb.String(), nil
+}
+
+// xmlText collects the character data of OOXML text (<t>) and cell value
+// (<v>) elements. Values of shared string cells are indices and are skipped.
+func xmlText(r io.Reader, sb *strings.Builder, limit int64) error {
+    decoder := xml.NewDecoder(r)
+    inText, sharedCell := false, false
+    for int64(sb.Len()) < limit {
+        token, err := decoder.Token()
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        switch token := token.(type) {
+        case xml.StartElement:
+            switch token.Name.Local {
+            case "t":
+                inText = true
+            case "v":
+                inText = !sharedCell
+            case "c":
+                sharedCell = false
+                for _, attr := range token.Attr {
+                    if attr.Name.Local == "t" && attr.Value == "s" {
+                        sharedCell = true
+                    }
+                }
+            case "tab":
+                sb.WriteByte('\t')
+            case "br":
+                sb.WriteByte('\n')
+            }
+        case xml.EndElement:
+            switch token.Name.Local {
+            case "t", "v":
+                inText = false
+            case "c":
+                sb.WriteByte('\t')
+            case "p", "si", "row":
+                sb.WriteByte('\n')
+            }
+        case xml.CharData:
+            if inText {
+                sb.Write(token)
+            }
+        }
+    }
+    return nil
+}
+
+// extractPdf is a best-effort extractor: it inflates every stream in the
+// file and collects the string operands of text showing operators. Text in
+// fonts with custom encodings comes out garbled or not at all.
+func extractPdf(path string, limit int64) (string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    if !bytes.HasPrefix(data, []byte("%PDF")) {
+        return "", fmt.Errorf("not a pdf file: %s", path)
+    }
+    sb := strings.Builder{}
+    for rest := data; int64(sb.Len()) < limit; {
+        start := bytes.Index(rest, []byte("stream"))
+        if start < 0 {
+            break
+        }
+        dict := rest[max(0, start-256):start]
+        rest = rest[start+len("stream"):]
+        if bytes.HasSuffix(dict, []byte("end")) {
+            continue
+        }
+        rest = bytes.TrimLeft(rest, "\r\n")
+        end := bytes.Index(rest, []byte("endstream"))
+        if end < 0 {
+            break
+        }
+        content := rest[:end]
+        rest = rest[end+len("endstream"):]
+        if open := bytes.LastIndex(dict, []byte("<<")); open >= 0 {
+            dict = dict[open:]
+        }
+        if bytes.Contains(dict, []byte("/FlateDecode")) {
+            zr, err := zlib.NewReader(bytes.NewReader(content))
+            if err != nil {
+                continue
+            }
+            // Truncated streams still yield their leading content.
+            content, _ = io.ReadAll(io.LimitReader(zr, limit))
+            zr.Close()
+        } else if bytes.Contains(dict, []byte("/Filter")) {
+            continue
+        }
+        pdfContentText(content, &sb)
+    }
+    text := sb.String()
+    if int64(len(text)) > limit {
+        text = strings.ToValidUTF8(text[:limit], "")
+    }
+    return text, nil
+}
+
+func pdfContentText(data []byte, sb *strings.Builder) {
+    pending := []string{}
+    inArray := false
+    for i := 0; i < len(data); i++ {
+        c := data[i]
+        switch {
+        case c == '[' || c == ']':
+            inArray = c == '['
+        case inArray && (c == '-' || c >= '0' && c <= '9'):
+            j := i + 1
+            for j < len(data) && (data[j] == '.' || data[j] >= '0' && data[j] <= '9') {
+                j++
+            }
+            // Large negative adjustments inside TJ arrays stand for spaces.
+            if adjust, err := strconv.ParseFloat(string(data[i:j]), 64); err == nil && adjust < -200 {
+                pending = append(pending, " ")
+            }
+            i = j - 1
+        case c == '%':
+            for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+                i++
+            }
+        case c == '(':
+            s, n := pdfLiteral(data[i:])
+            pending = append(pending, s)
+            i += n - 1
+        case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '\'' || c == '"' || c == '*':
+            j := i
+            for j < len(data) && !strings.ContainsRune(" \t\r\n\f\x00()<>[]{}/%", rune(data[j])) {
+                j++
+            }
+            switch string(data[i:j]) {
+            case "Tj", "TJ":
+                sb.WriteString(strings.Join(pending, ""))
+            case "'", "\"":
+                sb.WriteByte('\n')
+                sb.WriteString(strings.Join(pending, ""))
+            case "Td", "TD":
+                sb.WriteByte(' ')
+            case "T*", "ET":
+                sb.WriteByte('\n')
+            }
+            pending = pending[:0]
+            i = j - 1
+        }
+    }
+}
+
+// pdfLiteral decodes the literal string at the start of data and returns it
+// together with the number of bytes consumed.
+func pdfLiteral(data []byte) (string, int) {
+    buf := []byte{}
+    depth := 0
+    i := 0
+    for ; i < len(data); i++ {
+        c := data[i]
+        if c == '(' {
+            depth++
+            if depth == 1 {
+                continue
+            }
+        } else if c == ')' {
+            depth--
+            if depth == 0 {
+                i++
+                break
+            }
+        } else if c == '\\' && i+1 < len(data) {
+            i++
+            switch e := data[i]; e {
+            case 'n':
+                c = '\n'
+            case 'r':
+                c = '\r'
+            case 't':
+                c = '\t'
+            case 'b':
+                c = '\b'
+            case 'f':
+                c = '\f'
+            case '\r', '\n':
+                continue
+            default:
+                if e >= '0' && e <= '7' {
+                    c = 0
+                    for k := 0; k < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; k++ {
+                        c = c*8 + data[i] - '0'
+                        i++
+                    }
+                    i--
+                } else {
+                    c = e
+                }
+            }
+        }
+        buf = append(buf, c)
+    }
+    if len(buf) >= 2 && buf[0] == 0xfe && buf[1] == 0xff {
+        units := make([]uint16, 0, len(buf)/2)
+        for k := 2; k+1 < len(buf); k += 2 {
+            units = append(units, uint16(buf[k])<<8 | uint16(buf[k+1]))
+        }
+        return string(utf16.Decode(units)), i
+    }
+    runes := make([]rune, 0, len(buf))
+    for _, b := range buf {
+        if b >= 0x20 || b == '\t' || b == '\n' {
+            runes = append(runes, rune(b))
+        }
+    }
+    return string(runes), i
+}
\ No newline at end of file
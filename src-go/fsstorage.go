@@ -0,0 +1,196 @@
+package main
+
+import (
+    "archive/zip"
+    "errors"
+    "io"
+    "io/fs"
+    "sync"
+)
+
+// FSStorage serves a read-only io/fs file system, such as an embedded one or
+// the contents of a zip archive. The root of a tree on it is ".".
+type FSStorage struct {
+    fsys    fs.FS
+}
+
+func NewFSStorage(fsys fs.FS) *FSStorage {
+    return &FSStorage{ fsys: fsys }
+}
+
+func readOnlyError(op string, name string) error {
+    return &fs.PathError{ Op: op, Path: name, Err: fs.ErrPermission }
+}
+
+func (s *FSStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+    return fs.ReadDir(s.fsys, storageKey(name))
+}
+
+func (s *FSStorage) Stat(name string) (fs.FileInfo, error) {
+    return fs.Stat(s.fsys, storageKey(name))
+}
+
+func (s *FSStorage) Open(name string) (File, error) {
+    fp, err := s.fsys.Open(storageKey(name))
+    if err != nil {
+        return nil, err
+    }
+    return &fsFile{ fsys: s.fsys, name: name, file: fp }, nil
+}
+
+func (s *FSStorage) Create(name string) (File, error) {
+    return nil, readOnlyError("open", name)
+}
+
+func (s *FSStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+    if flag != 0 {
+        return nil, readOnlyError("open", name)
+    }
+    return s.Open(name)
+}
+
+func (s *FSStorage) Rename(from string, to string) error {
+    return readOnlyError("rename", from)
+}
+
+func (s *FSStorage) Remove(name string) error {
+    return readOnlyError("remove", name)
+}
+
+func (s *FSStorage) RemoveAll(name string) error {
+    return readOnlyError("remove", name)
+}
+
+func (s *FSStorage) Mkdir(name string, perm fs.FileMode) error {
+    return readOnlyError("mkdir", name)
+}
+
+func (s *FSStorage) ReadOnly() bool {
+    return true
+}
+
+// fsFile adds what File needs to an fs.File. Files that cannot seek, like
+// compressed entries of an archive, are opened again and skipped through.
+type fsFile struct {
+    mu        sync.Mutex
+    fsys    fs.FS
+    name    string
+    file    fs.File
+    offset    int64
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.read(p)
+}
+
+// read must be called with the lock held.
+func (f *fsFile) read(p []byte) (int, error) {
+    n, err := f.file.Read(p)
+    f.offset += int64(n)
+    return n, err
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+    if at, ok := f.file.(io.ReaderAt); ok {
+        return at.ReadAt(p, off)
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if _, err := f.seek(off, io.SeekStart); err != nil {
+        return 0, err
+    }
+    n, err := io.ReadFull(readerFunc(f.read), p)
+    if errors.Is(err, io.ErrUnexpectedEOF) {
+        err = io.EOF
+    }
+    return n, err
+}
+
+func (f *fsFile) Write(p []byte) (int, error) {
+    return 0, readOnlyError("write", f.name)
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.seek(offset, whence)
+}
+
+// seek must be called with the lock held.
+func (f *fsFile) seek(offset int64, whence int) (int64, error) {
+    if seeker, ok := f.file.(io.Seeker); ok {
+        pos, err := seeker.Seek(offset, whence)
+        if err == nil {
+            f.offset = pos
+        }
+        return pos, err
+    }
+    switch whence {
+    case io.SeekCurrent:
+        offset += f.offset
+    case io.SeekEnd:
+        info, err := f.file.Stat()
+        if err != nil {
+            return 0, err
+        }
+        offset += info.Size()
+    }
+    if offset < 0 {
+        return 0, &fs.PathError{ Op: "seek", Path: f.name, Err: fs.ErrInvalid }
+    }
+    if offset < f.offset {
+        file, err := f.fsys.Open(storageKey(f.name))
+        if err != nil {
+            return 0, err
+        }
+        f.file.Close()
+        f.file, f.offset = file, 0
+    }
+    if _, err := io.CopyN(io.Discard, readerFunc(f.read), offset - f.offset); err != nil && err != io.EOF {
+        return 0, err
+    }
+    // Past the end reads stop right away, as they would at the position.
+    f.offset = offset
+    return offset, nil
+}
+
+func (f *fsFile) Close() error {
+    return f.file.Close()
+}
+
+func (f *fsFile) Readdir(count int) ([]fs.FileInfo, error) {
+    dir, ok := f.file.(fs.ReadDirFile)
+    if !ok {
+        return nil, &fs.PathError{ Op: "readdir", Path: f.name, Err: errors.New("not a directory") }
+    }
+    entries, err := dir.ReadDir(count)
+    infos := []fs.FileInfo{}
+    for _, entry := range entries {
+        if info, err := entry.Info(); err == nil {
+            infos = append(infos, info)
+        }
+    }
+    return infos, err
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+    return f.file.Stat()
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (r readerFunc) Read(p []byte) (int, error) {
+    return r(p)
+}
+
+// OpenArchive opens the zip archive at file as a read-only storage, which
+// stays open for the lifetime of the server.
+func OpenArchive(file string) (*FSStorage, error) {
+    reader, err := zip.OpenReader(file)
+    if err != nil {
+        return nil, err
+    }
+    return NewFSStorage(reader), nil
+}
\ No newline at end of file
@@ -0,0 +1,473 @@
+package main
+
+import (
+    "encoding/gob"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "slices"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+
+    "github.com/fsnotify/fsnotify"
+)
+
+type SnippetPart struct {
+    Text    string    `json:"text"`
+    Match    bool    `json:"match"`
+}
+
+type SearchResult struct {
+    Path        []string            `json:"path"`
+    Size        int64                `json:"size"`
+    Time        time.Time            `json:"time"`
+    Score        int                    `json:"score"`
+    Snippets    [][]SnippetPart        `json:"snippets"`
+}
+
+type indexDoc struct {
+    Time    time.Time
+    Size    int64
+    Text    string
+}
+
+type indexData struct {
+    Docs    map[string]*indexDoc        // Keyed by slash-separated path.
+    Terms    map[string]map[string]int    // Term -> document -> occurrences.
+}
+
+// Index is an inverted full-text index over the readable files of a tree,
+// persisted under Index.Location. It follows the changes the watcher reports
+// in the directories it has walked and those made through the handlers,
+// while periodic rescans catch up on any event that was missed. Files are
+// indexed as readable for a client no conditional rule applies to, and
+// Search checks every match again for the client asking.
+type Index struct {
+    mu        sync.RWMutex
+    tree    *Tree
+    file    string
+    dirty    bool
+    data    indexData
+    watcher    *Watcher // Nil if changes are only found by rescans.
+    events    chan fsnotify.Event
+    dirs    map[string][]string // Path of each watched location, guarded by mu.
+}
+
+const snippetContext = 40
+
+// indexSettle is how long changes reported by the watcher must rest before
+// they are indexed, since files are often written in many steps.
+const indexSettle = time.Second
+
+func OpenIndex(tree *Tree, watcher *Watcher) (*Index, error) {
+    dir := os.ExpandEnv(cfg().Index.Location)
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    root := tree.Path
+    if !IsNamespace(root) {
+        root, _ = filepath.Abs(root)
+    }
+    index := &Index{
+        tree: tree,
+        file: filepath.Join(dir, Hash(root) + ".idx"),
+        data: indexData{
+            Docs: map[string]*indexDoc{},
+            Terms: map[string]map[string]int{},
+        },
+        watcher: watcher,
+        events: make(chan fsnotify.Event, 1024),
+        dirs: map[string][]string{},
+    }
+    index.load()
+    go index.run()
+    if watcher != nil {
+        go index.follow()
+    }
+    return index, nil
+}
+
+func (x *Index) run() {
+    for {
+        x.Rescan()
+        if err := x.save(); err != nil {
+            fmt.Println("Warning: cannot save content index:", err)
+        }
+        time.Sleep(time.Duration(cfg().Index.Interval) * time.Second)
+    }
+}
+
+func (x *Index) load() {
+    fp, err := os.Open(x.file)
+    if err != nil {
+        return
+    }
+    defer fp.Close()
+    data := indexData{}
+    if gob.NewDecoder(fp).Decode(&data) == nil && data.Docs != nil && data.Terms != nil {
+        x.data = data
+    }
+}
+
+func (x *Index) save() error {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    if !x.dirty {
+        return nil
+    }
+    tmp := x.file + ".tmp"
+    fp, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    err = gob.NewEncoder(fp).Encode(&x.data)
+    fp.Close()
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err = os.Rename(tmp, x.file); err != nil {
+        return err
+    }
+    x.dirty = false
+    return nil
+}
+
+// Rescan walks the whole tree, indexing new and modified files and dropping
+// files that disappeared or are no longer readable.
+func (x *Index) Rescan() {
+    seen, dirs := map[string]bool{}, map[string][]string{}
+    x.walk(x.tree, nil, seen, dirs)
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    for key := range x.data.Docs {
+        if !seen[key] {
+            x.drop(key)
+        }
+    }
+    for loc := range x.dirs {
+        if _, ok := dirs[loc]; !ok {
+            x.unwatch(loc)
+        }
+    }
+    x.watch(dirs)
+}
+
+// walk indexes the files below t, whose path is parts, recording their keys
+// in seen and the locations of the directories walked in dirs.
+func (x *Index) walk(t *Tree, parts []string, seen map[string]bool, dirs map[string][]string) {
+    entries, err := t.Storage().ReadDir(t.AbsPath())
+    if err != nil {
+        return
+    }
+    dirs[filepath.Clean(t.AbsPath())] = parts
+    for _, entry := range entries {
+        path := append(slices.Clip(parts), entry.Name())
+        if entry.IsDir() {
+            if next := t.Next(entry.Name()); next != nil {
+                x.walk(next, path, seen, dirs)
+            }
+            continue
+        }
+        if t.PermsOf(entry.Name()) & PermRead == 0 || !x.accepts(entry.Name()) {
+            continue
+        }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        key := strings.Join(path, "/")
+        seen[key] = true
+        x.update(key, t.Location(entry.Name()), info)
+    }
+}
+
+func (x *Index) accepts(name string) bool {
+    return slices.Contains(cfg().Index.Extensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// watch has the watcher report the changes in dirs, by location, that are
+// not watched yet. It must be called with the write lock held.
+func (x *Index) watch(dirs map[string][]string) {
+    if x.watcher == nil {
+        return
+    }
+    for loc, parts := range dirs {
+        if _, ok := x.dirs[loc]; !ok && x.watcher.Feed(loc, x.events) == nil {
+            x.dirs[loc] = parts
+        }
+    }
+}
+
+// unwatch stops watching loc. It must be called with the write lock held.
+func (x *Index) unwatch(loc string) {
+    if _, ok := x.dirs[loc]; ok {
+        x.watcher.Unsubscribe(loc, x.events)
+        delete(x.dirs, loc)
+    }
+}
+
+// follow indexes the entries the watcher reports as changed once they have
+// settled. Events dropped while it is busy wait for the next rescan.
+func (x *Index) follow() {
+    pending := map[string]bool{}
+    settle := time.NewTimer(indexSettle)
+    for {
+        select {
+        case ev := <-x.events:
+            pending[filepath.Clean(ev.Name)] = true
+            settle.Reset(indexSettle)
+        case <-settle.C:
+            for loc := range pending {
+                x.mu.RLock()
+                parts, ok := x.dirs[filepath.Dir(loc)]
+                x.mu.RUnlock()
+                if ok {
+                    x.refresh(append(slices.Clip(parts), filepath.Base(loc)))
+                }
+            }
+            clear(pending)
+        }
+    }
+}
+
+// Refresh re-indexes the entry at parts after it has been changed through
+// the API. It is safe to call on a nil index.
+func (x *Index) Refresh(parts []string) {
+    if x == nil || len(parts) == 0 {
+        return
+    }
+    go x.refresh(parts)
+}
+
+// refresh indexes the file at parts, or walks the directory at parts, and
+// drops what is gone from there or cannot be read anymore.
+func (x *Index) refresh(parts []string) {
+    key, name := strings.Join(parts, "/"), parts[len(parts)-1]
+    seen, dirs := map[string]bool{}, map[string][]string{}
+    if t, _ := x.tree.Walk(parts[:len(parts)-1]); t != nil {
+        if next := t.Next(name); next != nil {
+            x.walk(next, parts, seen, dirs)
+        } else if loc := t.Location(name); t.PermsOf(name) & PermRead != 0 && x.accepts(name) {
+            if info, err := t.Storage().Stat(loc); err == nil && !info.IsDir() {
+                seen[key] = true
+                x.update(key, loc, info)
+            }
+        }
+    }
+    below := func(other string) bool {
+        return other == key || strings.HasPrefix(other, key + "/")
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    for doc := range x.data.Docs {
+        if below(doc) && !seen[doc] {
+            x.drop(doc)
+        }
+    }
+    for loc, path := range x.dirs {
+        if _, ok := dirs[loc]; !ok && below(strings.Join(path, "/")) {
+            x.unwatch(loc)
+        }
+    }
+    x.watch(dirs)
+}
+
+func (x *Index) update(key string, loc string, info fs.FileInfo) {
+    x.mu.RLock()
+    doc, ok := x.data.Docs[key]
+    x.mu.RUnlock()
+    if ok && doc.Time.Equal(info.ModTime()) && doc.Size == info.Size() {
+        return
+    }
+    doc = &indexDoc{ Time: info.ModTime(), Size: info.Size() }
+    // Unreadable files are recorded without text so that they are not
+    // extracted again until they change.
+    if info.Size() <= cfg().Index.MaxFileSize {
+        doc.Text, _ = ExtractText(loc, cfg().Index.MaxFileSize)
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.drop(key)
+    x.data.Docs[key] = doc
+    for _, term := range tokenize(doc.Text) {
+        postings, ok := x.data.Terms[term]
+        if !ok {
+            postings = map[string]int{}
+            x.data.Terms[term] = postings
+        }
+        postings[key]++
+    }
+    x.dirty = true
+}
+
+// drop must be called with the write lock held.
+func (x *Index) drop(key string) {
+    doc, ok := x.data.Docs[key]
+    if !ok {
+        return
+    }
+    for _, term := range tokenize(doc.Text) {
+        if postings, ok := x.data.Terms[term]; ok {
+            delete(postings, key)
+            if len(postings) == 0 {
+                delete(x.data.Terms, term)
+            }
+        }
+    }
+    delete(x.data.Docs, key)
+    x.dirty = true
+}
+
+// Search returns the documents containing every term of the query, best
+// matches first. Documents that are not readable in t are skipped.
+func (x *Index) Search(t *Tree, query string, limit int) []SearchResult {
+    terms := tokenize(query)
+    results := []SearchResult{}
+    if len(terms) == 0 {
+        return results
+    }
+    x.mu.RLock()
+    defer x.mu.RUnlock()
+    scores := map[string]int{}
+    for i, term := range terms {
+        next := map[string]int{}
+        for key, count := range x.data.Terms[term] {
+            if score, ok := scores[key]; ok || i == 0 {
+                next[key] = score + count
+            }
+        }
+        scores = next
+    }
+    keys := make([]string, 0, len(scores))
+    for key := range scores {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if scores[keys[i]] != scores[keys[j]] {
+            return scores[keys[i]] > scores[keys[j]]
+        }
+        return keys[i] < keys[j]
+    })
+    for _, key := range keys {
+        if len(results) >= limit {
+            break
+        }
+        parts := strings.Split(key, "/")
+        if _, _, err := t.Locate(parts, PermRead, true); err != nil {
+            continue
+        }
+        doc := x.data.Docs[key]
+        results = append(results, SearchResult{
+            Path: parts,
+            Size: doc.Size,
+            Time: doc.Time,
+            Score: scores[key],
+            Snippets: snippets(doc.Text, query, 3),
+        })
+    }
+    return results
+}
+
+// tokenize splits text into lowercase words. Every CJK character is a
+// token of its own since those scripts do not separate words by spaces.
+func tokenize(text string) []string {
+    tokens := []string{}
+    word := []rune{}
+    flush := func() {
+        if len(word) > 0 && len(word) <= 64 {
+            tokens = append(tokens, string(word))
+        }
+        word = word[:0]
+    }
+    for _, r := range text {
+        r = unicode.ToLower(r)
+        switch {
+        case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+            flush()
+            tokens = append(tokens, string(r))
+        case unicode.IsLetter(r) || unicode.IsDigit(r):
+            word = append(word, r)
+        default:
+            flush()
+        }
+    }
+    flush()
+    return tokens
+}
+
+// snippets cuts up to max fragments around the matches of query in text.
+// Whole query words are highlighted where they occur verbatim, otherwise
+// their individual tokens are.
+func snippets(text string, query string, max int) [][]SnippetPart {
+    runes := []rune(text)
+    lower := make([]rune, len(runes))
+    for i, r := range runes {
+        lower[i] = unicode.ToLower(r)
+    }
+    find := func(needle []rune) [][2]int {
+        found := [][2]int{}
+        for i := 0; len(needle) > 0 && i+len(needle) <= len(lower); i++ {
+            if slices.Equal(lower[i:i+len(needle)], needle) {
+                found = append(found, [2]int{ i, i + len(needle) })
+                i += len(needle) - 1
+            }
+        }
+        return found
+    }
+    matches := [][2]int{}
+    for _, word := range strings.Fields(strings.ToLower(query)) {
+        found := find([]rune(word))
+        if len(found) == 0 {
+            for _, token := range tokenize(word) {
+                found = append(found, find([]rune(token))...)
+            }
+        }
+        matches = append(matches, found...)
+    }
+    sort.Slice(matches, func(i, j int) bool { return matches[i][0] < matches[j][0] })
+
+    result := [][]SnippetPart{}
+    flatten := func(rs []rune) string {
+        return strings.Map(func(r rune) rune {
+            if unicode.IsSpace(r) {
+                return ' '
+            }
+            return r
+        }, string(rs))
+    }
+    for i := 0; i < len(matches) && len(result) < max; {
+        start := matches[i][0] - snippetContext
+        if start < 0 {
+            start = 0
+        }
+        end := matches[i][1] + snippetContext
+        parts := []SnippetPart{}
+        pos := start
+        for ; i < len(matches) && matches[i][0] < end; i++ {
+            if matches[i][0] < pos {
+                continue
+            }
+            if e := matches[i][1] + snippetContext; e > end && e - start <= 4*snippetContext {
+                end = e
+            }
+            if matches[i][0] > pos {
+                parts = append(parts, SnippetPart{ Text: flatten(runes[pos:matches[i][0]]) })
+            }
+            parts = append(parts, SnippetPart{ Text: flatten(runes[matches[i][0]:matches[i][1]]), Match: true })
+            pos = matches[i][1]
+        }
+        if end > len(runes) {
+            end = len(runes)
+        }
+        if pos < end {
+            parts = append(parts, SnippetPart{ Text: flatten(runes[pos:end]) })
+        }
+        result = append(result, parts)
+    }
+    return result
+}
\ No newline at end of file
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "net/netip"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newIndex(t *testing.T, files map[string]string, watcher *Watcher) (*Index, *Tree) {
+    root := t.TempDir()
+    writeFiles(t, root, files)
+    location := t.TempDir()
+    useConfig(t, func(c *Config) {
+        c.Index.Enabled = true
+        c.Index.Location = location
+        c.Index.Interval = 3600
+    })
+    tree := CreateTree(root)
+    index, err := OpenIndex(tree, watcher)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return index, tree
+}
+
+// found waits up to a few seconds for the paths of the files matching query
+// in tree to be want, separated by spaces.
+func found(t *testing.T, index *Index, tree *Tree, query string, want string) {
+    paths := ""
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+        result := []string{}
+        for _, hit := range index.Search(tree, query, 10) {
+            result = append(result, strings.Join(hit.Path, "/"))
+        }
+        if paths = strings.Join(result, " "); paths == want {
+            return
+        }
+    }
+    t.Fatalf("%s: found %q, expected %q", query, paths, want)
+}
+
+func TestIndexFollowsChanges(t *testing.T) {
+    watcher, err := NewWatcher()
+    if err != nil {
+        t.Fatal(err)
+    }
+    index, tree := newIndex(t, map[string]string{ "a.txt": "apple", "old/b.txt": "banana" }, watcher)
+    found(t, index, tree, "apple", "a.txt")
+    found(t, index, tree, "banana", "old/b.txt")
+
+    writeFiles(t, tree.Path, map[string]string{ "a.txt": "apricot", "new/deep/c.txt": "cherry" })
+    found(t, index, tree, "apricot", "a.txt")
+    found(t, index, tree, "apple", "")
+    found(t, index, tree, "cherry", "new/deep/c.txt")
+
+    if err := os.Rename(filepath.Join(tree.Path, "old"), filepath.Join(tree.Path, "new", "moved")); err != nil {
+        t.Fatal(err)
+    }
+    found(t, index, tree, "banana", "new/moved/b.txt")
+    if err := os.RemoveAll(filepath.Join(tree.Path, "new")); err != nil {
+        t.Fatal(err)
+    }
+    found(t, index, tree, "cherry", "")
+    found(t, index, tree, "banana", "")
+}
+
+func TestIndexSearchFollowsClients(t *testing.T) {
+    index, tree := newIndex(t, map[string]string{
+        ".rules.yml": "invisible:\n  - patterns: [secret.txt]\n    clients: [10.0.0.0/8]\n",
+        "secret.txt": "classified",
+    }, nil)
+    index.Refresh([]string{ "secret.txt" })
+    found(t, index, tree.For(netip.MustParseAddr("192.168.1.1")), "classified", "secret.txt")
+    found(t, index, tree.For(netip.MustParseAddr("10.1.2.3")), "classified", "")
+}
\ No newline at end of file
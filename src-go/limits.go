@@ -0,0 +1,294 @@
+package main
+
+import (
+    "errors"
+    "io"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+var ErrTooMany = errors.New("too many requests")
+
+// throttleChunk is the largest write or read done before waiting for the
+// rate limits, so that big buffers do not arrive in bursts.
+const throttleChunk = 32 << 10
+
+// bucket is a token bucket refilled at rate tokens per second up to burst.
+// A nil bucket never limits anything.
+type bucket struct {
+    mu        sync.Mutex
+    rate    float64
+    burst    float64
+    tokens    float64
+    last    time.Time
+}
+
+func newBucket(rate float64, burst float64) *bucket {
+    if rate <= 0 {
+        return nil
+    }
+    return &bucket{ rate: rate, burst: burst, tokens: burst, last: time.Now() }
+}
+
+// refill adds the tokens earned since the last call. The caller must hold
+// b.mu.
+func (b *bucket) refill(now time.Time) {
+    b.tokens = min(b.burst, b.tokens + now.Sub(b.last).Seconds() * b.rate)
+    b.last = now
+}
+
+// Allow takes a token if one is left.
+func (b *bucket) Allow() bool {
+    if b == nil {
+        return true
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.refill(time.Now())
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// Wait takes n tokens, going into debt if needed, and sleeps until the debt
+// is paid off. Concurrent waiters thus share the rate.
+func (b *bucket) Wait(n int) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.refill(time.Now())
+    b.tokens -= float64(n)
+    delay := time.Duration(0)
+    if b.tokens < 0 {
+        delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+    }
+    b.mu.Unlock()
+    time.Sleep(delay)
+}
+
+type clientLimits struct {
+    download    *bucket
+    upload        *bucket
+    metadata    *bucket
+    uploads        int
+    seen        time.Time
+}
+
+// Limiter enforces the [Limits] section across the HTTP API, WebDAV, S3 and
+// SFTP. Clients are told apart by their IP address.
+type Limiter struct {
+    mu            sync.Mutex
+    download    *bucket
+    upload        *bucket
+    clients        map[string]*clientLimits
+    pruned        time.Time
+    conns        chan struct{} // Nil if connections are not limited.
+}
+
+func NewLimiter() *Limiter {
+    limits := cfg().Limits
+    l := &Limiter{
+        download: newBucket(float64(limits.DownloadRate), float64(limits.DownloadRate)),
+        upload: newBucket(float64(limits.UploadRate), float64(limits.UploadRate)),
+        clients: map[string]*clientLimits{},
+        pruned: time.Now(),
+    }
+    if limits.MaxConnections > 0 {
+        l.conns = make(chan struct{}, limits.MaxConnections)
+    }
+    return l
+}
+
+func (l *Limiter) client(addr string) *clientLimits {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    if now.Sub(l.pruned) > time.Minute {
+        // Forget idle clients, whose buckets would be full anyway.
+        for key, client := range l.clients {
+            if client.uploads == 0 && now.Sub(client.seen) > 10 * time.Minute {
+                delete(l.clients, key)
+            }
+        }
+        l.pruned = now
+    }
+    client, ok := l.clients[addr]
+    if !ok {
+        limits := cfg().Limits
+        client = &clientLimits{
+            download: newBucket(float64(limits.ClientDownloadRate), float64(limits.ClientDownloadRate)),
+            upload: newBucket(float64(limits.ClientUploadRate), float64(limits.ClientUploadRate)),
+            metadata: newBucket(limits.MetadataRate, float64(max(limits.MetadataBurst, 1))),
+        }
+        l.clients[addr] = client
+    }
+    client.seen = now
+    return client
+}
+
+func (l *Limiter) WaitDownload(addr string, n int) {
+    l.download.Wait(n)
+    l.client(addr).download.Wait(n)
+}
+
+func (l *Limiter) WaitUpload(addr string, n int) {
+    l.upload.Wait(n)
+    l.client(addr).upload.Wait(n)
+}
+
+// AllowMetadata reports whether a client may make another metadata request.
+func (l *Limiter) AllowMetadata(addr string) bool {
+    return l.client(addr).metadata.Allow()
+}
+
+// StartUpload takes one of the upload slots of a client. The returned
+// function gives it back.
+func (l *Limiter) StartUpload(addr string) (func(), bool) {
+    client := l.client(addr)
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if maxUploads := cfg().Limits.MaxClientUploads; maxUploads > 0 && client.uploads >= maxUploads {
+        return nil, false
+    }
+    client.uploads++
+    return sync.OnceFunc(func() {
+        l.mu.Lock()
+        client.uploads--
+        l.mu.Unlock()
+    }), true
+}
+
+// Connect takes one of the connection slots shared by all servers. The
+// returned function gives it back.
+func (l *Limiter) Connect() (func(), bool) {
+    if l.conns == nil {
+        return func() {}, true
+    }
+    select {
+    case l.conns <- struct{}{}:
+        return sync.OnceFunc(func() { <-l.conns }), true
+    default:
+        return nil, false
+    }
+}
+
+// throttle writes p in chunks, waiting before each one.
+func throttle(p []byte, wait func(int), write func([]byte) (int, error)) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        chunk := p[:min(len(p), throttleChunk)]
+        wait(len(chunk))
+        n, err := write(chunk)
+        written += n
+        if err != nil {
+            return written, err
+        }
+        p = p[n:]
+    }
+    return written, nil
+}
+
+type throttledWriter struct {
+    http.ResponseWriter
+    wait    func(int)
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+    return throttle(p, w.wait, w.ResponseWriter.Write)
+}
+
+// ginThrottledWriter is a throttledWriter that can replace the writer of a
+// gin context.
+type ginThrottledWriter struct {
+    gin.ResponseWriter
+    wait    func(int)
+}
+
+func (w *ginThrottledWriter) Write(p []byte) (int, error) {
+    return throttle(p, w.wait, w.ResponseWriter.Write)
+}
+
+func (w *ginThrottledWriter) WriteString(s string) (int, error) {
+    return w.Write([]byte(s))
+}
+
+type throttledReader struct {
+    io.ReadCloser
+    wait    func(int)
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+    n, err := r.ReadCloser.Read(p[:min(len(p), throttleChunk)])
+    r.wait(n)
+    return n, err
+}
+
+// metadataRoutes are the routes limited by Limits.MetadataRate, along with
+// PROPFIND on WebDAV.
+var metadataRoutes = map[string]bool{
+    "/tree/*path": true,
+    "/search/content": true,
+    "/versions/*path": true,
+    "/trash": true,
+}
+
+var adminRoutes = map[string]bool{
+    "/metrics": true,
+    "/healthz": true,
+    "/readyz": true,
+}
+
+func abortTooMany(c *gin.Context) {
+    c.Header("Retry-After", "1")
+    abortError(c, NewAPIError("too_many_requests"))
+}
+
+// LimitsMiddleware applies the limits to the HTTP API and WebDAV. Requests
+// over a limit fail with 429, while transfers are slowed down.
+func LimitsMiddleware(l *Limiter) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if adminRoutes[c.FullPath()] {
+            c.Next()
+            return
+        }
+        release, ok := l.Connect()
+        if !ok {
+            abortTooMany(c)
+            return
+        }
+        defer release()
+        client := c.ClientIP()
+        via, action := routeAction(c)
+        switch {
+        case metadataRoutes[c.FullPath()] || via == "dav" && c.Request.Method == "PROPFIND":
+            if !l.AllowMetadata(client) {
+                abortTooMany(c)
+                return
+            }
+        case action == "file":
+            c.Writer = &ginThrottledWriter{
+                ResponseWriter: c.Writer,
+                wait: func(n int) { l.WaitDownload(client, n) },
+            }
+        case action == "upload":
+            done, ok := l.StartUpload(client)
+            if !ok {
+                abortTooMany(c)
+                return
+            }
+            defer done()
+            // WebSocket uploads wait for each chunk themselves.
+            c.Request.Body = &throttledReader{
+                ReadCloser: c.Request.Body,
+                wait: func(n int) { l.WaitUpload(client, n) },
+            }
+        }
+        c.Next()
+    }
+}
\ No newline at end of file
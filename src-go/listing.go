@@ -0,0 +1,198 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "path/filepath"
+    "slices"
+    "strings"
+    "time"
+)
+
+var ErrListOptions = errors.New("invalid listing options")
+
+type ListOptions struct {
+    Sort    string    // name, size or time.
+    Order    string    // asc or desc.
+    Filter    string    // Glob matched against entry names.
+    Kind    string    // file, dir or empty for both.
+    Offset    int
+    Limit    int        // Zero for no limit.
+    Cursor    string    // Continue after the entry encoded by a previous listing.
+}
+
+type Listing struct {
+    Files    []FileItem    `json:"files"`
+    Dirs    []DirItem    `json:"dirs"`
+    Errors    []ScanError    `json:"errors"`
+    Total    int            `json:"total"`
+    Next    *string        `json:"next"`
+}
+
+// listCursor identifies a position in a sorted listing by the sort key of
+// the last returned entry, so that pages stay consistent while entries are
+// added or removed.
+type listCursor struct {
+    Sort    string        `json:"s"`
+    Order    string        `json:"o"`
+    Dir        bool        `json:"d"`
+    Name    string        `json:"n"`
+    Size    int64        `json:"z"`
+    Time    time.Time    `json:"t"`
+}
+
+type listEntry struct {
+    dir        bool
+    name    string
+    size    int64
+    time    time.Time
+    index    int
+}
+
+// compare orders directories before files and then by the sort key, using
+// the name to break ties.
+func (o *ListOptions) compare(a *listEntry, b *listEntry) int {
+    if a.dir != b.dir {
+        if a.dir {
+            return -1
+        }
+        return 1
+    }
+    result := 0
+    switch o.Sort {
+    case "size":
+        result = cmpInt64(a.size, b.size)
+    case "time":
+        result = a.time.Compare(b.time)
+    }
+    if result == 0 {
+        result = strings.Compare(a.name, b.name)
+    }
+    if o.Order == "desc" {
+        result = -result
+    }
+    return result
+}
+
+func cmpInt64(a int64, b int64) int {
+    if a < b {
+        return -1
+    } else if a > b {
+        return 1
+    }
+    return 0
+}
+
+// List scans the directory and returns one page of its entries.
+func (t *Tree) List(opts ListOptions) (*Listing, error) {
+    if opts.Sort == "" {
+        opts.Sort = "name"
+    }
+    if opts.Order == "" {
+        opts.Order = "asc"
+    }
+    if !slices.Contains([]string{ "name", "size", "time" }, opts.Sort) {
+        return nil, fmt.Errorf("%w: sort %s", ErrListOptions, opts.Sort)
+    }
+    if !slices.Contains([]string{ "asc", "desc" }, opts.Order) {
+        return nil, fmt.Errorf("%w: order %s", ErrListOptions, opts.Order)
+    }
+    if !slices.Contains([]string{ "", "file", "dir" }, opts.Kind) {
+        return nil, fmt.Errorf("%w: kind %s", ErrListOptions, opts.Kind)
+    }
+    if opts.Offset < 0 || opts.Limit < 0 {
+        return nil, fmt.Errorf("%w: offset or limit", ErrListOptions)
+    }
+    if _, err := filepath.Match(opts.Filter, ""); err != nil {
+        return nil, fmt.Errorf("%w: filter %v", ErrListOptions, err)
+    }
+    var after *listEntry
+    if opts.Cursor != "" {
+        cursor, err := decodeCursor(opts.Cursor)
+        if err != nil || cursor.Sort != opts.Sort || cursor.Order != opts.Order {
+            return nil, fmt.Errorf("%w: cursor", ErrListOptions)
+        }
+        after = &listEntry{ dir: cursor.Dir, name: cursor.Name, size: cursor.Size, time: cursor.Time }
+    }
+
+    files, dirs, errs, err := t.Scan()
+    if err != nil {
+        return nil, err
+    }
+    entries := []*listEntry{}
+    if opts.Kind != "file" {
+        for i, dir := range dirs {
+            if ok, _ := filepath.Match(opts.Filter, dir.Name); ok || opts.Filter == "" {
+                entries = append(entries, &listEntry{ dir: true, name: dir.Name, time: dir.Time, index: i })
+            }
+        }
+    }
+    if opts.Kind != "dir" {
+        for i, file := range files {
+            if ok, _ := filepath.Match(opts.Filter, file.Name); ok || opts.Filter == "" {
+                entries = append(entries, &listEntry{ name: file.Name, size: file.Size, time: file.Time, index: i })
+            }
+        }
+    }
+    slices.SortFunc(entries, opts.compare)
+
+    listing := &Listing{
+        Files: []FileItem{},
+        Dirs: []DirItem{},
+        Errors: errs,
+        Total: len(entries),
+    }
+    page := entries
+    if after != nil {
+        start, _ := slices.BinarySearchFunc(page, after, opts.compare)
+        if start < len(page) && opts.compare(page[start], after) == 0 {
+            start++
+        }
+        page = page[start:]
+    }
+    page = page[min(opts.Offset, len(page)):]
+    if opts.Limit > 0 && len(page) > opts.Limit {
+        page = page[:opts.Limit]
+        last := page[len(page)-1]
+        next := encodeCursor(listCursor{
+            Sort: opts.Sort,
+            Order: opts.Order,
+            Dir: last.dir,
+            Name: last.name,
+            Size: last.size,
+            Time: last.time,
+        })
+        listing.Next = &next
+    }
+    for _, entry := range page {
+        if entry.dir {
+            listing.Dirs = append(listing.Dirs, dirs[entry.index])
+        } else {
+            file := files[entry.index]
+            if assoc, err := GetAssoc(file.Name); err == nil {
+                file.Assoc = &assoc.Name
+            }
+            listing.Files = append(listing.Files, file)
+        }
+    }
+    return listing, nil
+}
+
+func encodeCursor(cursor listCursor) string {
+    data, _ := json.Marshal(cursor)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+    data, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return nil, err
+    }
+    cursor := &listCursor{}
+    if err := json.Unmarshal(data, cursor); err != nil {
+        return nil, err
+    }
+    return cursor, nil
+}
\ No newline at end of file
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "errors"
+    "strings"
+    "testing"
+)
+
+func names(listing *Listing) string {
+    result := []string{}
+    for _, dir := range listing.Dirs {
+        result = append(result, dir.Name + "/")
+    }
+    for _, file := range listing.Files {
+        result = append(result, file.Name)
+    }
+    return strings.Join(result, " ")
+}
+
+func TestListPages(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    tree := memTree(t, map[string]string{
+        "a.txt": "aaa",
+        "b.txt": "b",
+        "c.log": "cccc",
+        "d.txt": "dd",
+        "sub/e.txt": "e",
+    })
+
+    listing, err := tree.List(ListOptions{ Limit: 2 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names(listing) != "sub/ a.txt" || listing.Total != 5 || listing.Next == nil {
+        t.Fatalf("first page: %q of %d", names(listing), listing.Total)
+    }
+    listing, _ = tree.List(ListOptions{ Limit: 2, Cursor: *listing.Next })
+    if names(listing) != "b.txt c.log" || listing.Next == nil {
+        t.Fatalf("second page: %q", names(listing))
+    }
+    listing, _ = tree.List(ListOptions{ Limit: 2, Cursor: *listing.Next })
+    if names(listing) != "d.txt" || listing.Next != nil {
+        t.Fatalf("last page: %q", names(listing))
+    }
+
+    listing, _ = tree.List(ListOptions{ Sort: "size", Order: "desc", Kind: "file", Offset: 1, Limit: 2 })
+    if names(listing) != "a.txt d.txt" || listing.Total != 4 {
+        t.Fatalf("by size: %q of %d", names(listing), listing.Total)
+    }
+    listing, _ = tree.List(ListOptions{ Filter: "*.txt", Kind: "file" })
+    if names(listing) != "a.txt b.txt d.txt" || listing.Next != nil {
+        t.Fatalf("filtered: %q", names(listing))
+    }
+}
+
+func TestListCursorSurvivesChanges(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    tree := memTree(t, map[string]string{ "a": "", "b": "", "c": "", "d": "" })
+    listing, _ := tree.List(ListOptions{ Limit: 2 })
+    if names(listing) != "a b" {
+        t.Fatalf("first page: %q", names(listing))
+    }
+    // The last entry of the page is gone and an earlier one was added.
+    tree.Storage().Remove("b")
+    writeFile(tree.Storage(), "a2", nil)
+    listing, _ = tree.List(ListOptions{ Limit: 2, Cursor: *listing.Next })
+    if names(listing) != "c d" {
+        t.Fatalf("second page: %q", names(listing))
+    }
+}
+
+func TestListRejectsOptions(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    tree := memTree(t, map[string]string{ "a": "", "b": "" })
+    listing, _ := tree.List(ListOptions{ Limit: 1 })
+    for _, opts := range []ListOptions{
+        { Sort: "owner" },
+        { Order: "up" },
+        { Kind: "link" },
+        { Offset: -1 },
+        { Filter: "[" },
+        { Cursor: "!" },
+        { Sort: "size", Cursor: *listing.Next },
+    } {
+        if _, err := tree.List(opts); !errors.Is(err, ErrListOptions) {
+            t.Errorf("%+v: %v", opts, err)
+        }
+    }
+}
\ No newline at end of file
@@ -0,0 +1,283 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "html"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/net/webdav"
+)
+
+var ErrLocked = errors.New("locked")
+
+type LockInfo struct {
+    Owner    string        `json:"owner"`
+    Expiry    *time.Time    `json:"expiry"` // Nil for locks that never expire.
+    Depth    string        `json:"depth"` // 0 or infinity.
+}
+
+// LockRequest is the body of /lock.
+type LockRequest struct {
+    Owner    string    `json:"owner"`
+    Timeout    int        `json:"timeout"` // Seconds, negative for as long as allowed.
+    Depth    string    `json:"depth"`
+    Token    string    `json:"token"` // Refreshes the lock if set.
+}
+
+// LockResult is what /lock responds with.
+type LockResult struct {
+    Token    string        `json:"token"`
+    Lock    *LockInfo    `json:"lock"`
+}
+
+// UnlockRequest is the body of /unlock.
+type UnlockRequest struct {
+    Token    string    `json:"token"`
+}
+
+type lockEntry struct {
+    inner    string
+    details    webdav.LockDetails
+    expiry    time.Time
+}
+
+// LockManager is the lock system shared by the WebDAV handler and the HTTP
+// API. It wraps an in-memory lock system, handing out unguessable tokens
+// since tokens are all a client needs to write to or unlock a resource.
+// Resources are named by slash-separated paths starting with a slash.
+// Locks last at most Locks.MaxTimeout seconds, however long the client asks
+// for, so that forgotten locks do not keep files from being modified.
+type LockManager struct {
+    mu        sync.Mutex
+    ls        webdav.LockSystem
+    tokens    map[string]*lockEntry
+    maxTimeout    time.Duration // Zero if locks may last forever.
+}
+
+func NewLockManager() *LockManager {
+    return &LockManager{
+        ls: webdav.NewMemLS(),
+        tokens: map[string]*lockEntry{},
+        maxTimeout: time.Duration(cfg().Locks.MaxTimeout) * time.Second,
+    }
+}
+
+// clamp limits the duration of a lock, negative for infinite, to maxTimeout.
+func (m *LockManager) clamp(duration time.Duration) time.Duration {
+    if m.maxTimeout > 0 && (duration < 0 || duration > m.maxTimeout) {
+        return m.maxTimeout
+    }
+    return duration
+}
+
+// covers reports whether the lock applies to the named resource.
+func (e *lockEntry) covers(name string) bool {
+    root := e.details.Root
+    return root == name || !e.details.ZeroDepth && (root == "/" || strings.HasPrefix(name, root + "/"))
+}
+
+func lockName(parts []string) string {
+    return "/" + strings.Join(parts, "/")
+}
+
+// ownerText extracts the text of the owner XML given in a WebDAV LOCK.
+func ownerText(ownerXML string) string {
+    decoder := xml.NewDecoder(strings.NewReader(ownerXML))
+    sb := strings.Builder{}
+    for {
+        token, err := decoder.Token()
+        if err != nil {
+            break
+        }
+        if data, ok := token.(xml.CharData); ok {
+            sb.Write(data)
+        }
+    }
+    return strings.TrimSpace(sb.String())
+}
+
+// prune forgets expired locks. The caller must hold m.mu.
+func (m *LockManager) prune(now time.Time) {
+    for token, entry := range m.tokens {
+        if !entry.expiry.IsZero() && now.After(entry.expiry) {
+            delete(m.tokens, token)
+        }
+    }
+}
+
+func (m *LockManager) Confirm(now time.Time, name0 string, name1 string, conditions ...webdav.Condition) (func(), error) {
+    m.mu.Lock()
+    inner := make([]webdav.Condition, len(conditions))
+    for i, condition := range conditions {
+        inner[i] = condition
+        if entry, ok := m.tokens[condition.Token]; ok {
+            inner[i].Token = entry.inner
+        } else if condition.Token != "" {
+            // Internal tokens are never accepted from clients.
+            inner[i].Token = "-"
+        }
+    }
+    m.mu.Unlock()
+    return m.ls.Confirm(now, name0, name1, inner...)
+}
+
+func (m *LockManager) Create(now time.Time, details webdav.LockDetails) (string, error) {
+    details.Duration = m.clamp(details.Duration)
+    inner, err := m.ls.Create(now, details)
+    if err != nil {
+        return "", err
+    }
+    idbin := make([]byte, 16)
+    rand.Read(idbin)
+    token := fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", idbin[:4], idbin[4:6], idbin[6:8], idbin[8:10], idbin[10:])
+    entry := &lockEntry{ inner: inner, details: details }
+    if details.Duration >= 0 {
+        entry.expiry = now.Add(details.Duration)
+    }
+    m.mu.Lock()
+    m.prune(now)
+    m.tokens[token] = entry
+    m.mu.Unlock()
+    return token, nil
+}
+
+func (m *LockManager) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.prune(now)
+    entry, ok := m.tokens[token]
+    if !ok {
+        return webdav.LockDetails{}, webdav.ErrNoSuchLock
+    }
+    duration = m.clamp(duration)
+    details, err := m.ls.Refresh(now, entry.inner, duration)
+    if err != nil {
+        return details, err
+    }
+    entry.details, entry.expiry = details, time.Time{}
+    if duration >= 0 {
+        entry.expiry = now.Add(duration)
+    }
+    return details, nil
+}
+
+// RootOf returns the resource locked with token, or "" if there is no such
+// lock.
+func (m *LockManager) RootOf(token string) string {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.prune(time.Now())
+    if entry, ok := m.tokens[token]; ok {
+        return entry.details.Root
+    }
+    return ""
+}
+
+func (m *LockManager) Unlock(now time.Time, token string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.prune(now)
+    entry, ok := m.tokens[token]
+    if !ok {
+        return webdav.ErrNoSuchLock
+    }
+    if err := m.ls.Unlock(now, entry.inner); err != nil {
+        return err
+    }
+    delete(m.tokens, token)
+    return nil
+}
+
+// Acquire guards an operation on the named resources the way the WebDAV
+// handler does: resources locked by someone else, or with entries locked by
+// someone else, make it fail with ErrLocked unless token is the lock's
+// token. The returned function must be called once the operation is over.
+func (m *LockManager) Acquire(token string, names ...string) (func(), error) {
+    now := time.Now()
+    releases := []func(){}
+    release := func() {
+        for _, r := range releases {
+            r()
+        }
+    }
+    for i, name := range names {
+        if slices.Contains(names[:i], name) {
+            continue
+        }
+        // A temporary lock conflicts with any lock covering the resource,
+        // and with those below it since moving or deleting a directory
+        // takes its entries along.
+        temp, err := m.ls.Create(now, webdav.LockDetails{ Root: name, Duration: -1 })
+        if err == nil {
+            releases = append(releases, func() { m.ls.Unlock(time.Now(), temp) })
+            continue
+        }
+        if err == webdav.ErrLocked && token != "" {
+            if r, err := m.Confirm(now, name, "", webdav.Condition{ Token: token }); err == nil {
+                releases = append(releases, r)
+                continue
+            }
+        }
+        release()
+        return nil, ErrLocked
+    }
+    return release, nil
+}
+
+// Break removes the locks covering the named resource whoever holds them,
+// and returns how many there were.
+func (m *LockManager) Break(name string) int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    m.prune(now)
+    count := 0
+    for token, entry := range m.tokens {
+        if !entry.covers(name) {
+            continue
+        }
+        m.ls.Unlock(now, entry.inner)
+        delete(m.tokens, token)
+        count++
+    }
+    return count
+}
+
+// LockOf describes the lock covering the named resource, if any.
+func (m *LockManager) LockOf(name string) *LockInfo {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.prune(time.Now())
+    for _, entry := range m.tokens {
+        if !entry.covers(name) {
+            continue
+        }
+        info := &LockInfo{ Owner: ownerText(entry.details.OwnerXML), Depth: "infinity" }
+        if entry.details.ZeroDepth {
+            info.Depth = "0"
+        }
+        if !entry.expiry.IsZero() {
+            expiry := entry.expiry
+            info.Expiry = &expiry
+        }
+        return info
+    }
+    return nil
+}
+
+// Lock locks the named resource on behalf of owner for timeout, or as long as
+// allowed if timeout is negative.
+func (m *LockManager) Lock(name string, owner string, timeout time.Duration, zeroDepth bool) (string, error) {
+    return m.Create(time.Now(), webdav.LockDetails{
+        Root: name,
+        Duration: timeout,
+        OwnerXML: html.EscapeString(owner),
+        ZeroDepth: zeroDepth,
+    })
+}
\ No newline at end of file
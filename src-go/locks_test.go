@@ -0,0 +1,55 @@
+package main
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestAcquireCoversEntriesBelow(t *testing.T) {
+    useConfig(t, nil)
+    m := NewLockManager()
+    token, err := m.Lock("/dir/a.txt", "alice", -1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := m.Acquire("", "/dir"); !errors.Is(err, ErrLocked) {
+        t.Fatalf("moving the parent of a locked file: %v", err)
+    }
+    if _, err := m.Acquire("", "/dir/a.txt"); !errors.Is(err, ErrLocked) {
+        t.Fatalf("writing a locked file: %v", err)
+    }
+    release, err := m.Acquire(token, "/dir/a.txt")
+    if err != nil {
+        t.Fatalf("writing with the token: %v", err)
+    }
+    release()
+    release, err = m.Acquire("", "/other")
+    if err != nil {
+        t.Fatalf("writing elsewhere: %v", err)
+    }
+    release()
+}
+
+func TestLockTimeouts(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Locks.MaxTimeout = 60 })
+    m := NewLockManager()
+    if _, err := m.Lock("/a.txt", "alice", -1, true); err != nil {
+        t.Fatal(err)
+    }
+    info := m.LockOf("/a.txt")
+    if info == nil || info.Expiry == nil || time.Until(*info.Expiry) > time.Minute {
+        t.Fatalf("infinite lock was not clamped: %+v", info)
+    }
+    if count := m.Break("/a.txt"); count != 1 {
+        t.Fatalf("broke %d locks", count)
+    }
+    if m.LockOf("/a.txt") != nil {
+        t.Fatal("lock survived being broken")
+    }
+    release, err := m.Acquire("", "/a.txt")
+    if err != nil {
+        t.Fatalf("writing after the lock was broken: %v", err)
+    }
+    release()
+}
\ No newline at end of file
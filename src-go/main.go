@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"golang.org/x/sys/windows/registry"
@@ -20,7 +22,7 @@ func main() {
         }
     }()
     if len(os.Args) < 2 {
-        fmt.Printf("Usage: %s [init|serve]\n", os.Args[0])
+        fmt.Printf("Usage: %s [init|serve|audit|openapi]\n", os.Args[0])
         os.Exit(2)
     }
     switch os.Args[1] {
@@ -29,8 +31,18 @@ func main() {
         fs.StringVar(&cfgPath, "config", os.ExpandEnv(".\\sagasu-config.toml;${USERPROFILE}\\sagasu-config.toml"), "A semicolon-separated list of config file locations.")
         phost := fs.String("host", "", "Host to bind to.")
         pport := fs.Int("port", 0, "Port to bind to.")
-        proot := fs.String("root", ".", "Root directory to serve.")
+        proot := fs.String("root", ".", "Root directory, or zip archive, to serve.")
+        var pmounts MountFlags
+        fs.Var(&pmounts, "mount", "Directory to serve as a top-level folder, as name=path. Repeat to mount several instead of a root.")
+        ps3 := fs.Bool("s3", false, "Also serve the tree through the S3 API, as set up in the S3 section of the config.")
         fs.Parse(os.Args[2:])
+        mounts, err := SelectMounts(fs, pmounts)
+        if err != nil {
+            panic(err)
+        }
+        if *ps3 {
+            cfg().S3.Enabled = true
+        }
         var host string 
         var port int
         if len(*phost) > 0 {
@@ -43,7 +55,50 @@ func main() {
         } else {
             port = cfg().Http.Port
         }
-        NewServer(*proot)(host, port)
+        NewServer(*proot, mounts)(host, port)
+        break
+    }
+    case "audit": {
+        if len(os.Args) < 3 || os.Args[2] != "query" {
+            fmt.Printf("Usage: %s audit query [--since time] [--path path] [--action action]\n", os.Args[0])
+            os.Exit(2)
+        }
+        fs := flag.NewFlagSet("", flag.ExitOnError)
+        fs.StringVar(&cfgPath, "config", os.ExpandEnv(".\\sagasu-config.toml;${USERPROFILE}\\sagasu-config.toml"), "A semicolon-separated list of config file locations.")
+        proot := fs.String("root", ".", "Root directory the log was written for.")
+        var pmounts MountFlags
+        fs.Var(&pmounts, "mount", "Mounts the log was written for, as name=path, if a namespace was served.")
+        psince := fs.String("since", "", "Only entries after this time: a duration like 24h, a date or an RFC 3339 time.")
+        ppath := fs.String("path", "", "Only entries at or below this path, or matching it if it is a pattern.")
+        paction := fs.String("action", "", "Only entries with these comma-separated actions.")
+        fs.Parse(os.Args[3:])
+        mounts, err := SelectMounts(fs, pmounts)
+        if err != nil {
+            panic(err)
+        }
+        root := *proot
+        if len(mounts) > 0 {
+            root = namespacePath(mounts)
+        }
+        since, err := ParseSince(*psince)
+        if err != nil {
+            panic(fmt.Errorf("invalid time: %s", *psince))
+        }
+        query := AuditQuery{ Since: since, Path: *ppath }
+        if len(*paction) > 0 {
+            query.Actions = strings.Split(*paction, ",")
+        }
+        if err := QueryAudit(os.Stdout, root, query); err != nil {
+            panic(err)
+        }
+        break
+    }
+    case "openapi": {
+        encoder := json.NewEncoder(os.Stdout)
+        encoder.SetIndent("", "  ")
+        if err := encoder.Encode(OpenAPI()); err != nil {
+            panic(err)
+        }
         break
     }
     case "init": {
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "os"
+    "path"
+    "path/filepath"
+    "testing"
+)
+
+// useConfig makes the defaults, changed by edit, the config of a test.
+func useConfig(t *testing.T, edit func(c *Config)) {
+    c := defConfig
+    c.Assoc.Custom = map[string]Assoc{}
+    c.Sftp.Users = map[string]string{}
+    c.S3.Users = map[string]S3User{}
+    c.Mounts = []Mount{}
+    if edit != nil {
+        edit(&c)
+    }
+    saved, savedPolicy := cfgCache, policy
+    cfgCache, policy = &c, nil
+    t.Cleanup(func() { cfgCache, policy = saved, savedPolicy })
+}
+
+// writeFiles creates the files of a test below dir, by slash-separated path.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+    for name, content := range files {
+        loc := filepath.Join(dir, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(loc), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(loc, []byte(content), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// memTree creates a tree in memory holding the files of a test, by
+// slash-separated path.
+func memTree(t *testing.T, files map[string]string) *Tree {
+    mem := NewMemStorage()
+    for name, content := range files {
+        dir := ""
+        for _, part := range splitPath(path.Dir(name)) {
+            dir = path.Join(dir, part)
+            mem.Mkdir(dir, 0o755)
+        }
+        if err := writeFile(mem, name, []byte(content)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return CreateTreeOn(mem, ".")
+}
\ No newline at end of file
@@ -0,0 +1,312 @@
+package main
+
+import (
+    "errors"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+type memNode struct {
+    dir        bool
+    data    []byte
+    mode    fs.FileMode
+    time    time.Time
+}
+
+type memInfo struct {
+    name    string
+    node    memNode
+}
+
+func (i *memInfo) Name() string { return i.name }
+func (i *memInfo) Size() int64 { return int64(len(i.node.data)) }
+func (i *memInfo) ModTime() time.Time { return i.node.time }
+func (i *memInfo) IsDir() bool { return i.node.dir }
+func (i *memInfo) Sys() any { return nil }
+
+func (i *memInfo) Mode() fs.FileMode {
+    if i.node.dir {
+        return fs.ModeDir | i.node.mode
+    }
+    return i.node.mode
+}
+
+// MemStorage keeps a tree in memory, mostly for tests. Any location may be
+// used as the root of a tree on it, since leading slashes and dots do not
+// matter.
+type MemStorage struct {
+    mu        sync.Mutex
+    nodes    map[string]*memNode // Keyed by storageKey.
+}
+
+func NewMemStorage() *MemStorage {
+    return &MemStorage{
+        nodes: map[string]*memNode{
+            ".": { dir: true, mode: 0o755, time: time.Now() },
+        },
+    }
+}
+
+func memError(op string, name string, err error) error {
+    return &fs.PathError{ Op: op, Path: name, Err: err }
+}
+
+// info must be called with the lock held.
+func (m *MemStorage) info(key string) *memInfo {
+    return &memInfo{ name: path.Base(key), node: *m.nodes[key] }
+}
+
+// children returns the keys of the entries of the directory key, sorted.
+// It must be called with the lock held.
+func (m *MemStorage) children(key string) []string {
+    keys := []string{}
+    for k := range m.nodes {
+        if k != "." && path.Dir(k) == key {
+            keys = append(keys, k)
+        }
+    }
+    slices.Sort(keys)
+    return keys
+}
+
+// below reports whether key is at or below dir.
+func below(key string, dir string) bool {
+    return key == dir || dir == "." || strings.HasPrefix(key, dir + "/")
+}
+
+// parentDir checks that the parent of key is an existing directory. It must
+// be called with the lock held.
+func (m *MemStorage) parentDir(key string) bool {
+    parent, ok := m.nodes[path.Dir(key)]
+    return ok && parent.dir
+}
+
+func (m *MemStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := storageKey(name)
+    if node, ok := m.nodes[key]; !ok || !node.dir {
+        return nil, memError("readdir", name, fs.ErrNotExist)
+    }
+    entries := []fs.DirEntry{}
+    for _, child := range m.children(key) {
+        entries = append(entries, fs.FileInfoToDirEntry(m.info(child)))
+    }
+    return entries, nil
+}
+
+func (m *MemStorage) Stat(name string) (fs.FileInfo, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := storageKey(name)
+    if _, ok := m.nodes[key]; !ok {
+        return nil, memError("stat", name, fs.ErrNotExist)
+    }
+    return m.info(key), nil
+}
+
+func (m *MemStorage) Open(name string) (File, error) {
+    return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemStorage) Create(name string) (File, error) {
+    return m.OpenFile(name, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0o666)
+}
+
+func (m *MemStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := storageKey(name)
+    write := flag & (os.O_WRONLY | os.O_RDWR) != 0
+    node, ok := m.nodes[key]
+    switch {
+    case ok && flag & os.O_CREATE != 0 && flag & os.O_EXCL != 0:
+        return nil, memError("open", name, fs.ErrExist)
+    case !ok && (flag & os.O_CREATE == 0 || !m.parentDir(key)):
+        return nil, memError("open", name, fs.ErrNotExist)
+    case !ok:
+        node = &memNode{ mode: perm.Perm(), time: time.Now() }
+        m.nodes[key] = node
+    case node.dir && write:
+        return nil, memError("open", name, errors.New("is a directory"))
+    case flag & os.O_TRUNC != 0 && write:
+        node.data, node.time = nil, time.Now()
+    }
+    return &memFile{ storage: m, name: name, key: key, node: node, flag: flag }, nil
+}
+
+func (m *MemStorage) Rename(from string, to string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    src, dst := storageKey(from), storageKey(to)
+    node, ok := m.nodes[src]
+    if !ok || !m.parentDir(dst) {
+        return &os.LinkError{ Op: "rename", Old: from, New: to, Err: fs.ErrNotExist }
+    }
+    if src == dst {
+        return nil
+    }
+    if below(dst, src) {
+        return &os.LinkError{ Op: "rename", Old: from, New: to, Err: errors.New("invalid argument") }
+    }
+    if target, ok := m.nodes[dst]; ok && (target.dir != node.dir || target.dir && len(m.children(dst)) > 0) {
+        return &os.LinkError{ Op: "rename", Old: from, New: to, Err: fs.ErrExist }
+    }
+    for key, n := range m.nodes {
+        if below(key, src) {
+            delete(m.nodes, key)
+            m.nodes[dst + strings.TrimPrefix(key, src)] = n
+        }
+    }
+    return nil
+}
+
+func (m *MemStorage) Remove(name string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := storageKey(name)
+    if _, ok := m.nodes[key]; !ok || key == "." {
+        return memError("remove", name, fs.ErrNotExist)
+    }
+    if len(m.children(key)) > 0 {
+        return memError("remove", name, errors.New("directory not empty"))
+    }
+    delete(m.nodes, key)
+    return nil
+}
+
+func (m *MemStorage) RemoveAll(name string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    dir := storageKey(name)
+    for key := range m.nodes {
+        if key != "." && below(key, dir) {
+            delete(m.nodes, key)
+        }
+    }
+    return nil
+}
+
+func (m *MemStorage) Mkdir(name string, perm fs.FileMode) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    key := storageKey(name)
+    if _, ok := m.nodes[key]; ok {
+        return memError("mkdir", name, fs.ErrExist)
+    }
+    if !m.parentDir(key) {
+        return memError("mkdir", name, fs.ErrNotExist)
+    }
+    m.nodes[key] = &memNode{ dir: true, mode: perm.Perm(), time: time.Now() }
+    return nil
+}
+
+func (m *MemStorage) ReadOnly() bool {
+    return false
+}
+
+// memFile reads and writes the node it was opened on, which keeps its
+// contents even if it is renamed or removed meanwhile, like open files do.
+type memFile struct {
+    storage    *MemStorage
+    name    string
+    key        string
+    node    *memNode
+    flag    int
+    offset    int64
+    listed    int // Entries already returned by Readdir.
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+    n, err := f.ReadAt(p, f.offset)
+    f.offset += int64(n)
+    return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+    f.storage.mu.Lock()
+    defer f.storage.mu.Unlock()
+    if f.node.dir {
+        return 0, memError("read", f.name, errors.New("is a directory"))
+    }
+    if off >= int64(len(f.node.data)) {
+        return 0, io.EOF
+    }
+    n := copy(p, f.node.data[off:])
+    if n < len(p) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+    f.storage.mu.Lock()
+    defer f.storage.mu.Unlock()
+    if f.flag & (os.O_WRONLY | os.O_RDWR) == 0 {
+        return 0, memError("write", f.name, fs.ErrPermission)
+    }
+    if f.flag & os.O_APPEND != 0 {
+        f.offset = int64(len(f.node.data))
+    }
+    if end := f.offset + int64(len(p)); end > int64(len(f.node.data)) {
+        f.node.data = append(f.node.data, make([]byte, end - int64(len(f.node.data)))...)
+    }
+    copy(f.node.data[f.offset:], p)
+    f.offset += int64(len(p))
+    f.node.time = time.Now()
+    return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+    f.storage.mu.Lock()
+    defer f.storage.mu.Unlock()
+    switch whence {
+    case io.SeekCurrent:
+        offset += f.offset
+    case io.SeekEnd:
+        offset += int64(len(f.node.data))
+    }
+    if offset < 0 {
+        return 0, memError("seek", f.name, errors.New("invalid argument"))
+    }
+    f.offset = offset
+    return offset, nil
+}
+
+func (f *memFile) Close() error {
+    return nil
+}
+
+func (f *memFile) Readdir(count int) ([]fs.FileInfo, error) {
+    f.storage.mu.Lock()
+    defer f.storage.mu.Unlock()
+    if !f.node.dir {
+        return nil, memError("readdir", f.name, errors.New("not a directory"))
+    }
+    children := f.storage.children(f.key)
+    children = children[min(f.listed, len(children)):]
+    if count > 0 && len(children) > count {
+        children = children[:count]
+    }
+    infos := []fs.FileInfo{}
+    for _, child := range children {
+        infos = append(infos, f.storage.info(child))
+    }
+    f.listed += len(children)
+    if count > 0 && len(infos) == 0 {
+        return infos, io.EOF
+    }
+    return infos, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+    f.storage.mu.Lock()
+    defer f.storage.mu.Unlock()
+    return &memInfo{ name: path.Base(f.key), node: *f.node }, nil
+}
\ No newline at end of file
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// durationBuckets are the upper bounds of the request duration histogram,
+// in seconds.
+var durationBuckets = []float64{ 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60 }
+
+type requestKey struct {
+    route    string
+    method    string
+    status    int
+}
+
+type transferKey struct {
+    direction    string // upload or download.
+    via            string
+}
+
+type histogram struct {
+    counts    []int64 // Per bucket, not cumulative.
+    sum        float64
+    count    int64
+}
+
+// Metrics collects what is exported at /metrics. It is global since the
+// tree and icon caches report to it as well.
+type Metrics struct {
+    mu            sync.Mutex
+    requests    map[requestKey]int64
+    durations    map[string]*histogram
+    transfers    map[transferKey]int64
+    uploads        atomic.Int64
+    treeHits    atomic.Int64
+    treeMisses    atomic.Int64
+    iconHits    atomic.Int64
+    iconMisses    atomic.Int64
+    rulesLoads    atomic.Int64
+}
+
+var metrics = &Metrics{
+    requests: map[requestKey]int64{},
+    durations: map[string]*histogram{},
+    transfers: map[transferKey]int64{},
+}
+
+func (m *Metrics) Request(route string, method string, status int, duration time.Duration) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.requests[requestKey{ route, method, status }]++
+    h, ok := m.durations[route]
+    if !ok {
+        h = &histogram{ counts: make([]int64, len(durationBuckets)) }
+        m.durations[route] = h
+    }
+    seconds := duration.Seconds()
+    if i, _ := slices.BinarySearch(durationBuckets, seconds); i < len(durationBuckets) {
+        h.counts[i]++
+    }
+    h.sum += seconds
+    h.count++
+}
+
+// Transfer counts bytes uploaded or downloaded through one of the servers.
+func (m *Metrics) Transfer(direction string, via string, n int64) {
+    if n <= 0 {
+        return
+    }
+    m.mu.Lock()
+    m.transfers[transferKey{ direction, via }] += n
+    m.mu.Unlock()
+}
+
+// MetricsMiddleware counts requests to the HTTP API and WebDAV, along with
+// the bytes of downloads and uploads.
+func MetricsMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        start := time.Now()
+        body := &auditReader{ ReadCloser: c.Request.Body }
+        c.Request.Body = body
+        c.Next()
+        metrics.Request(c.FullPath(), c.Request.Method, c.Writer.Status(), time.Since(start))
+        switch via, action := routeAction(c); action {
+        case "file":
+            metrics.Transfer("download", via, int64(c.Writer.Size()))
+        case "upload":
+            metrics.Transfer("upload", via, body.n)
+        }
+    }
+}
+
+func escapeLabel(value string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(f float64) string {
+    return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Export writes the metrics in the Prometheus text format.
+func (m *Metrics) Export(w io.Writer, tree *Tree) {
+    header := func(name string, kind string, help string) {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+    }
+    m.mu.Lock()
+    header("sagasu_http_requests_total", "counter", "HTTP requests handled, by route, method and status.")
+    keys := make([]requestKey, 0, len(m.requests))
+    for key := range m.requests {
+        keys = append(keys, key)
+    }
+    slices.SortFunc(keys, func(a requestKey, b requestKey) int {
+        if a.route != b.route {
+            return strings.Compare(a.route, b.route)
+        } else if a.method != b.method {
+            return strings.Compare(a.method, b.method)
+        }
+        return a.status - b.status
+    })
+    for _, key := range keys {
+        fmt.Fprintf(w, "sagasu_http_requests_total{route=\"%s\",method=\"%s\",status=\"%d\"} %d\n",
+            escapeLabel(key.route), escapeLabel(key.method), key.status, m.requests[key])
+    }
+
+    header("sagasu_http_request_duration_seconds", "histogram", "Time taken to handle HTTP requests, by route.")
+    routes := make([]string, 0, len(m.durations))
+    for route := range m.durations {
+        routes = append(routes, route)
+    }
+    slices.Sort(routes)
+    for _, route := range routes {
+        h, label := m.durations[route], escapeLabel(route)
+        cumulative := int64(0)
+        for i, bound := range durationBuckets {
+            cumulative += h.counts[i]
+            fmt.Fprintf(w, "sagasu_http_request_duration_seconds_bucket{route=\"%s\",le=\"%s\"} %d\n", label, formatFloat(bound), cumulative)
+        }
+        fmt.Fprintf(w, "sagasu_http_request_duration_seconds_bucket{route=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+        fmt.Fprintf(w, "sagasu_http_request_duration_seconds_sum{route=\"%s\"} %s\n", label, formatFloat(h.sum))
+        fmt.Fprintf(w, "sagasu_http_request_duration_seconds_count{route=\"%s\"} %d\n", label, h.count)
+    }
+
+    header("sagasu_transferred_bytes_total", "counter", "Bytes of file contents uploaded or downloaded, by direction and protocol.")
+    transfers := make([]transferKey, 0, len(m.transfers))
+    for key := range m.transfers {
+        transfers = append(transfers, key)
+    }
+    slices.SortFunc(transfers, func(a transferKey, b transferKey) int {
+        if a.direction != b.direction {
+            return strings.Compare(a.direction, b.direction)
+        }
+        return strings.Compare(a.via, b.via)
+    })
+    for _, key := range transfers {
+        fmt.Fprintf(w, "sagasu_transferred_bytes_total{direction=\"%s\",via=\"%s\"} %d\n", key.direction, key.via, m.transfers[key])
+    }
+    m.mu.Unlock()
+
+    header("sagasu_uploads_active", "gauge", "WebSocket uploads in progress.")
+    fmt.Fprintf(w, "sagasu_uploads_active %d\n", m.uploads.Load())
+    header("sagasu_tree_cache_entries", "gauge", "Directories held in the tree cache.")
+    fmt.Fprintf(w, "sagasu_tree_cache_entries %d\n", tree.CacheSize())
+    header("sagasu_tree_cache_hits_total", "counter", "Directory lookups answered from the tree cache.")
+    fmt.Fprintf(w, "sagasu_tree_cache_hits_total %d\n", m.treeHits.Load())
+    header("sagasu_tree_cache_misses_total", "counter", "Directory lookups that went to the disk.")
+    fmt.Fprintf(w, "sagasu_tree_cache_misses_total %d\n", m.treeMisses.Load())
+    header("sagasu_icon_cache_hits_total", "counter", "Icons served from the icon cache.")
+    fmt.Fprintf(w, "sagasu_icon_cache_hits_total %d\n", m.iconHits.Load())
+    header("sagasu_icon_cache_misses_total", "counter", "Icons that had to be extracted.")
+    fmt.Fprintf(w, "sagasu_icon_cache_misses_total %d\n", m.iconMisses.Load())
+    header("sagasu_rules_loads_total", "counter", "Rules files read, including reloads.")
+    fmt.Fprintf(w, "sagasu_rules_loads_total %d\n", m.rulesLoads.Load())
+}
\ No newline at end of file
@@ -0,0 +1,290 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+// A namespace is a tree whose root has no directory of its own. Its entries
+// are the mounts, directories of the local disk with their own default flag
+// and rules file name. Below a mount everything lives on the disk like in
+// any other tree, so only the root itself is virtual.
+
+const namespacePrefix = ":mounts-"
+
+// namespacePath returns the location of the root of a namespace. It cannot
+// exist on the disk, and differs between sets of mounts so that logs and
+// indexes kept elsewhere are not shared by them.
+func namespacePath(mounts []Mount) string {
+    specs := []string{}
+    for _, m := range mounts {
+        path, _ := filepath.Abs(m.Path)
+        specs = append(specs, m.Name + "=" + path)
+    }
+    slices.Sort(specs)
+    return namespacePrefix + Hash(strings.Join(specs, ";")) + ":"
+}
+
+// IsNamespace reports whether root is the location of a namespace rather
+// than a directory.
+func IsNamespace(root string) bool {
+    return strings.HasPrefix(root, namespacePrefix)
+}
+
+// CreateNamespace serves the given directories as the entries of a virtual
+// root. Empty settings of the mounts are filled in from the config.
+func CreateNamespace(mounts []Mount) (*Tree, error) {
+    if len(mounts) == 0 {
+        return nil, errors.New("no mounts")
+    }
+    byName := map[string]*Mount{}
+    folded := map[string]bool{}
+    for _, m := range mounts {
+        if m.Name == "" || m.Name == "." || m.Name == ".." || strings.ContainsAny(m.Name, "/\\") {
+            return nil, fmt.Errorf("invalid mount name: %q", m.Name)
+        }
+        // Names only differing in case would clash on Windows clients.
+        if folded[strings.ToLower(m.Name)] {
+            return nil, fmt.Errorf("duplicate mount name: %s", m.Name)
+        }
+        folded[strings.ToLower(m.Name)] = true
+        m.Path, _ = filepath.Abs(m.Path)
+        if stat, err := os.Stat(m.Path); err != nil || !stat.IsDir() {
+            return nil, fmt.Errorf("cannot open directory: %s", m.Path)
+        }
+        if m.DefaultFlag == "" {
+            m.DefaultFlag = cfg().Tree.DefaultFlag
+        } else if ok, _ := Flags.TryFind(m.DefaultFlag); !ok {
+            return nil, fmt.Errorf("invalid default flag of %s: %s", m.Name, m.DefaultFlag)
+        }
+        if m.RulesFile == "" {
+            m.RulesFile = cfg().Tree.RulesFile
+        }
+        mount := m
+        byName[m.Name] = &mount
+    }
+    root := namespacePath(mounts)
+    tree := &Tree{
+        prev: nil,
+        mu: &sync.Mutex{},
+        cache: map[string]*Tree {},
+        Path: root,
+        reserved: map[string]bool{},
+        mounts: byName,
+        storage: &mountStorage{ root: root, mounts: byName, time: time.Now() },
+    }
+    tree.loadRules()
+    return tree, nil
+}
+
+// mountStorage is the local disk with the root of a namespace on top. The
+// root lists the mounts and cannot be changed. Its entries are reached at
+// the locations of the mounts, never at a location inside it.
+type mountStorage struct {
+    osStorage
+    root    string
+    mounts    map[string]*Mount
+    time    time.Time // When the namespace was created.
+}
+
+// inside reports whether name is the root or a location below it.
+func (s *mountStorage) inside(name string) bool {
+    return name == s.root || strings.HasPrefix(name, s.root + string(filepath.Separator))
+}
+
+func (s *mountStorage) guard(op string, name string) error {
+    if s.inside(name) {
+        return &fs.PathError{ Op: op, Path: name, Err: fs.ErrPermission }
+    }
+    return nil
+}
+
+func (s *mountStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+    if name != s.root {
+        if s.inside(name) {
+            return nil, &fs.PathError{ Op: "readdir", Path: name, Err: fs.ErrNotExist }
+        }
+        return os.ReadDir(name)
+    }
+    entries := []fs.DirEntry{}
+    for _, m := range s.mounts {
+        // Mounts gone missing are left out, as their trees cannot be entered.
+        if info, err := os.Stat(m.Path); err == nil {
+            entries = append(entries, fs.FileInfoToDirEntry(mountInfo{ FileInfo: info, name: m.Name }))
+        }
+    }
+    slices.SortFunc(entries, func(a fs.DirEntry, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+    return entries, nil
+}
+
+func (s *mountStorage) Stat(name string) (fs.FileInfo, error) {
+    if name == s.root {
+        return &memInfo{ name: "/", node: memNode{ dir: true, mode: 0o555, time: s.time } }, nil
+    } else if s.inside(name) {
+        return nil, &fs.PathError{ Op: "stat", Path: name, Err: fs.ErrNotExist }
+    }
+    info, err := os.Stat(name)
+    if err != nil {
+        return nil, err
+    }
+    // Mounts are named as in the namespace rather than after their folder.
+    for _, m := range s.mounts {
+        if m.Path == name {
+            return mountInfo{ FileInfo: info, name: m.Name }, nil
+        }
+    }
+    return info, nil
+}
+
+func (s *mountStorage) Open(name string) (File, error) {
+    if name == s.root {
+        return &mountDir{ storage: s }, nil
+    } else if s.inside(name) {
+        return nil, &fs.PathError{ Op: "open", Path: name, Err: fs.ErrNotExist }
+    }
+    return s.osStorage.Open(name)
+}
+
+func (s *mountStorage) Create(name string) (File, error) {
+    if err := s.guard("open", name); err != nil {
+        return nil, err
+    }
+    return s.osStorage.Create(name)
+}
+
+func (s *mountStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+    if flag == os.O_RDONLY {
+        return s.Open(name)
+    }
+    if err := s.guard("open", name); err != nil {
+        return nil, err
+    }
+    return s.osStorage.OpenFile(name, flag, perm)
+}
+
+func (s *mountStorage) Rename(from string, to string) error {
+    if s.inside(from) || s.inside(to) {
+        return &os.LinkError{ Op: "rename", Old: from, New: to, Err: fs.ErrPermission }
+    }
+    return os.Rename(from, to)
+}
+
+func (s *mountStorage) Remove(name string) error {
+    if err := s.guard("remove", name); err != nil {
+        return err
+    }
+    return os.Remove(name)
+}
+
+func (s *mountStorage) RemoveAll(name string) error {
+    if err := s.guard("remove", name); err != nil {
+        return err
+    }
+    return os.RemoveAll(name)
+}
+
+func (s *mountStorage) Mkdir(name string, perm fs.FileMode) error {
+    if err := s.guard("mkdir", name); err != nil {
+        return err
+    }
+    return os.Mkdir(name, perm)
+}
+
+type mountInfo struct {
+    fs.FileInfo
+    name    string
+}
+
+func (i mountInfo) Name() string { return i.name }
+
+// mountDir is the root of a namespace opened for listing.
+type mountDir struct {
+    storage    *mountStorage
+    listed    bool
+}
+
+func (d *mountDir) Read(p []byte) (int, error) {
+    return 0, &fs.PathError{ Op: "read", Path: d.storage.root, Err: errors.New("is a directory") }
+}
+
+func (d *mountDir) ReadAt(p []byte, off int64) (int, error) {
+    return d.Read(p)
+}
+
+func (d *mountDir) Write(p []byte) (int, error) {
+    return 0, &fs.PathError{ Op: "write", Path: d.storage.root, Err: fs.ErrPermission }
+}
+
+func (d *mountDir) Seek(offset int64, whence int) (int64, error) {
+    return 0, nil
+}
+
+func (d *mountDir) Close() error {
+    return nil
+}
+
+func (d *mountDir) Readdir(count int) ([]fs.FileInfo, error) {
+    if d.listed && count > 0 {
+        return nil, io.EOF
+    }
+    entries, _ := d.storage.ReadDir(d.storage.root)
+    infos := []fs.FileInfo{}
+    for _, entry := range entries {
+        if info, err := entry.Info(); err == nil {
+            infos = append(infos, info)
+        }
+    }
+    d.listed = true
+    return infos, nil
+}
+
+func (d *mountDir) Stat() (fs.FileInfo, error) {
+    return d.storage.Stat(d.storage.root)
+}
+
+// MountFlags collects repeated name=path command line flags.
+type MountFlags []Mount
+
+func (f *MountFlags) String() string {
+    specs := []string{}
+    for _, m := range *f {
+        specs = append(specs, m.Name + "=" + m.Path)
+    }
+    return strings.Join(specs, ",")
+}
+
+func (f *MountFlags) Set(value string) error {
+    name, path, ok := strings.Cut(value, "=")
+    if !ok || name == "" || path == "" {
+        return errors.New("expected name=path")
+    }
+    *f = append(*f, Mount{ Name: name, Path: path })
+    return nil
+}
+
+// SelectMounts returns the mounts given on the command line, or those of the
+// config unless a root was given instead. Both cannot be given at once.
+func SelectMounts(flags *flag.FlagSet, mounts MountFlags) ([]Mount, error) {
+    root := false
+    flags.Visit(func(f *flag.Flag) {
+        if f.Name == "root" {
+            root = true
+        }
+    })
+    if root && len(mounts) > 0 {
+        return nil, errors.New("--root and --mount cannot be combined")
+    }
+    if root || len(mounts) > 0 {
+        return mounts, nil
+    }
+    return cfg().Mounts, nil
+}
\ No newline at end of file
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestNamespace(t *testing.T) {
+    docs, media := t.TempDir(), t.TempDir()
+    writeFiles(t, docs, map[string]string{ "a.txt": "a" })
+    writeFiles(t, media, map[string]string{ "b.txt": "b", "access.yml": "readwrite: [b.txt]" })
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    mounts := []Mount{
+        { Name: "docs", Path: docs },
+        { Name: "media", Path: media, DefaultFlag: "readonly", RulesFile: "access.yml" },
+    }
+    tree, err := CreateNamespace(mounts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    listing, err := tree.List(ListOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names(listing) != "docs/ media/" {
+        t.Fatalf("mounts listed: %q", names(listing))
+    }
+    for _, name := range []string{ "docs", "new" } {
+        if perms := tree.PermsOf(name); perms & (PermWrite | PermDelete | PermCreate) != 0 {
+            t.Errorf("%s can be changed at the root: %b", name, perms)
+        }
+    }
+    mediaTree, _ := tree.Walk([]string{ "media" })
+    if perms := mediaTree.PermsOf("b.txt"); perms != PermAll {
+        t.Errorf("rules file of the mount: %b", perms)
+    }
+    if perms := mediaTree.PermsOf("c.txt"); perms != PermList | PermRead {
+        t.Errorf("default flag of the mount: %b", perms)
+    }
+    if _, err := CreateNamespace(append(mounts, Mount{ Name: "Docs", Path: docs })); err == nil {
+        t.Error("names only differing in case were accepted")
+    }
+
+    _, app, _ := newServer("", mounts)
+    if _, code := apiRequest(app, "POST", "/delete/docs", nil); code != "forbidden" {
+        t.Errorf("deleting a mount: %s", code)
+    }
+    move := TransferRequest{ From: []string{ "docs", "a.txt" }, To: []string{ "a.txt" } }
+    // Only the mounts exist at the root.
+    if _, code := apiRequest(app, "POST", "/move", move); code != "not_found" {
+        t.Errorf("moving to the root: %s", code)
+    }
+    move.To = []string{ "media", "b.txt" }
+    if w, code := apiRequest(app, "POST", "/move", move); w.Code != http.StatusOK {
+        t.Errorf("moving between mounts: %d %s", w.Code, code)
+    }
+    if contents := readFiles(t, media, "b.txt"); contents["b.txt"] != "a" {
+        t.Errorf("after moving: %v", contents)
+    }
+}
\ No newline at end of file
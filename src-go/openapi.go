@@ -0,0 +1,259 @@
+package main
+
+import (
+    "net/http"
+    "reflect"
+    "regexp"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// apiRoute documents a route of the HTTP API. The OpenAPI description is
+// generated from these and from the types the routes read and respond with.
+type apiRoute struct {
+    Method    string
+    Path    string // As registered with gin.
+    Summary    string
+    Query    []string // Names of the query parameters.
+    Body    any // Zero value of the JSON body, nil if there is none.
+    Data    any // Zero value of the data of successful responses, nil if there is none.
+    Content    string // Media type of successful responses that are not JSON.
+    Errors    []string // Codes the route fails with, besides the common ones.
+    Admin    bool // Served on Admin.Port if set.
+}
+
+var apiRoutes = []apiRoute{
+    { Method: "GET", Path: "/tree/*path", Summary: "List a directory.",
+        Query: []string{ "sort", "order", "filter", "kind", "cursor", "offset", "limit" },
+        Data: Listing{}, Errors: []string{ "not_found", "invalid_listing" } },
+    { Method: "GET", Path: "/watch/*path", Summary: "Watch a directory for changes, over a WebSocket or as server-sent events.",
+        Content: "text/event-stream", Errors: []string{ "not_found", "disabled" } },
+    { Method: "GET", Path: "/fileicon/*path", Summary: "Get the icon of a file.",
+        Content: "image/x-icon", Errors: []string{ "not_found", "forbidden" } },
+    { Method: "GET", Path: "/foldericon", Summary: "Get the icon of folders.",
+        Content: "image/x-icon" },
+    { Method: "GET", Path: "/file/*path", Summary: "Download a file.",
+        Query: []string{ "download" }, Content: "application/octet-stream", Errors: []string{ "not_found", "forbidden" } },
+    { Method: "GET", Path: "/upload/*path", Summary: "Upload a file over a WebSocket, sending an UploadRequest and then signed chunks. Failures after the upgrade close the connection with 4000 plus the status, or 1008 and 1011, and the error as the reason.",
+        Body: UploadRequest{}, Errors: []string{ "not_found", "forbidden", "precondition_failed", "locked", "max_size", "quota", "free_space", "disk_full", "denied", "not_allowed" } },
+    { Method: "GET", Path: "/search/content", Summary: "Search the content of indexed files.",
+        Query: []string{ "q", "limit" }, Data: []SearchResult{}, Errors: []string{ "disabled" } },
+    { Method: "POST", Path: "/move", Summary: "Move or rename a file or folder.",
+        Body: TransferRequest{}, Errors: []string{ "not_found", "forbidden", "precondition_failed", "locked", "max_size", "quota", "free_space", "disk_full", "denied", "not_allowed", "mismatch" } },
+    { Method: "POST", Path: "/copy", Summary: "Copy a file.",
+        Body: TransferRequest{}, Errors: []string{ "not_found", "forbidden", "is_directory", "same_entry", "precondition_failed", "locked", "max_size", "quota", "free_space", "disk_full", "denied", "not_allowed", "mismatch" } },
+    { Method: "POST", Path: "/batch", Summary: "Run a list of operations, each reporting a status and error of its own.",
+        Body: BatchRequest{}, Data: []BatchResult{} },
+    { Method: "POST", Path: "/delete/*path", Summary: "Delete a file or folder.",
+        Errors: []string{ "not_found", "forbidden", "precondition_failed", "locked" } },
+    { Method: "POST", Path: "/lock/*path", Summary: "Lock a file, or refresh a lock.",
+        Body: LockRequest{}, Data: LockResult{}, Errors: []string{ "not_found", "forbidden", "no_such_lock", "locked" } },
+    { Method: "POST", Path: "/unlock", Summary: "Release a lock.",
+        Body: UnlockRequest{}, Errors: []string{ "no_such_lock", "locked" } },
+    { Method: "GET", Path: "/versions/*path", Summary: "List the previous versions of a file.",
+        Data: []Version{}, Errors: []string{ "not_found", "forbidden" } },
+    { Method: "GET", Path: "/version/:id/*path", Summary: "Download a previous version of a file.",
+        Query: []string{ "download" }, Content: "application/octet-stream", Errors: []string{ "not_found", "forbidden" } },
+    { Method: "POST", Path: "/rollback", Summary: "Replace a file with a previous version.",
+        Body: RollbackRequest{}, Errors: []string{ "not_found", "forbidden", "precondition_failed", "locked", "disk_full" } },
+    { Method: "GET", Path: "/trash", Summary: "List the entries in the trash.",
+        Data: []TrashItem{}, Errors: []string{ "disabled" } },
+    { Method: "POST", Path: "/trash/restore", Summary: "Restore an entry from the trash, returning where it went.",
+        Body: RestoreRequest{}, Data: []string{}, Errors: []string{ "not_found", "forbidden", "exists" } },
+    { Method: "POST", Path: "/trash/purge", Summary: "Remove entries from the trash for good, returning how many.",
+        Body: PurgeRequest{}, Data: 0 },
+    { Method: "GET", Path: "/openapi.json", Summary: "Get this description of the API.",
+        Content: "application/json" },
+    { Method: "GET", Path: "/metrics", Summary: "Get metrics in the Prometheus text format.",
+        Content: "text/plain", Admin: true },
+    { Method: "GET", Path: "/healthz", Summary: "Check that the server is running.", Admin: true },
+    { Method: "GET", Path: "/readyz", Summary: "Check that the shared directories can be reached.",
+        Errors: []string{ "not_ready" }, Admin: true },
+    { Method: "GET", Path: "/rules/*path", Summary: "Get the rules file of a directory, with the admin token as a bearer token.",
+        Content: "application/yaml", Errors: []string{ "unauthorized", "not_found" }, Admin: true },
+    { Method: "PUT", Path: "/rules/*path", Summary: "Replace the rules file of a directory, with the admin token as a bearer token.",
+        Errors: []string{ "unauthorized", "not_found", "invalid_request", "invalid_rules", "max_size" }, Admin: true },
+    { Method: "DELETE", Path: "/rules/*path", Summary: "Delete the rules file of a directory, with the admin token as a bearer token.",
+        Errors: []string{ "unauthorized", "not_found" }, Admin: true },
+    { Method: "DELETE", Path: "/locks/*path", Summary: "Break the locks covering a file or folder whoever holds them, with the admin token as a bearer token, returning how many.",
+        Data: 0, Errors: []string{ "unauthorized", "no_such_lock" }, Admin: true },
+}
+
+var routeParam = regexp.MustCompile(`[:*](\w+)`)
+
+// OpenAPI describes the HTTP API as an OpenAPI 3.0 document.
+func OpenAPI() map[string]any {
+    schemas := map[string]any{}
+    errorSchema := openAPISchema(reflect.TypeOf(APIError{}), schemas)
+    codes := ErrorCodes()
+    descriptions := []string{}
+    for _, code := range codes {
+        descriptions = append(descriptions, code + ": " + errorCodes[code].Messages[languages[0]])
+    }
+    schemas["APIError"].(map[string]any)["properties"].(map[string]any)["code"] = map[string]any{
+        "type": "string",
+        "enum": codes,
+        "description": strings.Join(descriptions, "\n"),
+    }
+
+    paths := map[string]any{}
+    for _, route := range apiRoutes {
+        path := routeParam.ReplaceAllString(route.Path, "{$1}")
+        parameters := []any{
+            map[string]any{ "name": "Accept-Language", "in": "header", "schema": map[string]any{ "type": "string" },
+                "description": "Language of error messages: " + strings.Join(languages, " or ") + "." },
+        }
+        for _, match := range routeParam.FindAllStringSubmatch(route.Path, -1) {
+            parameters = append(parameters, map[string]any{ "name": match[1], "in": "path", "required": true, "schema": map[string]any{ "type": "string" } })
+        }
+        for _, name := range route.Query {
+            parameters = append(parameters, map[string]any{ "name": name, "in": "query", "schema": map[string]any{ "type": "string" } })
+        }
+        operation := map[string]any{
+            "summary": route.Summary,
+            "parameters": parameters,
+            "responses": openAPIResponses(route, errorSchema, schemas),
+        }
+        if route.Admin {
+            operation["tags"] = []string{ "admin" }
+        }
+        if route.Body != nil && route.Method != "GET" {
+            operation["requestBody"] = map[string]any{
+                "required": true,
+                "content": map[string]any{ "application/json": map[string]any{ "schema": openAPISchema(reflect.TypeOf(route.Body), schemas) } },
+            }
+        } else if route.Body != nil {
+            // Bodies of WebSocket routes are sent as messages.
+            openAPISchema(reflect.TypeOf(route.Body), schemas)
+        }
+        if paths[path] == nil {
+            paths[path] = map[string]any{}
+        }
+        paths[path].(map[string]any)[strings.ToLower(route.Method)] = operation
+    }
+
+    return map[string]any{
+        "openapi": "3.0.3",
+        "info": map[string]any{
+            "title": "Sagasu",
+            "version": "1",
+            "description": "Failed requests respond with {\"ok\": false, \"error\": APIError}, in the language picked by Accept-Language. Routes tagged admin are served on Admin.Port if it is set.",
+        },
+        "paths": paths,
+        "components": map[string]any{ "schemas": schemas },
+    }
+}
+
+// openAPIResponses describes the responses of a route: success, then the
+// errors it fails with grouped by status.
+func openAPIResponses(route apiRoute, errorSchema map[string]any, schemas map[string]any) map[string]any {
+    success := map[string]any{ "ok": map[string]any{ "type": "boolean" } }
+    if route.Data != nil {
+        success["data"] = openAPISchema(reflect.TypeOf(route.Data), schemas)
+    }
+    content := map[string]any{ "application/json": map[string]any{ "schema": map[string]any{ "type": "object", "properties": success } } }
+    if route.Content != "" {
+        content = map[string]any{ route.Content: map[string]any{} }
+    }
+    responses := map[string]any{
+        "200": map[string]any{ "description": "Success.", "content": content },
+    }
+
+    codes := slices.Clone(route.Errors)
+    if route.Body != nil {
+        codes = append(codes, "invalid_request")
+    }
+    if !route.Admin {
+        codes = append(codes, "too_many_requests")
+    }
+    codes = append(codes, "internal")
+    byStatus := map[int][]string{}
+    for _, code := range codes {
+        status := errorCodes[code].Status
+        byStatus[status] = append(byStatus[status], code)
+    }
+    failure := map[string]any{
+        "type": "object",
+        "properties": map[string]any{ "ok": map[string]any{ "type": "boolean" }, "error": errorSchema },
+    }
+    for status, codes := range byStatus {
+        responses[strconv.Itoa(status)] = map[string]any{
+            "description": http.StatusText(status) + ": " + strings.Join(codes, ", ") + ".",
+            "content": map[string]any{ "application/json": map[string]any{ "schema": failure } },
+        }
+    }
+    return responses
+}
+
+// openAPISchema describes the JSON encoding of values of type t. Named
+// structs are added to schemas and referred to.
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+    if t == reflect.TypeOf(time.Time{}) {
+        return map[string]any{ "type": "string", "format": "date-time" }
+    }
+    switch t.Kind() {
+    case reflect.Pointer:
+        schema := openAPISchema(t.Elem(), schemas)
+        if _, ok := schema["$ref"]; ok {
+            return map[string]any{ "allOf": []any{ schema }, "nullable": true }
+        }
+        schema["nullable"] = true
+        return schema
+    case reflect.Bool:
+        return map[string]any{ "type": "boolean" }
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]any{ "type": "integer" }
+    case reflect.Float32, reflect.Float64:
+        return map[string]any{ "type": "number" }
+    case reflect.String:
+        return map[string]any{ "type": "string" }
+    case reflect.Slice, reflect.Array:
+        return map[string]any{ "type": "array", "items": openAPISchema(t.Elem(), schemas) }
+    case reflect.Map:
+        return map[string]any{ "type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas) }
+    case reflect.Struct:
+        if t.Name() == "" {
+            return openAPIStruct(t, schemas)
+        }
+        if _, ok := schemas[t.Name()]; !ok {
+            // Taken before the fields are described, for types that refer to themselves.
+            schemas[t.Name()] = map[string]any{}
+            schemas[t.Name()] = openAPIStruct(t, schemas)
+        }
+        return map[string]any{ "$ref": "#/components/schemas/" + t.Name() }
+    }
+    return map[string]any{}
+}
+
+// openAPIStruct describes the fields of a struct as encoding/json encodes
+// them, including those of embedded structs.
+func openAPIStruct(t reflect.Type, schemas map[string]any) map[string]any {
+    properties := map[string]any{}
+    var describe func (t reflect.Type)
+    describe = func (t reflect.Type) {
+        for i := 0; i < t.NumField(); i++ {
+            field := t.Field(i)
+            tag := field.Tag.Get("json")
+            if tag == "-" {
+                continue
+            }
+            name, _, _ := strings.Cut(tag, ",")
+            if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+                describe(field.Type)
+                continue
+            }
+            if !field.IsExported() {
+                continue
+            }
+            if name == "" {
+                name = field.Name
+            }
+            properties[name] = openAPISchema(field.Type, schemas)
+        }
+    }
+    describe(t)
+    return map[string]any{ "type": "object", "properties": properties }
+}
\ No newline at end of file
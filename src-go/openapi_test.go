@@ -0,0 +1,47 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+func TestAPIRoutesMatchServer(t *testing.T) {
+    // With a port of its own, admin routes are told apart from the others.
+    useConfig(t, func(c *Config) { c.Admin.Port = 9090 })
+    _, app, admin := newServer(t.TempDir(), nil)
+
+    served := map[string]bool{}
+    for _, route := range routesOf(app.Routes()) {
+        served[route] = false
+    }
+    for _, route := range routesOf(admin.Routes()) {
+        served[route] = true
+    }
+    for _, route := range apiRoutes {
+        key := route.Method + " " + route.Path
+        isAdmin, ok := served[key]
+        switch {
+        case !ok:
+            t.Errorf("%s is described but not served", key)
+        case isAdmin != route.Admin:
+            t.Errorf("%s is described as admin %v but served as admin %v", key, route.Admin, isAdmin)
+        }
+        delete(served, key)
+    }
+    for key := range served {
+        t.Errorf("%s is served but not described", key)
+    }
+}
+
+// routesOf lists the routes of the HTTP API among those of an engine,
+// leaving out WebDAV and the web interface.
+func routesOf(routes []gin.RouteInfo) []string {
+    result := []string{}
+    for _, route := range routes {
+        if route.Path != "/" && route.Path != "/dav/*path" {
+            result = append(result, route.Method + " " + route.Path)
+        }
+    }
+    return result
+}
\ No newline at end of file
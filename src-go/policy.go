@@ -0,0 +1,112 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// Policy is a central rules file kept outside the served root. It maps
+// directories of the tree to the rules they would have in their own rules
+// file. The file is read again whenever it changes, which is checked at most
+// every policyRecheck, but like other rules its sections only reach cached
+// trees according to Tree.CachePolicy.
+type Policy struct {
+    mu          sync.Mutex
+    file        string
+    stamp       time.Time
+    size        int64
+    sections    map[string]*RuleSet // Keyed by slash-separated path, "" for root.
+    checked     time.Time // When the file was last checked for changes.
+    failing     bool // Whether the file could not be read at the last check.
+}
+
+const policyRecheck = time.Second
+
+var policy *Policy
+
+// OpenPolicy loads Tree.PolicyFile, if any, for the tree served from roots,
+// the mounts of a namespace or a single directory.
+func OpenPolicy(roots ...string) error {
+    policy = nil
+    if cfg().Tree.PolicyFile == "" {
+        return nil
+    }
+    if mode := cfg().Tree.PolicyMode; mode != "merge" && mode != "replace" {
+        return fmt.Errorf("invalid policy mode: %s", mode)
+    }
+    file, _ := filepath.Abs(os.ExpandEnv(cfg().Tree.PolicyFile))
+    for _, root := range roots {
+        root, _ = filepath.Abs(root)
+        if rel, err := filepath.Rel(root, file); err == nil && rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+            return fmt.Errorf("%s is inside the served directory", file)
+        }
+    }
+    p := &Policy{ file: file }
+    if err := p.load(); err != nil {
+        return err
+    }
+    policy = p
+    return nil
+}
+
+// policyKey normalizes a directory path of the tree.
+func policyKey(dir string) string {
+    dir = path.Clean("/" + strings.ReplaceAll(dir, "\\", "/"))
+    return strings.TrimPrefix(dir, "/")
+}
+
+// load must be called with the lock held, or before the policy is shared.
+func (p *Policy) load() error {
+    info, err := os.Stat(p.file)
+    if err != nil {
+        return err
+    }
+    if info.ModTime().Equal(p.stamp) && info.Size() == p.size && p.sections != nil {
+        return nil
+    }
+    data, err := os.ReadFile(p.file)
+    if err != nil {
+        return err
+    }
+    docs := map[string]map[string]yaml.Node{}
+    if err := yaml.Unmarshal(data, &docs); err != nil {
+        return err
+    }
+    metrics.rulesLoads.Add(1)
+    sections := map[string]*RuleSet{}
+    for dir, nodes := range docs {
+        set := parseRules(nodes)
+        for i := range set.Rules {
+            set.Rules[i].Policy = true
+        }
+        sections[policyKey(dir)] = &set
+    }
+    p.stamp, p.size, p.sections = info.ModTime(), info.Size(), sections
+    return nil
+}
+
+// Section returns the rules the policy defines for dir, or nil if none. A
+// policy that cannot be read anymore keeps its last sections, which is only
+// warned about once until it can be read again.
+func (p *Policy) Section(dir string) *RuleSet {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if time.Since(p.checked) >= policyRecheck {
+        p.checked = time.Now()
+        err := p.load()
+        if err != nil && !p.failing {
+            fmt.Println("Warning: cannot reload policy file, keeping its last rules:", err)
+        } else if err == nil && p.failing {
+            fmt.Println("Policy file reloaded:", p.file)
+        }
+        p.failing = err != nil
+    }
+    return p.sections[policyKey(dir)]
+}
\ No newline at end of file
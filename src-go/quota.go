@@ -0,0 +1,183 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// SpaceError rejects a write for the space it would take.
+type SpaceError struct {
+    Reason    string // max_size, quota or free_space.
+    Limit    int64
+}
+
+func (e *SpaceError) Error() string {
+    switch e.Reason {
+    case "max_size":
+        return fmt.Sprintf("file larger than max_size of %d bytes", e.Limit)
+    case "quota":
+        return fmt.Sprintf("directory quota of %d bytes exceeded", e.Limit)
+    }
+    return fmt.Sprintf("less than %d bytes of disk space would be left", e.Limit)
+}
+
+// Status is the HTTP status a write rejected with e fails with.
+func (e *SpaceError) Status() int {
+    if e.Reason == "max_size" {
+        return http.StatusRequestEntityTooLarge
+    }
+    return http.StatusInsufficientStorage
+}
+
+var sizeUnits = map[string]int64{
+    "": 1, "B": 1,
+    "K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+    "M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+    "G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+    "T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+// parseSize reads a number of bytes with an optional binary unit, like 512,
+// 100MB or 1.5G.
+func parseSize(value string) (int64, error) {
+    value = strings.TrimSpace(value)
+    i := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+    if i < 0 {
+        i = len(value)
+    }
+    number, err := strconv.ParseFloat(value[:i], 64)
+    unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(value[i:]))]
+    if err != nil || !ok || number < 0 {
+        return 0, fmt.Errorf("invalid size: %s", value)
+    }
+    return int64(number * float64(unit)), nil
+}
+
+// treeUsage sums the sizes of the files below t, leaving out the entries
+// reserved by the server.
+func treeUsage(t *Tree) int64 {
+    entries, err := t.Storage().ReadDir(t.AbsPath())
+    if err != nil {
+        return 0
+    }
+    size := int64(0)
+    for _, entry := range entries {
+        if t.anchored() && t.Root().reserved[entry.Name()] {
+            continue
+        }
+        size += diskUsage(t.Storage(), t.Location(entry.Name()))
+    }
+    return size
+}
+
+// MaxSizeAt returns the largest size allowed for the file named by parts, or
+// 0 if there is no limit.
+func (t *Tree) MaxSizeAt(parts []string) int64 {
+    if len(parts) == 0 {
+        return 0
+    }
+    parent, _ := t.Walk(parts[:len(parts)-1])
+    if parent == nil {
+        return 0
+    }
+    return parent.MaxSizeOf(parts[len(parts)-1])
+}
+
+// CheckSpace tells whether a file of size bytes may be written to the path
+// named by parts, replacing the file there if any. For moves, from names the
+// source, whose bytes already count towards the quotas it shares with the
+// target and whose disk space is reused.
+func (t *Tree) CheckSpace(parts []string, size int64, from []string) error {
+    if len(parts) == 0 {
+        return nil
+    }
+    parent, _ := t.Walk(parts[:len(parts)-1])
+    if parent == nil {
+        // Resolving the path fails anyway.
+        return nil
+    }
+    parent = parent.base()
+    name := parts[len(parts)-1]
+    if limit := parent.MaxSizeOf(name); limit > 0 && size > limit {
+        return &SpaceError{ Reason: "max_size", Limit: limit }
+    }
+    grow := size
+    if info, err := parent.Storage().Stat(parent.Location(name)); err == nil && !info.IsDir() {
+        grow -= info.Size()
+    }
+    for p := parent; p != nil; p = p.prev {
+        quota := p.ruleSet().Quota
+        if quota <= 0 {
+            continue
+        }
+        if prefix := p.Parts(); from != nil && len(from) > len(prefix) && slices.Equal(from[:len(prefix)], prefix) {
+            continue
+        }
+        if treeUsage(p) + grow > quota {
+            return &SpaceError{ Reason: "quota", Limit: quota }
+        }
+    }
+    // Replaced files usually stay on the disk as versions or in the trash.
+    if reserve := cfg().Limits.MinFreeSpace; reserve > 0 && from == nil && Local(t.Storage()) {
+        root, _ := filepath.Abs(t.AnchorOf(parts))
+        if free, err := freeSpace(root); err == nil && int64(free) - size < reserve {
+            return &SpaceError{ Reason: "free_space", Limit: reserve }
+        }
+    }
+    return nil
+}
+
+// SpaceLeft returns how large the file at the path named by parts may grow
+// while it is written, given what is already on the disk, and the error
+// growing it further fails with. There is no limit if the error is nil.
+func (t *Tree) SpaceLeft(parts []string) (int64, error) {
+    left, full := int64(0), (*SpaceError)(nil)
+    if len(parts) == 0 {
+        return left, nil
+    }
+    parent, _ := t.Walk(parts[:len(parts)-1])
+    if parent == nil {
+        return left, nil
+    }
+    parent = parent.base()
+    current := int64(0)
+    if info, err := parent.Storage().Stat(parent.Location(parts[len(parts)-1])); err == nil && !info.IsDir() {
+        current = info.Size()
+    }
+    for p := parent; p != nil; p = p.prev {
+        quota := p.ruleSet().Quota
+        if quota <= 0 {
+            continue
+        }
+        if room := quota - treeUsage(p) + current; full == nil || room < left {
+            left, full = room, &SpaceError{ Reason: "quota", Limit: quota }
+        }
+    }
+    if reserve := cfg().Limits.MinFreeSpace; reserve > 0 && Local(t.Storage()) {
+        root, _ := filepath.Abs(t.AnchorOf(parts))
+        if free, err := freeSpace(root); err == nil {
+            if room := int64(free) - reserve + current; full == nil || room < left {
+                left, full = room, &SpaceError{ Reason: "free_space", Limit: reserve }
+            }
+        }
+    }
+    if full == nil {
+        return left, nil
+    }
+    return left, full
+}
+
+// CheckTempSpace tells whether size bytes may be kept in the temporary
+// directory, where uploads are buffered before being moved into the tree.
+func CheckTempSpace(size int64) error {
+    reserve := cfg().Limits.MinFreeSpace
+    if free, err := freeSpace(os.TempDir()); err == nil && int64(free) - size < reserve {
+        return &SpaceError{ Reason: "free_space", Limit: reserve }
+    }
+    return nil
+}
\ No newline at end of file
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "errors"
+    "io"
+    "net/netip"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestDropbox(t *testing.T) {
+    useConfig(t, nil)
+    tree := memTree(t, map[string]string{
+        ".rules.yml": "dropbox: [inbox, \"outbox/*\"]",
+        "inbox/theirs.txt": "private",
+        "outbox/theirs.txt": "private",
+        "outbox/sub/theirs.txt": "private",
+    })
+    if perms := tree.PermsOf("inbox"); perms != PermList | PermCreate {
+        t.Fatalf("dropbox itself: %b", perms)
+    }
+    inbox, _ := tree.Walk([]string{ "inbox" })
+    if perms := inbox.PermsOf("theirs.txt"); perms != PermCreate {
+        t.Fatalf("entries of the dropbox: %b", perms)
+    }
+    files, _, _, _ := inbox.Scan()
+    if len(files) != 0 {
+        t.Fatalf("entries are listed: %+v", files)
+    }
+    // Hidden entries cannot be told from missing ones.
+    if _, _, err := tree.Locate([]string{ "inbox", "theirs.txt" }, PermRead, true); !errors.Is(err, ErrNotFound) {
+        t.Fatalf("reading from the dropbox: %v", err)
+    }
+    if _, _, err := tree.Locate([]string{ "inbox", "mine.txt" }, PermWrite, false); err != nil {
+        t.Fatalf("dropping a new file: %v", err)
+    }
+    if _, _, err := tree.Locate([]string{ "inbox", "theirs.txt" }, PermWrite, false); !errors.Is(err, ErrForbidden) {
+        t.Fatalf("overwriting a file: %v", err)
+    }
+
+    // Files matched by the rule themselves are not listable.
+    outbox, _ := tree.Walk([]string{ "outbox" })
+    if perms := outbox.PermsOf("theirs.txt"); perms != PermCreate {
+        t.Errorf("file matched by the dropbox: %b", perms)
+    }
+    if perms := outbox.PermsOf("sub"); perms != PermList | PermCreate {
+        t.Errorf("directory matched by the dropbox: %b", perms)
+    }
+}
+
+func TestDefaultDropbox(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "dropbox" })
+    tree := memTree(t, map[string]string{
+        "theirs.txt": "private",
+        "sub/theirs.txt": "private",
+    })
+    if perms := tree.PermsOf("theirs.txt"); perms != PermCreate {
+        t.Errorf("file: %b", perms)
+    }
+    if perms := tree.PermsOf("sub"); perms != PermList | PermCreate {
+        t.Errorf("directory: %b", perms)
+    }
+    if files, _, _, _ := tree.Scan(); len(files) != 0 {
+        t.Errorf("entries are listed: %+v", files)
+    }
+}
+
+func TestClientRules(t *testing.T) {
+    useConfig(t, nil)
+    tree := memTree(t, map[string]string{
+        ".rules.yml": `
+readwrite:
+  - patterns: [lan]
+    clients: [10.0.0.0/8, 192.168.1.20]
+invisible: [lan]
+`,
+    })
+    readwrite, invisible := Flags.Find("readwrite"), Flags.Find("invisible")
+    for addr, want := range map[string]uint16{ "10.1.2.3": readwrite, "192.168.1.20": readwrite, "192.168.1.1": invisible } {
+        if flag, _ := tree.For(netip.MustParseAddr(addr)).FlagOf("lan"); flag != want {
+            t.Errorf("lan from %s: %s", addr, Flags[flag])
+        }
+    }
+    if flag, _ := tree.FlagOf("lan"); flag != invisible {
+        t.Errorf("lan from an unknown client: %s", Flags[flag])
+    }
+}
+
+func TestScheduledRules(t *testing.T) {
+    useConfig(t, nil)
+    tree := memTree(t, map[string]string{
+        ".rules.yml": `
+readwrite:
+  - patterns: [always]
+    schedule: "* * * * *"
+  - patterns: [never]
+    schedule: "* * 30 2 *"
+  - patterns: [expired]
+    until: 2001-01-01
+  - patterns: [broken]
+    schedule: "every day"
+invisible: [never, broken]
+`,
+    })
+    readwrite, invisible := Flags.Find("readwrite"), Flags.Find("invisible")
+    for name, want := range map[string]uint16{ "always": readwrite, "never": invisible, "expired": Flags.Find("readonly"), "broken": invisible } {
+        if flag, _ := tree.FlagOf(name); flag != want {
+            t.Errorf("%s: %s", name, Flags[flag])
+        }
+    }
+    if _, effect := tree.FlagOf("always"); effect == nil || effect.Next != nil {
+        t.Errorf("a schedule matching always should not change: %+v", effect)
+    }
+}
+
+func TestPolicy(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "policy.yml")
+    writeFiles(t, filepath.Dir(file), map[string]string{ "policy.yml": `
+"":
+  readonly: ["*.txt"]
+docs:
+  invisible: ["secret*"]
+` })
+    files := map[string]string{
+        ".rules.yml": "readwrite: [\"*.txt\", \"*.md\"]",
+        "docs/secret.md": "",
+    }
+    for _, mode := range []string{ "merge", "replace" } {
+        useConfig(t, func(c *Config) { c.Tree.PolicyFile, c.Tree.PolicyMode = file, mode })
+        if err := OpenPolicy(t.TempDir()); err != nil {
+            t.Fatal(err)
+        }
+        tree := memTree(t, files)
+        flag, effect := tree.FlagOf("a.txt")
+        if flag != Flags.Find("readonly") || effect == nil || !effect.Policy {
+            t.Errorf("%s: the policy should prevail: %s, %+v", mode, Flags[flag], effect)
+        }
+        want := Flags.Find("readwrite")
+        if mode == "replace" {
+            want = Flags.Find("readonly")
+        }
+        if flag, _ := tree.FlagOf("b.md"); flag != want {
+            t.Errorf("%s: rules file: %s", mode, Flags[flag])
+        }
+        docs, _ := tree.Walk([]string{ "docs" })
+        if flag, _ := docs.FlagOf("secret.md"); flag != Flags.Find("invisible") {
+            t.Errorf("%s: section of a subdirectory: %s", mode, Flags[flag])
+        }
+    }
+
+    useConfig(t, func(c *Config) { c.Tree.PolicyFile = file })
+    if err := OpenPolicy(filepath.Dir(file)); err == nil {
+        t.Error("a policy inside the served directory was accepted")
+    }
+    useConfig(t, func(c *Config) { c.Tree.PolicyFile = file + ".missing" })
+    if err := OpenPolicy(t.TempDir()); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("missing policy: %v", err)
+    }
+}
+
+// captureOutput returns what f prints.
+func captureOutput(t *testing.T, f func()) string {
+    r, w, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    saved := os.Stdout
+    os.Stdout = w
+    f()
+    os.Stdout = saved
+    w.Close()
+    data, _ := io.ReadAll(r)
+    return string(data)
+}
+
+func TestPolicyReload(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "policy.yml")
+    writeFiles(t, dir, map[string]string{ "policy.yml": "docs:\n  readonly: [a]\n" })
+    useConfig(t, func(c *Config) { c.Tree.PolicyFile = file })
+    if err := OpenPolicy(t.TempDir()); err != nil {
+        t.Fatal(err)
+    }
+    if policy.Section("docs") == nil {
+        t.Fatal("no section")
+    }
+
+    // Changes wait for the next check.
+    writeFiles(t, dir, map[string]string{ "policy.yml": "other:\n  readonly: [a]\n" })
+    if policy.Section("docs") == nil {
+        t.Fatal("checked again right away")
+    }
+
+    os.Remove(file)
+    output := captureOutput(t, func() {
+        for i := 0; i < 3; i++ {
+            policy.checked = time.Time{}
+            if policy.Section("docs") == nil {
+                t.Error("the last sections were not kept")
+            }
+        }
+    })
+    if strings.Count(output, "Warning") != 1 {
+        t.Fatalf("warned %q", output)
+    }
+
+    writeFiles(t, dir, map[string]string{ "policy.yml": "other:\n  readonly: [a]\n" })
+    policy.checked = time.Time{}
+    output = captureOutput(t, func() {
+        if policy.Section("docs") != nil || policy.Section("other") == nil {
+            t.Error("the new sections were not read")
+        }
+    })
+    if !strings.Contains(output, "reloaded") {
+        t.Fatalf("printed %q", output)
+    }
+}
\ No newline at end of file
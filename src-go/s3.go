@@ -0,0 +1,979 @@
+package main
+
+import (
+    "crypto/md5"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net/http"
+    "net/netip"
+    "net/url"
+    "os"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+type s3Error struct {
+    Status    int
+    Code    string
+    Message    string
+}
+
+func (e *s3Error) Error() string {
+    return e.Code + ": " + e.Message
+}
+
+var (
+    errS3AccessDenied = &s3Error{ http.StatusForbidden, "AccessDenied", "Access Denied" }
+    errS3InvalidKey = &s3Error{ http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist." }
+    errS3SignatureMismatch = &s3Error{ http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match." }
+    errS3TimeSkewed = &s3Error{ http.StatusForbidden, "RequestTimeTooSkewed", "The request time is too far from the server time." }
+    errS3AuthMalformed = &s3Error{ http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed." }
+    errS3ContentMismatch = &s3Error{ http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The payload does not match its SHA256." }
+    errS3BadDigest = &s3Error{ http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match." }
+    errS3IncompleteBody = &s3Error{ http.StatusBadRequest, "IncompleteBody", "The chunked body is malformed." }
+    errS3MalformedXML = &s3Error{ http.StatusBadRequest, "MalformedXML", "The XML body is malformed." }
+    errS3InvalidArgument = &s3Error{ http.StatusBadRequest, "InvalidArgument", "Invalid argument." }
+    errS3InvalidPart = &s3Error{ http.StatusBadRequest, "InvalidPart", "A part is missing or its ETag does not match." }
+    errS3NoSuchBucket = &s3Error{ http.StatusNotFound, "NoSuchBucket", "The bucket does not exist." }
+    errS3NoSuchKey = &s3Error{ http.StatusNotFound, "NoSuchKey", "The key does not exist." }
+    errS3NoSuchUpload = &s3Error{ http.StatusNotFound, "NoSuchUpload", "The upload does not exist." }
+    errS3NotImplemented = &s3Error{ http.StatusNotImplemented, "NotImplemented", "The operation is not supported." }
+    errS3MethodNotAllowed = &s3Error{ http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed." }
+    errS3EntityTooLarge = &s3Error{ http.StatusBadRequest, "EntityTooLarge", "The object exceeds the maximum allowed size." }
+    errS3StorageFull = &s3Error{ http.StatusInsufficientStorage, "StorageFull", "The quota or disk space is exhausted." }
+    errS3Locked = &s3Error{ http.StatusConflict, "OperationAborted", "The object is locked." }
+    errS3SlowDown = &s3Error{ http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate." }
+    errS3Internal = &s3Error{ http.StatusInternalServerError, "InternalError", "Internal error." }
+)
+
+type s3Object struct {
+    Key                string
+    LastModified    string
+    ETag            string
+    Size            int64
+    StorageClass    string
+}
+
+type s3Prefix struct {
+    Prefix    string
+}
+
+type s3ListResult struct {
+    XMLName                    xml.Name    `xml:"ListBucketResult"`
+    Xmlns                    string        `xml:"xmlns,attr"`
+    Name                    string
+    Prefix                    string
+    Delimiter                string        `xml:",omitempty"`
+    MaxKeys                    int
+    KeyCount                int            `xml:",omitempty"`
+    IsTruncated                bool
+    EncodingType            string        `xml:",omitempty"`
+    Marker                    string        `xml:",omitempty"`
+    NextMarker                string        `xml:",omitempty"`
+    ContinuationToken        string        `xml:",omitempty"`
+    NextContinuationToken    string        `xml:",omitempty"`
+    StartAfter                string        `xml:",omitempty"`
+    Contents                []s3Object
+    CommonPrefixes            []s3Prefix
+}
+
+const (
+    s3MaxPartSize = 5 << 30 // As on S3.
+    s3UploadMaxAge = 24 * time.Hour // Incomplete uploads left alone this long are aborted.
+)
+
+// s3Upload is an incomplete multipart upload, whose parts are stored in dir
+// named by their numbers.
+type s3Upload struct {
+    parts    []string
+    dir        string
+    touched    time.Time // When the upload was created or last received a part.
+}
+
+// size sums the sizes of the parts received so far, but the one numbered
+// except, which is about to be replaced.
+func (u *s3Upload) size(except int) int64 {
+    entries, err := os.ReadDir(u.dir)
+    if err != nil {
+        return 0
+    }
+    size := int64(0)
+    for _, entry := range entries {
+        if entry.Name() == strconv.Itoa(except) {
+            continue
+        }
+        if info, err := entry.Info(); err == nil {
+            size += info.Size()
+        }
+    }
+    return size
+}
+
+// S3Server is a minimal S3-compatible API whose single bucket is the tree.
+// Keys map to slash-separated paths and are resolved through the rules like
+// every other request. Only path-style addressing is supported.
+type S3Server struct {
+    tree    *Tree
+    index    *Index
+    trash    *Trash
+    locks    *LockManager
+    audit    *Audit
+    limits    *Limiter
+    mu        *sync.Mutex // Guards uploads, shared by the copies made for requests.
+    uploads    map[string]*s3Upload
+}
+
+func NewS3Handler(tree *Tree, index *Index, trash *Trash, locks *LockManager, audit *Audit, limits *Limiter) *S3Server {
+    return &S3Server{
+        tree: tree,
+        index: index,
+        trash: trash,
+        locks: locks,
+        audit: audit,
+        limits: limits,
+        mu: &sync.Mutex{},
+        uploads: map[string]*s3Upload{},
+    }
+}
+
+func ServeS3(tree *Tree, index *Index, trash *Trash, locks *LockManager, audit *Audit, limits *Limiter) error {
+    if len(cfg().S3.Users) == 0 {
+        return fmt.Errorf("no users configured")
+    }
+    handler := NewS3Handler(tree, index, trash, locks, audit, limits)
+    go handler.run()
+    return http.ListenAndServe(fmt.Sprintf("%s:%d", cfg().S3.Host, cfg().S3.Port), handler)
+}
+
+func (s *S3Server) run() {
+    for {
+        s.expire()
+        time.Sleep(time.Hour)
+    }
+}
+
+// expire aborts the multipart uploads left alone for s3UploadMaxAge.
+func (s *S3Server) expire() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for id, upload := range s.uploads {
+        if time.Since(upload.touched) > s3UploadMaxAge {
+            delete(s.uploads, id)
+            os.RemoveAll(upload.dir)
+        }
+    }
+}
+
+func s3Time(t time.Time) string {
+    return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+    var serr *s3Error
+    var space *SpaceError
+    var kind *TypeError
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.As(err, &serr):
+    case errors.As(err, &kind):
+        serr = &s3Error{ http.StatusUnsupportedMediaType, "UnsupportedMediaType", kind.Error() + "." }
+    case errors.As(err, &tooLarge):
+        serr = errS3EntityTooLarge
+    case errors.As(err, &space) && space.Reason == "max_size":
+        serr = errS3EntityTooLarge
+    case errors.As(err, &space), isDiskFull(err):
+        serr = errS3StorageFull
+    case errors.Is(err, ErrNotFound), errors.Is(err, fs.ErrNotExist):
+        serr = errS3NoSuchKey
+    case errors.Is(err, ErrForbidden), errors.Is(err, fs.ErrPermission):
+        serr = errS3AccessDenied
+    case errors.Is(err, ErrLocked):
+        serr = errS3Locked
+    default:
+        serr = errS3Internal
+    }
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(serr.Status)
+    if r.Method == http.MethodHead {
+        return
+    }
+    io.WriteString(w, xml.Header)
+    xml.NewEncoder(w).Encode(struct {
+        XMLName        xml.Name    `xml:"Error"`
+        Code        string
+        Message        string
+        Resource    string
+    }{ Code: serr.Code, Message: serr.Message, Resource: r.URL.Path })
+}
+
+func writeS3Xml(w http.ResponseWriter, v any) {
+    w.Header().Set("Content-Type", "application/xml")
+    io.WriteString(w, xml.Header)
+    xml.NewEncoder(w).Encode(v)
+}
+
+func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    release, ok := s.limits.Connect()
+    if !ok {
+        writeS3Error(w, r, errS3SlowDown)
+        return
+    }
+    defer release()
+    auth, err := s3Authenticate(r)
+    if err != nil {
+        writeS3Error(w, r, err)
+        return
+    }
+    body := &auditReader{ ReadCloser: auth.Body(r) }
+    r.Body = body
+    if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+        r.ContentLength, _ = strconv.ParseInt(decoded, 10, 64)
+    }
+    bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+    if bucket == "" {
+        if r.Method != http.MethodGet {
+            writeS3Error(w, r, errS3MethodNotAllowed)
+            return
+        }
+        s.listBuckets(w)
+        return
+    }
+    if bucket != cfg().S3.Bucket {
+        writeS3Error(w, r, errS3NoSuchBucket)
+        return
+    }
+    client := remoteHost(r.RemoteAddr)
+    // The request is served by a copy resolving paths for the client.
+    addr, _ := netip.ParseAddr(client)
+    view := *s
+    view.tree = s.tree.For(addr)
+    s = &view
+    entry := AuditEntry{ Time: time.Now(), Client: client, User: auth.User, Via: "s3" }
+    aw := &auditWriter{ ResponseWriter: w }
+    var out http.ResponseWriter = aw
+    switch {
+    case key == "" && r.Method == http.MethodGet:
+        if !s.limits.AllowMetadata(client) {
+            writeS3Error(w, r, errS3SlowDown)
+            return
+        }
+    case key != "" && r.Method == http.MethodGet:
+        out = &throttledWriter{ ResponseWriter: aw, wait: func(n int) { s.limits.WaitDownload(client, n) } }
+    case key != "" && r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") == "":
+        done, ok := s.limits.StartUpload(client)
+        if !ok {
+            writeS3Error(w, r, errS3SlowDown)
+            return
+        }
+        defer done()
+        body.ReadCloser = &throttledReader{ ReadCloser: body.ReadCloser, wait: func(n int) { s.limits.WaitUpload(client, n) } }
+    }
+    if key == "" {
+        err = s.serveBucket(out, r, entry)
+    } else {
+        err = s.serveObject(out, r, key)
+    }
+    if err != nil {
+        writeS3Error(aw, r, err)
+    }
+    entry.Action, entry.Path, entry.Target = s3Action(r, key)
+    switch entry.Action {
+    case "file":
+        metrics.Transfer("download", "s3", aw.n)
+    case "upload":
+        metrics.Transfer("upload", "s3", body.n)
+    }
+    if entry.Action != "" {
+        entry.Bytes = body.n + aw.n
+        entry.Status = max(aw.status, http.StatusOK)
+        entry.Outcome = auditOutcome(entry.Status)
+        s.audit.Log(entry)
+    }
+}
+
+// s3Action tells how a request is audited. Parts of multipart uploads are
+// not, and neither are batch deletes since each of their objects is.
+func s3Action(r *http.Request, key string) (string, string, string) {
+    query := r.URL.Query()
+    switch {
+    case key == "":
+        if r.Method == http.MethodGet && !query.Has("location") {
+            return "tree", strings.TrimSuffix(query.Get("prefix"), "/"), ""
+        }
+    case r.Method == http.MethodGet:
+        return "file", key, ""
+    case r.Method == http.MethodPut && query.Has("uploadId"):
+    case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+        source, _ := s3CopySource(r)
+        return "copy", source, key
+    case r.Method == http.MethodPut:
+        return "upload", key, ""
+    case r.Method == http.MethodPost && query.Has("uploadId"):
+        return "upload", key, ""
+    case r.Method == http.MethodDelete && !query.Has("uploadId"):
+        return "delete", key, ""
+    }
+    return "", "", ""
+}
+
+// s3CopySource returns the key named by X-Amz-Copy-Source.
+func s3CopySource(r *http.Request) (string, error) {
+    source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+    if err != nil {
+        return "", errS3InvalidArgument
+    }
+    source, _, _ = strings.Cut(source, "?")
+    bucket, key, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+    if bucket != cfg().S3.Bucket {
+        return "", errS3NoSuchBucket
+    }
+    return key, nil
+}
+
+func (s *S3Server) listBuckets(w http.ResponseWriter) {
+    created := time.Now()
+    if info, err := s.tree.Storage().Stat(s.tree.AbsPath()); err == nil {
+        created = info.ModTime()
+    }
+    type bucket struct {
+        Name            string
+        CreationDate    string
+    }
+    writeS3Xml(w, struct {
+        XMLName    xml.Name    `xml:"ListAllMyBucketsResult"`
+        Xmlns    string        `xml:"xmlns,attr"`
+        Owner    struct{ ID string }
+        Buckets    []bucket    `xml:"Buckets>Bucket"`
+    }{
+        Xmlns: s3Namespace,
+        Buckets: []bucket{{ Name: cfg().S3.Bucket, CreationDate: s3Time(created) }},
+    })
+}
+
+func (s *S3Server) serveBucket(w http.ResponseWriter, r *http.Request, entry AuditEntry) error {
+    query := r.URL.Query()
+    switch {
+    case r.Method == http.MethodHead:
+        return nil
+    case r.Method == http.MethodGet && query.Has("location"):
+        writeS3Xml(w, struct {
+            XMLName    xml.Name    `xml:"LocationConstraint"`
+            Xmlns    string        `xml:"xmlns,attr"`
+            Region    string        `xml:",chardata"`
+        }{ Xmlns: s3Namespace, Region: cfg().S3.Region })
+        return nil
+    case r.Method == http.MethodGet && (len(query) == 0 || query.Has("list-type") || query.Has("prefix") || query.Has("delimiter") || query.Has("marker") || query.Has("max-keys")):
+        return s.listObjects(w, query)
+    case r.Method == http.MethodPost && query.Has("delete"):
+        return s.deleteObjects(w, r, entry)
+    }
+    return errS3NotImplemented
+}
+
+func (s *S3Server) serveObject(w http.ResponseWriter, r *http.Request, key string) error {
+    query := r.URL.Query()
+    parts := strings.Split(key, "/")
+    switch r.Method {
+    case http.MethodGet, http.MethodHead:
+        return s.getObject(w, r, parts)
+    case http.MethodPut:
+        if query.Has("uploadId") {
+            return s.uploadPart(w, r, query)
+        } else if r.Header.Get("X-Amz-Copy-Source") != "" {
+            return s.copyObject(w, r, parts)
+        }
+        return s.putObject(w, r, parts)
+    case http.MethodPost:
+        if query.Has("uploads") {
+            return s.createUpload(w, parts)
+        } else if query.Has("uploadId") {
+            return s.completeUpload(w, r, parts, query.Get("uploadId"))
+        }
+    case http.MethodDelete:
+        if query.Has("uploadId") {
+            return s.abortUpload(w, query.Get("uploadId"))
+        }
+        if err := s.deleteObject(parts); err != nil {
+            return err
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return nil
+    }
+    return errS3NotImplemented
+}
+
+func (s *S3Server) getObject(w http.ResponseWriter, r *http.Request, parts []string) error {
+    _, loc, err := s.tree.Locate(parts, PermRead, true)
+    if err != nil {
+        return err
+    }
+    fp, err := os.Open(loc)
+    if err != nil {
+        return err
+    }
+    defer fp.Close()
+    info, err := fp.Stat()
+    if err != nil {
+        return err
+    }
+    if info.IsDir() {
+        return errS3NoSuchKey
+    }
+    w.Header().Set("ETag", fileETag(info))
+    http.ServeContent(w, r, info.Name(), info.ModTime(), fp)
+    return nil
+}
+
+// receive stores the request body in a temporary file, checking it against
+// Content-MD5 if the client sent one. It returns the file and the MD5 sum.
+func receive(r *http.Request, dir string) (string, string, error) {
+    tmp, err := os.CreateTemp(dir, "")
+    if err != nil {
+        return "", "", err
+    }
+    defer tmp.Close()
+    hasher := md5.New()
+    if _, err := io.Copy(io.MultiWriter(tmp, hasher), r.Body); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return "", "", err
+    }
+    sum := hasher.Sum(nil)
+    if expected := r.Header.Get("Content-MD5"); expected != "" && expected != base64.StdEncoding.EncodeToString(sum) {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return "", "", errS3BadDigest
+    }
+    return tmp.Name(), hex.EncodeToString(sum), nil
+}
+
+// mkdirs creates the missing parent directories of parts, each of which has
+// to be writable, since S3 keys imply their prefixes.
+func (s *S3Server) mkdirs(parts []string) error {
+    t := s.tree
+    for i, segment := range parts[:len(parts)-1] {
+        if next := t.Next(segment); next != nil {
+            t = next
+            continue
+        }
+        _, loc, err := s.tree.Locate(parts[:i+1], PermCreate, false)
+        if err != nil {
+            return err
+        }
+        if err := os.Mkdir(loc, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+            return err
+        }
+        if t = t.Next(segment); t == nil {
+            return errS3AccessDenied
+        }
+    }
+    return nil
+}
+
+// commit moves a received file into place at parts.
+func (s *S3Server) commit(w http.ResponseWriter, tmp string, parts []string) error {
+    if err := s.tree.CheckType(parts, sniffFile(OSStorage, tmp)); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    // The body may have come without a length, and the tree may have grown
+    // since the length was checked.
+    info, err := os.Stat(tmp)
+    if err == nil {
+        err = s.tree.CheckSpace(parts, info.Size(), nil)
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err := s.mkdirs(parts); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    // S3 has no lock tokens, so keys locked through WebDAV or the HTTP API
+    // cannot be written.
+    release, err := s.locks.Acquire("", lockName(parts))
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    defer release()
+    _, loc, err := s.tree.Locate(parts, PermWrite, false)
+    if err == nil {
+        err = s.trash.Replace(s.tree, parts, loc)
+    }
+    if err == nil {
+        // The temporary directory may be on another volume than the tree.
+        err = moveEntry(s.tree.Storage(), tmp, loc, nil)
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    s.index.Refresh(parts)
+    if cfg().Tree.CachePolicy == "upload" {
+        s.tree.Reload()
+    }
+    if info, err := os.Stat(loc); err == nil {
+        w.Header().Set("ETag", fileETag(info))
+    }
+    return nil
+}
+
+func (s *S3Server) putObject(w http.ResponseWriter, r *http.Request, parts []string) error {
+    if parts[len(parts)-1] == "" {
+        // Keys ending with a slash are directory markers.
+        if err := s.mkdirs(parts); err != nil {
+            return err
+        }
+        return nil
+    }
+    if _, _, err := s.tree.Locate(parts, PermWrite, false); err != nil && !errors.Is(err, ErrNotFound) {
+        return err
+    }
+    if err := s.tree.CheckType(parts, ""); err != nil {
+        return err
+    }
+    if r.ContentLength >= 0 {
+        if err := s.tree.CheckSpace(parts, r.ContentLength, nil); err != nil {
+            return err
+        }
+        if err := CheckTempSpace(r.ContentLength); err != nil {
+            return err
+        }
+    } else if limit := s.tree.MaxSizeAt(parts); limit > 0 {
+        r.Body = http.MaxBytesReader(nil, r.Body, limit)
+    }
+    tmp, _, err := receive(r, "")
+    if err != nil {
+        return err
+    }
+    return s.commit(w, tmp, parts)
+}
+
+func (s *S3Server) copyObject(w http.ResponseWriter, r *http.Request, parts []string) error {
+    key, err := s3CopySource(r)
+    if err != nil {
+        return err
+    }
+    _, from, err := s.tree.Locate(strings.Split(key, "/"), PermRead, true)
+    if err != nil {
+        return err
+    }
+    src, err := os.Open(from)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    if info, err := src.Stat(); err != nil {
+        return err
+    } else if err := s.tree.CheckSpace(parts, info.Size(), nil); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp("", "")
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(tmp, src)
+    tmp.Close()
+    if err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := s.commit(w, tmp.Name(), parts); err != nil {
+        return err
+    }
+    _, loc, _ := s.tree.Locate(parts, 0, false)
+    info, err := os.Stat(loc)
+    if err != nil {
+        return err
+    }
+    writeS3Xml(w, struct {
+        XMLName            xml.Name    `xml:"CopyObjectResult"`
+        Xmlns            string        `xml:"xmlns,attr"`
+        ETag            string
+        LastModified    string
+    }{ Xmlns: s3Namespace, ETag: fileETag(info), LastModified: s3Time(info.ModTime()) })
+    return nil
+}
+
+func (s *S3Server) deleteObject(parts []string) error {
+    marker := parts[len(parts)-1] == ""
+    if marker {
+        parts = parts[:len(parts)-1]
+    }
+    _, loc, err := s.tree.Locate(parts, PermDelete, true)
+    if errors.Is(err, ErrNotFound) {
+        // Deleting a missing key succeeds in S3.
+        return nil
+    } else if err != nil {
+        return err
+    }
+    info, err := os.Stat(loc)
+    if err != nil {
+        return err
+    }
+    if info.IsDir() != marker {
+        return nil
+    }
+    release, err := s.locks.Acquire("", lockName(parts))
+    if err != nil {
+        return err
+    }
+    defer release()
+    if marker {
+        // Directory markers only go away together with the last key below.
+        if entries, _ := os.ReadDir(loc); len(entries) > 0 {
+            return nil
+        }
+        err = os.Remove(loc)
+    } else {
+        err = s.trash.Delete(s.tree, parts)
+    }
+    if err != nil {
+        return err
+    }
+    s.index.Refresh(parts)
+    return nil
+}
+
+func (s *S3Server) deleteObjects(w http.ResponseWriter, r *http.Request, entry AuditEntry) error {
+    body := struct {
+        Quiet    bool
+        Objects    []struct{ Key string }    `xml:"Object"`
+    }{}
+    if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+        return errS3MalformedXML
+    }
+    type deleted struct {
+        Key    string
+    }
+    type failed struct {
+        Key        string
+        Code    string
+        Message    string
+    }
+    result := struct {
+        XMLName    xml.Name    `xml:"DeleteResult"`
+        Xmlns    string        `xml:"xmlns,attr"`
+        Deleted    []deleted
+        Error    []failed
+    }{ Xmlns: s3Namespace }
+    for _, object := range body.Objects {
+        err := s.deleteObject(strings.Split(object.Key, "/"))
+        entry.Action, entry.Path, entry.Outcome = "delete", object.Key, auditOutcomeOf(err)
+        s.audit.Log(entry)
+        var serr *s3Error
+        if err == nil {
+            if !body.Quiet {
+                result.Deleted = append(result.Deleted, deleted{ Key: object.Key })
+            }
+        } else if errors.As(err, &serr) {
+            result.Error = append(result.Error, failed{ Key: object.Key, Code: serr.Code, Message: serr.Message })
+        } else if errors.Is(err, ErrForbidden) {
+            result.Error = append(result.Error, failed{ Key: object.Key, Code: errS3AccessDenied.Code, Message: errS3AccessDenied.Message })
+        } else if errors.Is(err, ErrLocked) {
+            result.Error = append(result.Error, failed{ Key: object.Key, Code: errS3Locked.Code, Message: errS3Locked.Message })
+        } else {
+            result.Error = append(result.Error, failed{ Key: object.Key, Code: errS3Internal.Code, Message: errS3Internal.Message })
+        }
+    }
+    writeS3Xml(w, result)
+    return nil
+}
+
+func (s *S3Server) createUpload(w http.ResponseWriter, parts []string) error {
+    if _, _, err := s.tree.Locate(parts, PermWrite, false); err != nil && !errors.Is(err, ErrNotFound) {
+        return err
+    }
+    if err := s.tree.CheckType(parts, ""); err != nil {
+        return err
+    }
+    dir, err := os.MkdirTemp("", "sagasu-s3-")
+    if err != nil {
+        return err
+    }
+    idbin := make([]byte, 16)
+    rand.Read(idbin)
+    id := hex.EncodeToString(idbin)
+    s.mu.Lock()
+    s.uploads[id] = &s3Upload{ parts: parts, dir: dir, touched: time.Now() }
+    s.mu.Unlock()
+    writeS3Xml(w, struct {
+        XMLName        xml.Name    `xml:"InitiateMultipartUploadResult"`
+        Xmlns        string        `xml:"xmlns,attr"`
+        Bucket        string
+        Key            string
+        UploadId    string
+    }{ Xmlns: s3Namespace, Bucket: cfg().S3.Bucket, Key: strings.Join(parts, "/"), UploadId: id })
+    return nil
+}
+
+// upload finds an incomplete upload, keeping it from expiring for now.
+func (s *S3Server) upload(id string) (*s3Upload, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    upload, ok := s.uploads[id]
+    if !ok {
+        return nil, errS3NoSuchUpload
+    }
+    upload.touched = time.Now()
+    return upload, nil
+}
+
+// uploadPart stores a part of an upload. The parts received so far count
+// towards the limits of the object, which are checked before and after the
+// part arrives since its length may not be known.
+func (s *S3Server) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) error {
+    upload, err := s.upload(query.Get("uploadId"))
+    if err != nil {
+        return err
+    }
+    number, err := strconv.Atoi(query.Get("partNumber"))
+    if err != nil || number < 1 || number > 10000 {
+        return errS3InvalidArgument
+    }
+    if r.ContentLength > s3MaxPartSize {
+        return errS3EntityTooLarge
+    }
+    size := max(r.ContentLength, 0)
+    received := upload.size(number)
+    if err := s.tree.CheckSpace(upload.parts, received + size, nil); err != nil {
+        return err
+    }
+    if err := CheckTempSpace(size); err != nil {
+        return err
+    }
+    r.Body = http.MaxBytesReader(nil, r.Body, s3MaxPartSize)
+    tmp, sum, err := receive(r, upload.dir)
+    if err != nil {
+        return err
+    }
+    info, err := os.Stat(tmp)
+    if err == nil {
+        err = s.tree.CheckSpace(upload.parts, received + info.Size(), nil)
+    }
+    if err == nil {
+        err = os.Rename(tmp, filepath.Join(upload.dir, strconv.Itoa(number)))
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    w.Header().Set("ETag", "\"" + sum + "\"")
+    return nil
+}
+
+func (s *S3Server) completeUpload(w http.ResponseWriter, r *http.Request, parts []string, id string) error {
+    upload, err := s.upload(id)
+    if err != nil {
+        return err
+    }
+    body := struct {
+        Parts    []struct {
+            PartNumber    int
+            ETag        string
+        }    `xml:"Part"`
+    }{}
+    if err := xml.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Parts) == 0 {
+        return errS3MalformedXML
+    }
+    if !slices.Equal(parts, upload.parts) {
+        return errS3NoSuchUpload
+    }
+    tmp, err := os.CreateTemp("", "")
+    if err != nil {
+        return err
+    }
+    defer tmp.Close()
+    for _, part := range body.Parts {
+        fp, err := os.Open(filepath.Join(upload.dir, strconv.Itoa(part.PartNumber)))
+        if err != nil {
+            os.Remove(tmp.Name())
+            return errS3InvalidPart
+        }
+        hasher := md5.New()
+        _, err = io.Copy(io.MultiWriter(tmp, hasher), fp)
+        fp.Close()
+        if err != nil || strings.Trim(part.ETag, "\"") != hex.EncodeToString(hasher.Sum(nil)) {
+            os.Remove(tmp.Name())
+            if err != nil {
+                return err
+            }
+            return errS3InvalidPart
+        }
+    }
+    tmp.Close()
+    if info, err := os.Stat(tmp.Name()); err == nil {
+        if err := s.tree.CheckSpace(parts, info.Size(), nil); err != nil {
+            os.Remove(tmp.Name())
+            return err
+        }
+    }
+    if err := s.commit(w, tmp.Name(), parts); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    delete(s.uploads, id)
+    s.mu.Unlock()
+    os.RemoveAll(upload.dir)
+    writeS3Xml(w, struct {
+        XMLName    xml.Name    `xml:"CompleteMultipartUploadResult"`
+        Xmlns    string        `xml:"xmlns,attr"`
+        Bucket    string
+        Key        string
+        ETag    string
+    }{ Xmlns: s3Namespace, Bucket: cfg().S3.Bucket, Key: strings.Join(parts, "/"), ETag: w.Header().Get("ETag") })
+    return nil
+}
+
+func (s *S3Server) abortUpload(w http.ResponseWriter, id string) error {
+    upload, err := s.upload(id)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    delete(s.uploads, id)
+    s.mu.Unlock()
+    os.RemoveAll(upload.dir)
+    w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+// listObjects implements both versions of ListObjects. Keys are collected
+// from the directory named by the prefix, recursively unless the delimiter
+// is a slash.
+func (s *S3Server) listObjects(w http.ResponseWriter, query url.Values) error {
+    v2 := query.Get("list-type") == "2"
+    prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+    maxKeys := 1000
+    if query.Has("max-keys") {
+        var err error
+        if maxKeys, err = strconv.Atoi(query.Get("max-keys")); err != nil || maxKeys < 0 {
+            return errS3InvalidArgument
+        }
+    }
+    after := query.Get("marker")
+    if v2 {
+        after = query.Get("start-after")
+        if token := query.Get("continuation-token"); token != "" {
+            decoded, err := base64.RawURLEncoding.DecodeString(token)
+            if err != nil {
+                return errS3InvalidArgument
+            }
+            after = string(decoded)
+        }
+    }
+
+    base := ""
+    if i := strings.LastIndex(prefix, "/"); i >= 0 {
+        base = prefix[:i+1]
+    }
+    objects := []s3Object{}
+    if t, _ := s.tree.Walk(splitPath(base)); t != nil {
+        objects = s.collect(t, base, delimiter != "/")
+    }
+    slices.SortFunc(objects, func(a s3Object, b s3Object) int { return strings.Compare(a.Key, b.Key) })
+
+    escape := func(key string) string { return key }
+    if query.Get("encoding-type") == "url" {
+        escape = func(key string) string { return awsEscape(key, false) }
+    }
+    result := s3ListResult{
+        Xmlns: s3Namespace,
+        Name: cfg().S3.Bucket,
+        Prefix: escape(prefix),
+        Delimiter: escape(delimiter),
+        MaxKeys: maxKeys,
+        EncodingType: query.Get("encoding-type"),
+        Contents: []s3Object{},
+        CommonPrefixes: []s3Prefix{},
+    }
+    last := ""
+    for _, object := range objects {
+        if !strings.HasPrefix(object.Key, prefix) || object.Key <= after {
+            continue
+        }
+        key, common := object.Key, false
+        if delimiter != "" {
+            if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+                key, common = key[:len(prefix)+i+len(delimiter)], true
+                if key <= after || len(result.CommonPrefixes) > 0 && result.CommonPrefixes[len(result.CommonPrefixes)-1].Prefix == escape(key) {
+                    continue
+                }
+            }
+        }
+        if len(result.Contents) + len(result.CommonPrefixes) >= maxKeys {
+            result.IsTruncated = true
+            break
+        }
+        if common {
+            result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{ Prefix: escape(key) })
+        } else {
+            object.Key = escape(object.Key)
+            result.Contents = append(result.Contents, object)
+        }
+        last = key
+    }
+    if v2 {
+        result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+        result.ContinuationToken = query.Get("continuation-token")
+        result.StartAfter = query.Get("start-after")
+        if result.IsTruncated {
+            result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+        }
+    } else {
+        result.Marker = query.Get("marker")
+        if result.IsTruncated {
+            result.NextMarker = escape(last)
+        }
+    }
+    writeS3Xml(w, result)
+    return nil
+}
+
+// collect lists the visible files below t as objects keyed under base.
+// Directories become "name/" entries when not recursing.
+func (s *S3Server) collect(t *Tree, base string, recursive bool) []s3Object {
+    objects := []s3Object{}
+    entries, err := t.Storage().ReadDir(t.AbsPath())
+    if err != nil {
+        return objects
+    }
+    for _, entry := range entries {
+        if t.Hidden(entry.Name()) { continue }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        key := base + entry.Name()
+        if entry.IsDir() {
+            if !recursive {
+                objects = append(objects, s3Object{ Key: key + "/" })
+            } else if next := t.Next(entry.Name()); next != nil {
+                objects = append(objects, s.collect(next, key + "/", true)...)
+            }
+            continue
+        }
+        objects = append(objects, s3Object{
+            Key: key,
+            LastModified: s3Time(info.ModTime()),
+            ETag: fileETag(info),
+            Size: info.Size(),
+            StorageClass: "STANDARD",
+        })
+    }
+    return objects
+}
\ No newline at end of file
@@ -0,0 +1,280 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// s3Client signs requests like the AWS SDKs do, independently of the
+// verification in sigv4.go.
+type s3Client struct {
+    t        *testing.T
+    server    *httptest.Server
+    access    string
+    secret    string
+}
+
+func newS3Client(t *testing.T, files map[string]string) (*s3Client, string) {
+    root := t.TempDir()
+    writeFiles(t, root, files)
+    useConfig(t, func(c *Config) {
+        c.Tree.DefaultFlag = "readwrite"
+        c.Trash.Enabled = false
+        c.S3.Users["alice"] = S3User{ AccessKey: "AKIDALICE", SecretKey: "alice-secret" }
+    })
+    tree := CreateTree(root)
+    handler := NewS3Handler(tree, nil, OpenTrash(tree, OpenVersions(tree)), NewLockManager(), nil, NewLimiter())
+    server := httptest.NewServer(handler)
+    t.Cleanup(server.Close)
+    return &s3Client{ t: t, server: server, access: "AKIDALICE", secret: "alice-secret" }, root
+}
+
+func signingKey(secret string, day string) []byte {
+    key := []byte("AWS4" + secret)
+    for _, part := range []string{ day, "us-east-1", "s3", "aws4_request" } {
+        mac := hmac.New(sha256.New, key)
+        mac.Write([]byte(part))
+        key = mac.Sum(nil)
+    }
+    return key
+}
+
+func signature(key []byte, date string, scope string, canonical string) string {
+    sum := sha256.Sum256([]byte(canonical))
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte("AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(sum[:])))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// do sends a request signed in the Authorization header, claiming payload
+// as the body if given.
+func (c *s3Client) do(method string, target string, body []byte, payload []byte) *http.Response {
+    req, err := http.NewRequest(method, c.server.URL + target, bytes.NewReader(body))
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    if payload == nil {
+        payload = body
+    }
+    sum := sha256.Sum256(payload)
+    hash := hex.EncodeToString(sum[:])
+    date := time.Now().UTC().Format("20060102T150405Z")
+    scope := date[:8] + "/us-east-1/s3/aws4_request"
+    canonical := strings.Join([]string{
+        method,
+        req.URL.EscapedPath(),
+        req.URL.Query().Encode(),
+        "host:" + req.URL.Host + "\nx-amz-content-sha256:" + hash + "\nx-amz-date:" + date + "\n",
+        "host;x-amz-content-sha256;x-amz-date",
+        hash,
+    }, "\n")
+    req.Header.Set("X-Amz-Date", date)
+    req.Header.Set("X-Amz-Content-Sha256", hash)
+    req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + c.access + "/" + scope +
+        ",SignedHeaders=host;x-amz-content-sha256;x-amz-date,Signature=" +
+        signature(signingKey(c.secret, date[:8]), date, scope, canonical))
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    c.t.Cleanup(func() { resp.Body.Close() })
+    return resp
+}
+
+// presign returns a URL to GET target valid for a minute.
+func (c *s3Client) presign(target string) string {
+    u, _ := url.Parse(c.server.URL + target)
+    date := time.Now().UTC().Format("20060102T150405Z")
+    scope := date[:8] + "/us-east-1/s3/aws4_request"
+    query := url.Values{
+        "X-Amz-Algorithm": { "AWS4-HMAC-SHA256" },
+        "X-Amz-Credential": { c.access + "/" + scope },
+        "X-Amz-Date": { date },
+        "X-Amz-Expires": { "60" },
+        "X-Amz-SignedHeaders": { "host" },
+    }
+    canonical := strings.Join([]string{
+        http.MethodGet, u.EscapedPath(), query.Encode(), "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD",
+    }, "\n")
+    query.Set("X-Amz-Signature", signature(signingKey(c.secret, date[:8]), date, scope, canonical))
+    u.RawQuery = query.Encode()
+    return u.String()
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+func TestS3PutAndGet(t *testing.T) {
+    c, root := newS3Client(t, nil)
+    if resp := c.do(http.MethodPut, "/sagasu/docs/a.txt", []byte("hello"), nil); resp.StatusCode != http.StatusOK {
+        t.Fatalf("put: status %d: %s", resp.StatusCode, readBody(t, resp))
+    }
+    if data, err := os.ReadFile(filepath.Join(root, "docs", "a.txt")); err != nil || string(data) != "hello" {
+        t.Fatalf("stored %q, %v", data, err)
+    }
+    resp := c.do(http.MethodGet, "/sagasu/docs/a.txt", nil, nil)
+    if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "hello" {
+        t.Fatalf("get: status %d: %q", resp.StatusCode, body)
+    }
+    resp = c.do(http.MethodGet, "/sagasu?list-type=2&prefix=docs/", nil, nil)
+    if body := readBody(t, resp); !strings.Contains(body, "<Key>docs/a.txt</Key>") {
+        t.Fatalf("list: %s", body)
+    }
+}
+
+func TestS3Presigned(t *testing.T) {
+    c, _ := newS3Client(t, map[string]string{ "a.txt": "presigned" })
+    resp, err := http.Get(c.presign("/sagasu/a.txt"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "presigned" {
+        t.Fatalf("status %d: %q", resp.StatusCode, body)
+    }
+}
+
+func TestS3RejectsBadSignatures(t *testing.T) {
+    c, _ := newS3Client(t, map[string]string{ "a.txt": "secret" })
+
+    c.secret = "wrong"
+    resp := c.do(http.MethodGet, "/sagasu/a.txt", nil, nil)
+    if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "SignatureDoesNotMatch") {
+        t.Fatalf("wrong secret: status %d: %s", resp.StatusCode, body)
+    }
+
+    c.access = "AKIDNOBODY"
+    resp = c.do(http.MethodGet, "/sagasu/a.txt", nil, nil)
+    if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "InvalidAccessKeyId") {
+        t.Fatalf("unknown key: status %d: %s", resp.StatusCode, body)
+    }
+
+    resp, err := http.Get(c.server.URL + "/sagasu/a.txt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("anonymous: status %d", resp.StatusCode)
+    }
+}
+
+func TestS3RejectsTamperedPayload(t *testing.T) {
+    c, root := newS3Client(t, nil)
+    resp := c.do(http.MethodPut, "/sagasu/a.txt", []byte("tampered"), []byte("original"))
+    if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "XAmzContentSHA256Mismatch") {
+        t.Fatalf("status %d: %s", resp.StatusCode, body)
+    }
+    if _, err := os.Stat(filepath.Join(root, "a.txt")); err == nil {
+        t.Fatal("tampered payload was stored")
+    }
+}
+
+func TestS3Multipart(t *testing.T) {
+    c, root := newS3Client(t, nil)
+    resp := c.do(http.MethodPost, "/sagasu/big.bin?uploads", nil, nil)
+    created := struct { UploadId string }{}
+    if err := xml.NewDecoder(resp.Body).Decode(&created); err != nil || created.UploadId == "" {
+        t.Fatalf("create: status %d, %v", resp.StatusCode, err)
+    }
+    etags := []string{}
+    for i, part := range []string{ "first-", "second" } {
+        resp := c.do(http.MethodPut, "/sagasu/big.bin?partNumber=" + strconv.Itoa(i + 1) + "&uploadId=" + created.UploadId, []byte(part), nil)
+        if resp.StatusCode != http.StatusOK {
+            t.Fatalf("part %d: status %d: %s", i + 1, resp.StatusCode, readBody(t, resp))
+        }
+        etags = append(etags, resp.Header.Get("ETag"))
+    }
+    complete := "<CompleteMultipartUpload>"
+    for i, etag := range etags {
+        complete += "<Part><PartNumber>" + strconv.Itoa(i + 1) + "</PartNumber><ETag>" + etag + "</ETag></Part>"
+    }
+    complete += "</CompleteMultipartUpload>"
+    resp = c.do(http.MethodPost, "/sagasu/big.bin?uploadId=" + created.UploadId, []byte(complete), nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("complete: status %d: %s", resp.StatusCode, readBody(t, resp))
+    }
+    if data, err := os.ReadFile(filepath.Join(root, "big.bin")); err != nil || string(data) != "first-second" {
+        t.Fatalf("stored %q, %v", data, err)
+    }
+    resp = c.do(http.MethodPut, "/sagasu/big.bin?partNumber=3&uploadId=" + created.UploadId, []byte("late"), nil)
+    if body := readBody(t, resp); resp.StatusCode != http.StatusNotFound || !strings.Contains(body, "NoSuchUpload") {
+        t.Fatalf("part after completion: status %d: %s", resp.StatusCode, body)
+    }
+}
+
+func TestS3MultipartQuota(t *testing.T) {
+    c, _ := newS3Client(t, map[string]string{ ".rules.yml": "quota: 100" })
+    resp := c.do(http.MethodPost, "/sagasu/big.bin?uploads", nil, nil)
+    created := struct { UploadId string }{}
+    xml.NewDecoder(resp.Body).Decode(&created)
+    if resp := c.do(http.MethodPut, "/sagasu/big.bin?partNumber=1&uploadId=" + created.UploadId, bytes.Repeat([]byte("x"), 60), nil); resp.StatusCode != http.StatusOK {
+        t.Fatalf("first part: status %d", resp.StatusCode)
+    }
+    resp = c.do(http.MethodPut, "/sagasu/big.bin?partNumber=2&uploadId=" + created.UploadId, bytes.Repeat([]byte("x"), 60), nil)
+    if body := readBody(t, resp); resp.StatusCode != http.StatusInsufficientStorage {
+        t.Fatalf("second part: status %d: %s", resp.StatusCode, body)
+    }
+}
+
+func TestS3ExpiresUploads(t *testing.T) {
+    c, _ := newS3Client(t, nil)
+    handler := c.server.Config.Handler.(*S3Server)
+    resp := c.do(http.MethodPost, "/sagasu/big.bin?uploads", nil, nil)
+    created := struct { UploadId string }{}
+    xml.NewDecoder(resp.Body).Decode(&created)
+    upload, err := handler.upload(created.UploadId)
+    if err != nil {
+        t.Fatal(err)
+    }
+    upload.touched = time.Now().Add(-s3UploadMaxAge - time.Minute)
+    handler.expire()
+    if _, err := os.Stat(upload.dir); err == nil {
+        t.Fatal("parts of an expired upload were kept")
+    }
+    resp = c.do(http.MethodPut, "/sagasu/big.bin?partNumber=1&uploadId=" + created.UploadId, []byte("late"), nil)
+    if resp.StatusCode != http.StatusNotFound {
+        t.Fatalf("part after expiry: status %d", resp.StatusCode)
+    }
+}
+
+
+func TestS3Locks(t *testing.T) {
+    c, root := newS3Client(t, map[string]string{ "a.txt": "a" })
+    handler := c.server.Config.Handler.(*S3Server)
+    token, err := handler.locks.Lock("/a.txt", "someone", -1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp := c.do(http.MethodPut, "/sagasu/a.txt", []byte("changed"), nil); resp.StatusCode != http.StatusConflict {
+        t.Errorf("put: status %d: %s", resp.StatusCode, readBody(t, resp))
+    }
+    if resp := c.do(http.MethodDelete, "/sagasu/a.txt", nil, nil); resp.StatusCode != http.StatusConflict {
+        t.Errorf("delete: status %d: %s", resp.StatusCode, readBody(t, resp))
+    }
+    if data, err := os.ReadFile(filepath.Join(root, "a.txt")); err != nil || string(data) != "a" {
+        t.Fatalf("stored %q, %v", data, err)
+    }
+    handler.locks.Unlock(time.Now(), token)
+    if resp := c.do(http.MethodDelete, "/sagasu/a.txt", nil, nil); resp.StatusCode != http.StatusNoContent {
+        t.Errorf("delete once unlocked: status %d", resp.StatusCode)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Schedule is a cron-like expression of minute, hour, day of month, month
+// and day of week, matching the minutes during which a rule applies. As in
+// cron, a day matches either field if both of them are restricted.
+type Schedule struct {
+    minutes    uint64
+    hours    uint64
+    days    uint64
+    months    uint64
+    weekdays    uint64
+    anyDay    bool // Day of month is unrestricted.
+    anyWeekday    bool // Day of week is unrestricted.
+}
+
+// scheduleHorizon bounds the search for the next change of a schedule.
+const scheduleHorizon = 366 * 24 * time.Hour
+
+func ParseSchedule(expr string) (*Schedule, error) {
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("schedule %q: expected 5 fields", expr)
+    }
+    s := &Schedule{}
+    var err error
+    bounds := [][2]int{ {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7} }
+    targets := []*uint64{ &s.minutes, &s.hours, &s.days, &s.months, &s.weekdays }
+    for i, field := range fields {
+        if *targets[i], err = parseField(field, bounds[i][0], bounds[i][1]); err != nil {
+            return nil, fmt.Errorf("schedule %q: %w", expr, err)
+        }
+    }
+    // Both 0 and 7 are Sunday.
+    if s.weekdays & (1 << 7) != 0 {
+        s.weekdays |= 1
+    }
+    s.anyDay, s.anyWeekday = fields[2] == "*", fields[4] == "*"
+    return s, nil
+}
+
+// parseField reads a comma-separated list of *, n, a-b, each optionally
+// followed by /step, into a bit set.
+func parseField(field string, min int, max int) (uint64, error) {
+    bits := uint64(0)
+    for _, part := range strings.Split(field, ",") {
+        span, stepstr, stepped := strings.Cut(part, "/")
+        step := 1
+        if stepped {
+            var err error
+            if step, err = strconv.Atoi(stepstr); err != nil || step <= 0 {
+                return 0, fmt.Errorf("invalid step %q", part)
+            }
+        }
+        lo, hi := min, max
+        if span != "*" {
+            first, last, ranged := strings.Cut(span, "-")
+            var err error
+            if lo, err = strconv.Atoi(first); err != nil {
+                return 0, fmt.Errorf("invalid value %q", part)
+            }
+            hi = lo
+            if ranged {
+                if hi, err = strconv.Atoi(last); err != nil {
+                    return 0, fmt.Errorf("invalid value %q", part)
+                }
+            } else if stepped {
+                hi = max
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("value %q out of range", part)
+        }
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << v
+        }
+    }
+    return bits, nil
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+    if s.months & (1 << int(t.Month())) == 0 {
+        return false
+    }
+    day := s.days & (1 << t.Day()) != 0
+    weekday := s.weekdays & (1 << int(t.Weekday())) != 0
+    if !s.anyDay && !s.anyWeekday {
+        return day || weekday
+    }
+    return day && weekday
+}
+
+// Match reports whether the minute of t is part of the schedule.
+func (s *Schedule) Match(t time.Time) bool {
+    return s.matchDay(t) && s.hours & (1 << t.Hour()) != 0 && s.minutes & (1 << t.Minute()) != 0
+}
+
+// Next returns the start of the first minute after now at which Match
+// changes, or the zero time if it does not change within a year.
+func (s *Schedule) Next(now time.Time) time.Time {
+    state := s.Match(now)
+    allMinutes := s.minutes == 1 << 60 - 1
+    t := now.Truncate(time.Minute).Add(time.Minute)
+    for end := now.Add(scheduleHorizon); t.Before(end); {
+        hour := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+        switch {
+        case !s.matchDay(t):
+            if state {
+                return t
+            }
+            t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, t.Location())
+        case s.hours & (1 << t.Hour()) == 0:
+            if state {
+                return t
+            }
+            t = hour.Add(time.Hour)
+        case s.minutes & (1 << t.Minute()) != 0 != state:
+            return t
+        case state && allMinutes:
+            t = hour.Add(time.Hour)
+        default:
+            t = t.Add(time.Minute)
+        }
+    }
+    return time.Time{}
+}
\ No newline at end of file
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func at(value string) time.Time {
+    t, err := time.Parse("2006-01-02 15:04", value)
+    if err != nil {
+        panic(err)
+    }
+    return t
+}
+
+func TestParseSchedule(t *testing.T) {
+    for _, expr := range []string{ "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *" } {
+        if _, err := ParseSchedule(expr); err == nil {
+            t.Errorf("%q was accepted", expr)
+        }
+    }
+    s, err := ParseSchedule("0,30 9-17/4 * * 1-5")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 2026-10-19 is a Monday.
+    for value, want := range map[string]bool{
+        "2026-10-19 09:00": true,
+        "2026-10-19 13:30": true,
+        "2026-10-19 17:00": true,
+        "2026-10-19 09:15": false,
+        "2026-10-19 10:00": false,
+        "2026-10-24 09:00": false,
+    } {
+        if s.Match(at(value)) != want {
+            t.Errorf("%s: expected %v", value, want)
+        }
+    }
+}
+
+func TestScheduleDays(t *testing.T) {
+    // Either the first of the month or a Sunday, given as 7.
+    s, _ := ParseSchedule("* * 1 * 7")
+    for value, want := range map[string]bool{
+        "2026-10-01 12:00": true,
+        "2026-10-25 12:00": true,
+        "2026-10-19 12:00": false,
+    } {
+        if s.Match(at(value)) != want {
+            t.Errorf("%s: expected %v", value, want)
+        }
+    }
+    // Both if only one of them is restricted.
+    s, _ = ParseSchedule("* * * 2 7")
+    if s.Match(at("2026-10-25 12:00")) || !s.Match(at("2026-02-01 12:00")) {
+        t.Error("day of week in February")
+    }
+}
+
+func TestScheduleNext(t *testing.T) {
+    s, _ := ParseSchedule("0-29 9 * * 1-5")
+    for now, want := range map[string]string{
+        "2026-10-19 08:00": "2026-10-19 09:00",
+        "2026-10-19 09:10": "2026-10-19 09:30",
+        "2026-10-19 09:45": "2026-10-20 09:00",
+        "2026-10-23 09:45": "2026-10-26 09:00",
+    } {
+        if next := s.Next(at(now)); !next.Equal(at(want)) {
+            t.Errorf("after %s: %v, expected %s", now, next, want)
+        }
+    }
+    s, _ = ParseSchedule("* 8-17 * * *")
+    if next := s.Next(at("2026-10-19 12:34")); !next.Equal(at("2026-10-19 18:00")) {
+        t.Errorf("hours: %v", next)
+    }
+    s, _ = ParseSchedule("* * 30 2 *")
+    if next := s.Next(at("2026-10-19 12:00")); !next.IsZero() {
+        t.Errorf("never: %v", next)
+    }
+}
\ No newline at end of file
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,19 +23,59 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/mdp/qrterminal/v3"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/net/webdav"
 )
 
 type Server func(host string, port int)
 
-func NewServer(root string) Server {
+// NewServer serves the directory or zip archive at root, or a namespace of
+// the given mounts if there are any.
+func NewServer(root string, mounts []Mount) Server {
+    server, _, _ := newServer(root, mounts)
+    return server
+}
+
+// newServer is NewServer, also returning the engines serving the HTTP API
+// and the admin routes, which are the same unless Admin.Port is set.
+func newServer(root string, mounts []Mount) (Server, *gin.Engine, *gin.Engine) {
     if (!cfg().Http.Debug) {
         gin.SetMode(gin.ReleaseMode)
     }
 
     app := gin.New()
     app.Use(gin.Recovery())
+    // X-Forwarded-For is only believed when sent by a trusted proxy.
+    if err := app.SetTrustedProxies(cfg().Http.TrustedProxies); err != nil {
+        panic(fmt.Errorf("invalid trusted proxies: %v", err))
+    }
 
-    tree := CreateTree(root)
+    roots := []string{ root }
+    if len(mounts) > 0 {
+        roots = []string{}
+        for _, m := range mounts {
+            roots = append(roots, m.Path)
+        }
+    }
+    if err := OpenPolicy(roots...); err != nil {
+        panic(fmt.Errorf("cannot open policy file: %v", err))
+    }
+
+    // Archives are served read-only, directories from the local disk.
+    var tree *Tree
+    if len(mounts) > 0 {
+        var err error
+        if tree, err = CreateNamespace(mounts); err != nil {
+            panic(fmt.Errorf("cannot mount directories: %v", err))
+        }
+    } else if strings.EqualFold(filepath.Ext(root), ".zip") {
+        storage, err := OpenArchive(root)
+        if err != nil {
+            panic(fmt.Errorf("cannot open archive: %v", err))
+        }
+        tree = CreateTreeOn(storage, ".")
+    } else {
+        tree = CreateTree(root)
+    }
     upgrader := websocket.Upgrader{
         ReadBufferSize: 1024,
         WriteBufferSize: 1024,
@@ -38,12 +85,40 @@ func NewServer(root string) Server {
     if tree == nil {
         panic(fmt.Errorf("cannot open directory: %s", root))
     }
+    // Features handing locations to other libraries need the local disk.
+    local := Local(tree.Storage())
+
+    watcher, err := NewWatcher()
+    if err != nil {
+        panic(fmt.Errorf("cannot create file watcher: %v", err))
+    }
+
+    versions := OpenVersions(tree)
+
+    trash := OpenTrash(tree, versions)
+
+    audit, err := OpenAudit(tree)
+    if err != nil {
+        panic(fmt.Errorf("cannot open audit log: %v", err))
+    }
+
+    var index *Index
+    if cfg().Index.Enabled && local {
+        index, err = OpenIndex(tree, watcher)
+        if err != nil {
+            panic(fmt.Errorf("cannot open content index: %v", err))
+        }
+    }
 
     app.Use(cors.New(cors.Config{
         AllowAllOrigins: true,
         AllowMethods: []string { "GET", "OPTIONS" },
         AllowHeaders: []string { "Origin", "Content-Length", "Content-Type" },
     }))
+    app.Use(MetricsMiddleware())
+    app.Use(AuditMiddleware(audit))
+    limits := NewLimiter()
+    app.Use(LimitsMiddleware(limits))
     
     fs := assetFS()
     for _, name := range AssetNames() {
@@ -51,80 +126,400 @@ func NewServer(root string) Server {
         app.StaticFileFS("/" + name, "dist/" + name, fs)
     }
 
-    getAbsPath := func (c *gin.Context, parts []string, minFlag string, checkExists bool) (bool, string) {
-        t := tree
-        if len(parts) > 0 {
-            for _, segment := range parts[:len(parts)-1] {
-                t = t.Next(segment)
-                if t == nil {
-                    c.AbortWithStatusJSON(http.StatusNotFound, gin.H {
-                        "ok": false,
-                        "error": segment,
-                    })
-                    return false, ""
-                }
-            }
+    abortLocate := func (c *gin.Context, lerr *LocateError) {
+        abortError(c, apiErrorOf(lerr))
+    }
+
+    // bindJSON reads the JSON body of a request into body, failing the
+    // request if it is malformed.
+    bindJSON := func (c *gin.Context, body any) bool {
+        if err := c.ShouldBindJSON(body); err != nil {
+            abortError(c, NewAPIError("invalid_request"))
+            return false
         }
-        flag, _ := t.FlagOf(parts[len(parts)-1])
-        if checkExists && flag <= Flags.Find("invisible") && !cfg().Tree.ShowHidden {
-            c.AbortWithStatusJSON(http.StatusNotFound, gin.H {
-                "ok": false,
-                "error": parts[len(parts)-1],
-            })
-            return false, ""
-        } else if flag < Flags.Find(minFlag) {
-            c.AbortWithStatusJSON(http.StatusForbidden, gin.H {
-                "ok": false,
-            })
+        return true
+    }
+
+    // treeOf returns the tree as seen by the client of a request, whose
+    // address may decide the rules that apply.
+    treeOf := func (c *gin.Context) *Tree {
+        addr, _ := netip.ParseAddr(c.ClientIP())
+        return tree.For(addr)
+    }
+
+    getAbsPath := func (c *gin.Context, parts []string, need uint16, checkExists bool) (bool, string) {
+        _, loc, err := treeOf(c).Locate(parts, need, checkExists)
+        if err != nil {
+            abortLocate(c, err.(*LocateError))
             return false, ""
         }
-        loc, _ := filepath.Abs(filepath.Join(t.AbsPath(), parts[len(parts)-1]))
-        if checkExists {
-            _, err := os.Stat(loc)
+        return true, loc
+    }
+
+    // checkConditions applies If-Match and If-None-Match to the file at loc,
+    // preferring the given values over the request headers.
+    checkConditions := func (c *gin.Context, loc string, ifMatch string, ifNoneMatch string) bool {
+        if ifMatch == "" {
+            ifMatch = c.GetHeader("If-Match")
+        }
+        if ifNoneMatch == "" {
+            ifNoneMatch = c.GetHeader("If-None-Match")
+        }
+        if checkPreconditions(tree.Storage(), loc, ifMatch, ifNoneMatch) != nil {
+            abortError(c, NewAPIError("precondition_failed"))
+            return false
+        }
+        return true
+    }
+
+    // abortSpace rejects a write that would take too much space.
+    abortSpace := func (c *gin.Context, serr *SpaceError) {
+        abortError(c, apiErrorOf(serr), gin.H {
+            "limit": serr.Limit,
+        })
+    }
+
+    // abortType rejects a write for the type of the file.
+    abortType := func (c *gin.Context, terr *TypeError) {
+        abortError(c, apiErrorOf(terr), gin.H {
+            "type": terr.Type,
+        })
+    }
+
+    locks := NewLockManager()
+
+    // acquireLocks fails with 423 if any of the files is locked by someone
+    // else. The token is taken from the Lock-Token header if not given.
+    acquireLocks := func (c *gin.Context, token string, names ...[]string) (func(), bool) {
+        if token == "" {
+            token = strings.Trim(c.GetHeader("Lock-Token"), "<>")
+        }
+        lockNames := []string{}
+        for _, parts := range names {
+            lockNames = append(lockNames, lockName(parts))
+        }
+        release, err := locks.Acquire(token, lockNames...)
+        if err != nil {
+            abortError(c, apiErrorOf(err))
+            return nil, false
+        }
+        return release, true
+    }
+
+    davHandler := gin.WrapH(NewDavHandler(tree, index, trash, locks))
+    dav := func (c *gin.Context) {
+        addr, _ := netip.ParseAddr(c.ClientIP())
+        c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), davClientKey{}, addr))
+        tree := tree.For(addr)
+        var terr *TypeError
+        switch c.Request.Method {
+        case "COPY", "MOVE":
+            dest, err := url.Parse(c.GetHeader("Destination"))
             if err != nil {
-                c.AbortWithStatusJSON(http.StatusNotFound, gin.H {
-                    "ok": false,
-                    "error": parts[len(parts)-1],
-                })
-                return false, ""
+                break
+            }
+            from, to := splitPath(c.Param("path")), splitPath(strings.TrimPrefix(dest.Path, "/dav"))
+            if _, from_loc, err := tree.Locate(from, 0, true); err == nil {
+                if errors.As(tree.CheckTypeOf(to, from_loc), &terr) {
+                    abortType(c, terr)
+                    return
+                }
+                // Copies take new space, moves only count against quotas
+                // the source is not under already.
+                if c.Request.Method == "COPY" {
+                    from = nil
+                }
+                var serr *SpaceError
+                if errors.As(tree.CheckSpace(to, diskUsage(tree.Storage(), from_loc), from), &serr) {
+                    abortSpace(c, serr)
+                    return
+                }
+            }
+        case "PUT":
+            parts := splitPath(c.Param("path"))
+            if _, full := tree.SpaceLeft(parts); full != nil && c.Request.ContentLength < 0 {
+                // The size of a chunked body is only known once it has been
+                // received, so it is buffered to be checked like any other.
+                if limit := tree.MaxSizeAt(parts); limit > 0 {
+                    c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+                }
+                tmp, _, err := receive(c.Request, "")
+                var tooLarge *http.MaxBytesError
+                if errors.As(err, &tooLarge) {
+                    abortSpace(c, &SpaceError{ Reason: "max_size", Limit: tooLarge.Limit })
+                    return
+                } else if err != nil {
+                    abortError(c, apiErrorOf(err))
+                    return
+                }
+                defer os.Remove(tmp)
+                fp, err := os.Open(tmp)
+                if err != nil {
+                    abortError(c, apiErrorOf(err))
+                    return
+                }
+                defer fp.Close()
+                info, err := fp.Stat()
+                if err != nil {
+                    abortError(c, apiErrorOf(err))
+                    return
+                }
+                c.Request.Body, c.Request.ContentLength = fp, info.Size()
             }
+            if c.Request.ContentLength >= 0 {
+                var serr *SpaceError
+                if errors.As(tree.CheckSpace(parts, c.Request.ContentLength, nil), &serr) {
+                    abortSpace(c, serr)
+                    return
+                }
+            } else if limit := tree.MaxSizeAt(parts); limit > 0 {
+                c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+            }
+            // The content is sniffed like the first chunk of an upload.
+            head := bufio.NewReaderSize(c.Request.Body, 512)
+            sniffed := ""
+            if data, _ := head.Peek(512); len(data) > 0 {
+                sniffed = mediaType(http.DetectContentType(data))
+            }
+            if errors.As(tree.CheckType(parts, sniffed), &terr) {
+                abortType(c, terr)
+                return
+            }
+            c.Request.Body = struct { io.Reader; io.Closer }{ head, c.Request.Body }
         }
-        return true, loc
+        davHandler(c)
+    }
+    for _, method := range []string {
+        "OPTIONS", "GET", "HEAD", "PUT", "DELETE",
+        "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+    } {
+        app.Handle(method, "/dav/*path", dav)
     }
 
     app.GET("/", func (c *gin.Context) {
         c.FileFromFS("dist/", fs)
     })
 
+    app.GET("/openapi.json", func (c *gin.Context) {
+        c.JSON(http.StatusOK, OpenAPI())
+    })
+
+    // Metrics and health checks go to a separate engine if they have a port
+    // of their own, so that they need not be exposed with the rest.
+    admin := app
+    if cfg().Admin.Port > 0 {
+        admin = gin.New()
+        admin.Use(gin.Recovery())
+    }
+
+    admin.GET("/metrics", func (c *gin.Context) {
+        c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        metrics.Export(c.Writer, tree)
+    })
+
+    admin.GET("/healthz", func (c *gin.Context) {
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+        })
+    })
+
+    // adminOnly lets through holders of the admin token only.
+    adminOnly := func (c *gin.Context) {
+        token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+        if cfg().Admin.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg().Admin.Token)) != 1 {
+            abortError(c, NewAPIError("unauthorized"))
+        }
+    }
+
+    // Rules files are reserved in the tree, so they are managed here instead.
+    rules := admin.Group("/rules", adminOnly)
+
+    rules.GET("/*path", func (c *gin.Context) {
+        loc, err := tree.RulesFileOf(splitPath(c.Param("path")))
+        if err != nil {
+            abortError(c, apiErrorOf(err))
+            return
+        }
+        data, err := readFile(tree.Storage(), loc)
+        if err != nil {
+            abortError(c, apiErrorOf(err))
+            return
+        }
+        c.Data(http.StatusOK, "application/yaml", data)
+    })
+
+    rules.PUT("/*path", func (c *gin.Context) {
+        data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxRulesSize))
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            abortSpace(c, &SpaceError{ Reason: "max_size", Limit: tooLarge.Limit })
+            return
+        } else if err != nil {
+            abortError(c, NewAPIError("invalid_request"))
+            return
+        }
+        if err := tree.SetRules(splitPath(c.Param("path")), data); err != nil {
+            abortError(c, apiErrorOf(err))
+            return
+        }
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+        })
+    })
+
+    rules.DELETE("/*path", func (c *gin.Context) {
+        if err := tree.SetRules(splitPath(c.Param("path")), nil); err != nil {
+            abortError(c, apiErrorOf(err))
+            return
+        }
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+        })
+    })
+
+    // Locks are only broken here, whoever holds them.
+    admin.DELETE("/locks/*path", adminOnly, func (c *gin.Context) {
+        count := locks.Break(lockName(splitPath(c.Param("path"))))
+        if count == 0 {
+            abortError(c, NewAPIError("no_such_lock"))
+            return
+        }
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+            "data": count,
+        })
+    })
+
+    admin.GET("/readyz", func (c *gin.Context) {
+        // Ready once the shared root and every mount can be reached.
+        _, err := tree.Storage().Stat(tree.AbsPath())
+        if tree.Virtual() {
+            for _, anchor := range tree.Anchors() {
+                if err == nil {
+                    _, err = os.Stat(anchor)
+                }
+            }
+        }
+        if err != nil {
+            abortError(c, NewAPIError("not_ready", err.Error()))
+            return
+        }
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+        })
+    })
+
     app.GET("/tree/*path", func (c *gin.Context) {
         path := c.Param("path")
         path, _ = strings.CutPrefix(path, "/")
-        t := tree
+        t := treeOf(c)
         if len(path) > 0 {
-            for _, segment := range strings.Split(path, "/") {
-                t = t.Next(segment)
-                if t == nil {
-                    c.AbortWithStatusJSON(http.StatusNotFound, gin.H {
-                        "ok": false,
-                        "error": segment,
-                    })
-                    return
-                }
+            var err error
+            if t, err = t.Enter(strings.Split(path, "/")); err != nil {
+                abortError(c, apiErrorOf(err))
+                return
             }
         }
-        files, dirs, err := t.Scan()
+        opts := ListOptions{
+            Sort: c.Query("sort"),
+            Order: c.Query("order"),
+            Filter: c.Query("filter"),
+            Kind: c.Query("kind"),
+            Cursor: c.Query("cursor"),
+        }
+        var err error
+        if opts.Offset, err = strconv.Atoi(c.DefaultQuery("offset", "0")); err != nil {
+            abortError(c, NewAPIError("invalid_listing", "offset " + c.Query("offset")))
+            return
+        }
+        if opts.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "0")); err != nil {
+            abortError(c, NewAPIError("invalid_listing", "limit " + c.Query("limit")))
+            return
+        }
+        listing, err := t.List(opts)
         if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+            abortError(c, apiErrorOf(err))
             return
         }
+        for i := range listing.Files {
+            listing.Files[i].Lock = locks.LockOf(strings.TrimSuffix("/" + path, "/") + "/" + listing.Files[i].Name)
+        }
         c.JSON(http.StatusOK, gin.H {
             "ok": true,
-            "data": gin.H {
-                "files": files,
-                "dirs": dirs,
-            },
+            "data": listing,
+        })
+    })
+
+    app.GET("/watch/*path", func (c *gin.Context) {
+        path := c.Param("path")
+        path, _ = strings.CutPrefix(path, "/")
+        t := treeOf(c)
+        if !local {
+            abortError(c, NewAPIError("disabled"))
+            return
+        }
+        if len(path) > 0 {
+            var err error
+            if t, err = t.Enter(strings.Split(path, "/")); err != nil {
+                abortError(c, apiErrorOf(err))
+                return
+            }
+        }
+        // The mounts of a namespace never change, so its root has nothing to watch.
+        if t.Virtual() {
+            abortError(c, NewAPIError("disabled"))
+            return
+        }
+        events, err := watcher.Subscribe(t.AbsPath())
+        if err != nil {
+            abortError(c, NewAPIError("internal"))
+            return
+        }
+        defer watcher.Unsubscribe(t.AbsPath(), events)
+
+        if websocket.IsWebSocketUpgrade(c.Request) {
+            conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+            closed := make(chan struct{})
+            go func() {
+                defer close(closed)
+                for {
+                    if _, _, err := conn.ReadMessage(); err != nil {
+                        return
+                    }
+                }
+            }()
+            for {
+                select {
+                case <-closed:
+                    return
+                case ev := <-events:
+                    if event, ok := t.WatchEventOf(ev); ok {
+                        if conn.WriteJSON(event) != nil {
+                            return
+                        }
+                    }
+                }
+            }
+        }
+
+        ping := time.NewTicker(30 * time.Second)
+        defer ping.Stop()
+        c.Stream(func (w io.Writer) bool {
+            select {
+            case <-c.Request.Context().Done():
+                return false
+            case <-ping.C:
+                io.WriteString(w, ": ping\n\n")
+            case ev := <-events:
+                if event, ok := t.WatchEventOf(ev); ok {
+                    c.SSEvent(event.Type, event)
+                }
+            }
+            return true
         })
     })
 
@@ -132,15 +527,13 @@ func NewServer(root string) Server {
         path := c.Param("path")
         path, _ = strings.CutPrefix(path, "/")
         parts := strings.Split(path, "/")
-        ok, loc := getAbsPath(c, parts, "visible", true)
+        ok, loc := getAbsPath(c, parts, PermList, true)
         if !ok {
             return
         }
         assoc, err := GetAssoc(loc)
         if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+            abortError(c, NewAPIError("internal"))
             return
         }
         c.Header("Cache-Control", "no-cache")
@@ -150,9 +543,7 @@ func NewServer(root string) Server {
     app.GET("/foldericon", func (c *gin.Context) {
         path, err := GetFolderIcon()
         if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+            abortError(c, NewAPIError("internal"))
             return
         } 
         c.File(path)
@@ -163,67 +554,176 @@ func NewServer(root string) Server {
         path := c.Param("path")
         path, _ = strings.CutPrefix(path, "/")
         parts := strings.Split(path, "/")
-        ok, loc := getAbsPath(c, parts, "visible", true)
+        ok, loc := getAbsPath(c, parts, PermRead, true)
         if !ok {
             return
         }
+        fp, err := tree.Storage().Open(loc)
+        if err != nil {
+            abortError(c, &APIError{ Code: "not_found", Path: parts })
+            return
+        }
+        defer fp.Close()
+        info, err := fp.Stat()
+        if err != nil || info.IsDir() {
+            abortError(c, &APIError{ Code: "not_found", Path: parts })
+            return
+        }
+        // Conditional requests are then handled by http.ServeContent.
+        c.Header("ETag", fileETag(info))
         if download == "true" {
             c.Header("Content-Disposition", "attachment; filename=\"" + parts[len(parts)-1] + "\"")
         }
-        c.File(loc)
+        http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), fp)
     })
 
     app.GET("/upload/*path", func (c *gin.Context) {
+        tree := treeOf(c)
         path := c.Param("path")
         path, _ = strings.CutPrefix(path, "/")
         parts := strings.Split(path, "/")
-        ok, loc := getAbsPath(c, parts, "readwrite", false)
+        ok, loc := getAbsPath(c, parts, PermWrite, false)
         if !ok {
             return
         }
+        ifMatch, ifNoneMatch := c.GetHeader("If-Match"), c.GetHeader("If-None-Match")
+        if !checkConditions(c, loc, ifMatch, ifNoneMatch) {
+            return
+        }
         conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
         if err != nil {
             c.AbortWithStatus(http.StatusBadRequest)
             return
         }
+        // The status of the request says nothing about how the upload went.
+        received := int64(0)
+        c.Set(auditOutcomeKey, "error")
+        metrics.uploads.Add(1)
+        defer func() {
+            metrics.uploads.Add(-1)
+            metrics.Transfer("upload", "http", received)
+            c.Set(auditBytesKey, received)
+        }()
 
-        body := struct {
-            Count    int        `json:"count"`
-            Key        string    `json:"key"`
-        }{}
+        body := UploadRequest{}
         err = conn.ReadJSON(&body)
         defer conn.Close()
 
-        if err != nil {
+        // closeError ends the upload with a close code, and e as the reason.
+        closeError := func(code int, e *APIError) {
             conn.WriteControl(
                 websocket.CloseMessage, 
-                websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""), 
+                websocket.FormatCloseMessage(code, closeReason(c, e)), 
                 time.Time{},
             )
+        }
+        if err != nil || body.Size == nil || *body.Size < 0 {
+            closeError(websocket.ClosePolicyViolation, NewAPIError("invalid_request"))
+            return
+        }
+        if body.IfMatch != "" {
+            ifMatch = body.IfMatch
+        }
+        if body.IfNoneMatch != "" {
+            ifNoneMatch = body.IfNoneMatch
+        }
+        // Browsers cannot set headers on WebSocket requests, so a failed
+        // precondition is reported with a close code mirroring HTTP 412.
+        closePrecondition := func() {
+            c.Set(auditOutcomeKey, "denied")
+            closeError(4000 + http.StatusPreconditionFailed, NewAPIError("precondition_failed"))
+        }
+        if checkPreconditions(tree.Storage(), loc, ifMatch, ifNoneMatch) != nil {
+            closePrecondition()
+            return
+        }
+        lockToken := body.LockToken
+        if lockToken == "" {
+            lockToken = strings.Trim(c.GetHeader("Lock-Token"), "<>")
+        }
+        release, err := locks.Acquire(lockToken, lockName(parts))
+        if err != nil {
+            c.Set(auditOutcomeKey, "denied")
+            closeError(4000 + http.StatusLocked, NewAPIError("locked"))
             return
         }
+        defer release()
+        // Rejecting early spares the client sending what cannot be kept, and
+        // the chunks are buffered in the temporary directory until the end.
+        closeSpace := func(serr *SpaceError) {
+            c.Set(auditOutcomeKey, "denied")
+            closeError(4000 + serr.Status(), apiErrorOf(serr))
+        }
+        var serr *SpaceError
+        if errors.As(tree.CheckSpace(parts, *body.Size, nil), &serr) || errors.As(CheckTempSpace(*body.Size), &serr) {
+            closeSpace(serr)
+            return
+        }
+        // The extension is checked now and the content on the first chunk.
+        closeType := func(terr *TypeError) {
+            c.Set(auditOutcomeKey, "denied")
+            closeError(4000 + http.StatusUnsupportedMediaType, apiErrorOf(terr))
+        }
+        var terr *TypeError
+        if errors.As(tree.CheckType(parts, ""), &terr) {
+            closeType(terr)
+            return
+        }
+        // A full disk is reported with its status like the checks above.
+        closeWrite := func(err error) {
+            if aerr := apiErrorOf(err); aerr.Code == "disk_full" {
+                closeError(4000 + aerr.Status(), aerr)
+            } else {
+                closeError(websocket.CloseInternalServerErr, aerr)
+            }
+        }
+        // No more than the size checked above may be sent.
+        maxSize := *body.Size
         key, _ := hex.DecodeString(body.Key)
-        tmp, _ := os.CreateTemp("", "")
+        client := c.ClientIP()
+        tmp, err := os.CreateTemp("", "")
+        if err != nil {
+            closeWrite(err)
+            return
+        }
         conn.WriteJSON(true)
 
         for i := 0; i < body.Count; i++ {
             for {
                 _, data, err := conn.ReadMessage()
                 if err != nil {
-                    conn.WriteControl(
-                        websocket.CloseMessage, 
-                        websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""), 
-                        time.Time{},
-                    )
+                    closeError(websocket.ClosePolicyViolation, NewAPIError("invalid_request"))
                     tmp.Close()
                     os.Remove(tmp.Name())
                     return
                 }
+                limits.WaitUpload(client, len(data))
                 sig, data := data[:32], data[32:]
                 hasher, _ := blake2b.New(32, key)
                 hasher.Write(data)
                 if slices.Equal(sig, hasher.Sum(nil)) {
-                    tmp.Write(data)
+                    if received + int64(len(data)) > maxSize {
+                        tmp.Close()
+                        os.Remove(tmp.Name())
+                        closeSpace(&SpaceError{ Reason: "max_size", Limit: maxSize })
+                        return
+                    }
+                    if received == 0 && len(data) > 0 {
+                        sniffed := mediaType(http.DetectContentType(data))
+                        if errors.As(tree.CheckType(parts, sniffed), &terr) {
+                            tmp.Close()
+                            os.Remove(tmp.Name())
+                            closeType(terr)
+                            return
+                        }
+                    }
+                    if _, err := tmp.Write(data); err != nil {
+                        tmp.Close()
+                        os.Remove(tmp.Name())
+                        closeWrite(err)
+                        return
+                    }
+                    received += int64(len(data))
                     conn.WriteJSON(true)
                     break
                 }
@@ -232,22 +732,27 @@ func NewServer(root string) Server {
         }
 
         tmp.Close()
-        err = os.Remove(loc)
+        // The target may have changed while the chunks were arriving.
+        if checkPreconditions(tree.Storage(), loc, ifMatch, ifNoneMatch) != nil {
+            os.Remove(tmp.Name())
+            closePrecondition()
+            return
+        }
+        if errors.As(tree.CheckSpace(parts, received, nil), &serr) {
+            os.Remove(tmp.Name())
+            closeSpace(serr)
+            return
+        }
+        err = trash.Replace(tree, parts, loc)
         if err != nil {
-            conn.WriteControl(
-                websocket.CloseMessage, 
-                websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), 
-                time.Time{},
-            )
+            os.Remove(tmp.Name())
+            closeWrite(err)
             return
         }
-        err = os.Rename(tmp.Name(), loc)
+        err = importFile(tree.Storage(), tmp.Name(), loc)
         if err != nil {
-            conn.WriteControl(
-                websocket.CloseMessage, 
-                websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), 
-                time.Time{},
-            )
+            os.Remove(tmp.Name())
+            closeWrite(err)
             return
         }
 
@@ -256,116 +761,428 @@ func NewServer(root string) Server {
             websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), 
             time.Time{},
         )
+        c.Set(auditOutcomeKey, "ok")
+        index.Refresh(parts)
 
         if cfg().Tree.CachePolicy == "upload" {
             tree.Reload()
         }
     })
 
+    app.GET("/search/content", func (c *gin.Context) {
+        if index == nil {
+            abortError(c, NewAPIError("disabled"))
+            return
+        }
+        limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+        if err != nil || limit <= 0 {
+            abortError(c, NewAPIError("invalid_request"))
+            return
+        }
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+            "data": index.Search(treeOf(c), c.Query("q"), limit),
+        })
+    })
+
+    // runTransfer moves or copies through work. Clients accepting server-sent
+    // events are sent the progress of long copies, and then the outcome as a
+    // result event since the status is sent before the work is done.
+    runTransfer := func (c *gin.Context, work func (progress Progress) error) {
+        if !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+            if err := work(nil); err != nil {
+                abortError(c, apiErrorOf(err))
+                return
+            }
+            c.JSON(http.StatusOK, gin.H {
+                "ok": true,
+            })
+            return
+        }
+        c.Header("Cache-Control", "no-cache")
+        err := work(func (done int64, total int64) {
+            c.SSEvent("progress", gin.H {
+                "done": done,
+                "total": total,
+            })
+            c.Writer.Flush()
+        })
+        if err != nil {
+            c.Set(auditOutcomeKey, auditOutcomeOf(err))
+            c.SSEvent("result", gin.H {
+                "ok": false,
+                "error": apiErrorOf(err).In(languageOf(c)),
+            })
+            return
+        }
+        c.SSEvent("result", gin.H {
+            "ok": true,
+        })
+    }
+
     app.POST("/move", func (c *gin.Context) {
-        body := struct {
-            From    []string    `json:"from"`
-            To      []string    `json:"to"`
-        }{}
-        err := c.BindJSON(&body)
-        if err != nil { return }
+        tree := treeOf(c)
+        body := TransferRequest{}
+        if !bindJSON(c, &body) { return }
+        c.Set(auditPathKey, body.From)
+        c.Set(auditTargetKey, body.To)
         
-        ok, from_loc := getAbsPath(c, body.From, "readwrite", true)
+        ok, from_loc := getAbsPath(c, body.From, PermDelete, true)
         if !ok {
             return
         }
 
-        ok, to_loc := getAbsPath(c, body.To, "readwrite", false)
+        ok, to_loc := getAbsPath(c, body.To, PermWrite, false)
         if !ok {
             return
         }
-
-        err = os.Rename(from_loc, to_loc)
-
-        if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+        if !checkConditions(c, to_loc, body.IfMatch, body.IfNoneMatch) {
             return
         }
+        var terr *TypeError
+        if errors.As(tree.CheckTypeOf(body.To, from_loc), &terr) {
+            abortType(c, terr)
+            return
+        }
+        var serr *SpaceError
+        if errors.As(tree.CheckSpace(body.To, diskUsage(tree.Storage(), from_loc), body.From), &serr) {
+            abortSpace(c, serr)
+            return
+        }
+        release, ok := acquireLocks(c, body.LockToken, body.From, body.To)
+        if !ok {
+            return
+        }
+        defer release()
 
-        c.JSON(http.StatusOK, gin.H {
-            "ok": true,
+        runTransfer(c, func (progress Progress) error {
+            // Moving an entry onto itself, such as to change the case of its
+            // name, replaces nothing.
+            var restore Undo
+            if !sameEntry(tree.Storage(), from_loc, to_loc) {
+                var err error
+                if restore, err = trash.replace(tree, body.To, to_loc); err != nil {
+                    return err
+                }
+            }
+            if err := moveEntry(tree.Storage(), from_loc, to_loc, progress); err != nil {
+                if restore != nil {
+                    restore()
+                }
+                return err
+            }
+            index.Refresh(body.From)
+            index.Refresh(body.To)
+            return nil
         })
     })
 
     app.POST("/copy", func (c *gin.Context) {
-        body := struct {
-            From    []string    `json:"from"`
-            To      []string    `json:"to"`
-        }{}
-        err := c.BindJSON(&body)
-        if err != nil { return }
+        tree := treeOf(c)
+        body := TransferRequest{}
+        if !bindJSON(c, &body) { return }
+        c.Set(auditPathKey, body.From)
+        c.Set(auditTargetKey, body.To)
         
-        ok, from_loc := getAbsPath(c, body.From, "readwrite", true)
+        ok, from_loc := getAbsPath(c, body.From, PermRead, true)
         if !ok {
             return
         }
 
-        ok, to_loc := getAbsPath(c, body.To, "readwrite", false)
+        ok, to_loc := getAbsPath(c, body.To, PermWrite, false)
+        if !ok {
+            return
+        }
+        if !checkConditions(c, to_loc, body.IfMatch, body.IfNoneMatch) {
+            return
+        }
+        var terr *TypeError
+        if errors.As(tree.CheckTypeOf(body.To, from_loc), &terr) {
+            abortType(c, terr)
+            return
+        }
+        if sameEntry(tree.Storage(), from_loc, to_loc) {
+            abortError(c, apiErrorOf(ErrSameEntry))
+            return
+        }
+        var serr *SpaceError
+        if errors.As(tree.CheckSpace(body.To, diskUsage(tree.Storage(), from_loc), nil), &serr) {
+            abortSpace(c, serr)
+            return
+        }
+        release, ok := acquireLocks(c, body.LockToken, body.To)
         if !ok {
             return
         }
+        defer release()
 
-        src, err := os.Open(from_loc)
-        if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+        runTransfer(c, func (progress Progress) error {
+            info, err := tree.Storage().Stat(from_loc)
+            if err != nil {
+                return err
+            } else if info.IsDir() {
+                return &os.PathError{ Op: "copy", Path: from_loc, Err: ErrIsDirectory }
+            }
+            restore, err := trash.replace(tree, body.To, to_loc)
+            if err != nil {
+                return err
+            }
+            t := &transfer{ total: info.Size(), progress: progress }
+            if err := copyFile(tree.Storage(), from_loc, to_loc, t); err != nil {
+                if restore != nil {
+                    restore()
+                }
+                return err
+            }
+            index.Refresh(body.To)
+            return nil
+        })
+    })
+
+    app.POST("/delete/*path", func (c *gin.Context) {
+        path := c.Param("path")
+        path, _ = strings.CutPrefix(path, "/")
+        parts := strings.Split(path, "/")
+        ok, loc := getAbsPath(c, parts, PermDelete, true)
+        if !ok || !checkConditions(c, loc, "", "") {
             return
         }
-        defer src.Close()
-        dst, err := os.Create(to_loc)
-        if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+        release, ok := acquireLocks(c, "", parts)
+        if !ok {
+            return
+        }
+        defer release()
+        if err := trash.Delete(treeOf(c), parts); err != nil {
+            abortError(c, apiErrorOf(err))
             return
         }
-        defer dst.Close()
+        index.Refresh(parts)
 
-        _, err = io.Copy(dst, src)
-        if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+        })
+    })
+
+    app.POST("/batch", func (c *gin.Context) {
+        body := BatchRequest{}
+        if !bindJSON(c, &body) { return }
+        if body.Mode == "" {
+            body.Mode = "stopOnError"
+        }
+        if !slices.Contains(batchModes, body.Mode) || len(body.Ops) > maxBatchOps {
+            abortError(c, NewAPIError("invalid_request"))
+            return
+        }
+        if body.LockToken == "" {
+            body.LockToken = strings.Trim(c.GetHeader("Lock-Token"), "<>")
+        }
+
+        batch := &Batch{
+            tree: treeOf(c),
+            trash: trash,
+            index: index,
+            locks: locks,
+            audit: audit,
+            client: c.ClientIP(),
+            token: body.LockToken,
+            transaction: body.Mode == "transaction",
+        }
+        results, ok := batch.Run(body.Ops, body.Mode)
+        for i := range results {
+            if results[i].Error != nil {
+                results[i].Error = results[i].Error.In(languageOf(c))
+            }
+        }
+        if cfg().Tree.CachePolicy == "upload" {
+            tree.Reload()
+        }
+
+        c.JSON(http.StatusOK, gin.H {
+            "ok": ok,
+            "data": results,
+        })
+    })
+
+    app.POST("/lock/*path", func (c *gin.Context) {
+        path := c.Param("path")
+        path, _ = strings.CutPrefix(path, "/")
+        parts := strings.Split(path, "/")
+        body := LockRequest{}
+        if !bindJSON(c, &body) { return }
+        if body.Timeout == 0 {
+            body.Timeout = 600
+        }
+        timeout := time.Duration(body.Timeout) * time.Second
+        if body.Timeout < 0 {
+            timeout = -1
+        }
+
+        ok, _ := getAbsPath(c, parts, PermWrite, false)
+        if !ok {
+            return
+        }
+        var err error
+        token := body.Token
+        if token != "" {
+            // A token only refreshes the lock on the path it was given for.
+            err = webdav.ErrNoSuchLock
+            if locks.RootOf(token) == lockName(parts) {
+                _, err = locks.Refresh(time.Now(), token, timeout)
+            }
+        } else {
+            token, err = locks.Lock(lockName(parts), body.Owner, timeout, body.Depth != "infinity")
+        }
+        if errors.Is(err, webdav.ErrNoSuchLock) {
+            abortError(c, NewAPIError("no_such_lock"))
+            return
+        } else if err != nil {
+            abortError(c, NewAPIError("locked"))
             return
         }
 
         c.JSON(http.StatusOK, gin.H {
             "ok": true,
+            "data": LockResult{
+                Token: token,
+                Lock: locks.LockOf(lockName(parts)),
+            },
         })
     })
 
-    app.POST("/delete/*path", func (c *gin.Context) {
+    app.POST("/unlock", func (c *gin.Context) {
+        body := UnlockRequest{}
+        if !bindJSON(c, &body) { return }
+
+        err := locks.Unlock(time.Now(), body.Token)
+        if errors.Is(err, webdav.ErrNoSuchLock) {
+            abortError(c, NewAPIError("no_such_lock"))
+            return
+        } else if err != nil {
+            abortError(c, NewAPIError("locked"))
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+        })
+    })
+
+    app.GET("/versions/*path", func (c *gin.Context) {
+        path := c.Param("path")
+        path, _ = strings.CutPrefix(path, "/")
+        parts := strings.Split(path, "/")
+        list, err := versions.List(treeOf(c), parts)
+        if err != nil {
+            abortLocate(c, err.(*LocateError))
+            return
+        }
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+            "data": list,
+        })
+    })
+
+    app.GET("/version/:id/*path", func (c *gin.Context) {
+        download := c.Query("download")
         path := c.Param("path")
         path, _ = strings.CutPrefix(path, "/")
         parts := strings.Split(path, "/")
-        ok, loc := getAbsPath(c, parts, "readwrite", true)
+        loc, err := versions.Open(treeOf(c), parts, c.Param("id"))
+        if err != nil {
+            abortError(c, apiErrorOf(err))
+            return
+        }
+        if download == "true" {
+            c.Header("Content-Disposition", "attachment; filename=\"" + parts[len(parts)-1] + "\"")
+        }
+        c.File(loc)
+    })
+
+    app.POST("/rollback", func (c *gin.Context) {
+        body := RollbackRequest{}
+        if !bindJSON(c, &body) { return }
+        c.Set(auditPathKey, body.Path)
+
+        ok, loc := getAbsPath(c, body.Path, PermWrite, false)
+        if !ok || !checkConditions(c, loc, body.IfMatch, body.IfNoneMatch) {
+            return
+        }
+        release, ok := acquireLocks(c, body.LockToken, body.Path)
         if !ok {
             return
         }
-        err := os.Remove(loc)
+        defer release()
+
+        if err := versions.Rollback(treeOf(c), body.Path, body.ID, trash); err != nil {
+            abortError(c, apiErrorOf(err))
+            return
+        }
+        index.Refresh(body.Path)
+
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+        })
+    })
+
+    app.GET("/trash", func (c *gin.Context) {
+        if !trash.Enabled() {
+            abortError(c, NewAPIError("disabled"))
+            return
+        }
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+            "data": trash.List(treeOf(c)),
+        })
+    })
+
+    app.POST("/trash/restore", func (c *gin.Context) {
+        body := RestoreRequest{}
+        if !bindJSON(c, &body) { return }
+
+        c.Set(auditPathKey, body.To)
+        to, err := trash.Restore(treeOf(c), body.ID, body.To)
         if err != nil {
-            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
-                "ok": false,
-            })
+            abortError(c, apiErrorOf(err))
+            return
+        }
+        c.Set(auditPathKey, to)
+        index.Refresh(to)
+        if cfg().Tree.CachePolicy == "upload" {
+            tree.Reload()
+        }
+
+        c.JSON(http.StatusOK, gin.H {
+            "ok": true,
+            "data": to,
+        })
+    })
+
+    app.POST("/trash/purge", func (c *gin.Context) {
+        body := PurgeRequest{}
+        if !bindJSON(c, &body) { return }
+
+        count, err := trash.Purge(treeOf(c), body.IDs)
+        if err != nil {
+            abortError(c, apiErrorOf(err))
             return
         }
 
         c.JSON(http.StatusOK, gin.H {
             "ok": true,
+            "data": count,
         })
     })
 
     return func(host string, port int) {
         fmt.Println("探す (Sagasu) - Lightweight Remote File System")
-        fmt.Printf("Serving root: %s\n\n", root)
+        if tree.Virtual() {
+            for _, m := range mounts {
+                fmt.Printf("Serving mount: /%s -> %s\n", m.Name, tree.Location(m.Name))
+            }
+            fmt.Println()
+        } else {
+            fmt.Printf("Serving root: %s\n\n", root)
+        }
 
         if host == "0.0.0.0" {
             ip := getIP()
@@ -377,6 +1194,33 @@ func NewServer(root string) Server {
             fmt.Printf("Endpoint @ http://%s:%d", host, port)
         }
 
+        if cfg().Sftp.Enabled && local {
+            fmt.Printf("\nSFTP Endpoint @ sftp://%s:%d", cfg().Sftp.Host, cfg().Sftp.Port)
+            go func() {
+                if err := ServeSftp(tree, index, trash, locks, audit, limits); err != nil {
+                    fmt.Println("\nWarning: SFTP server stopped:", err)
+                }
+            }()
+        }
+
+        if cfg().S3.Enabled && local {
+            fmt.Printf("\nS3 Endpoint @ http://%s:%d/%s", cfg().S3.Host, cfg().S3.Port, cfg().S3.Bucket)
+            go func() {
+                if err := ServeS3(tree, index, trash, locks, audit, limits); err != nil {
+                    fmt.Println("\nWarning: S3 server stopped:", err)
+                }
+            }()
+        }
+
+        if admin != app {
+            fmt.Printf("\nAdmin Endpoint @ http://%s:%d/metrics", cfg().Admin.Host, cfg().Admin.Port)
+            go func() {
+                if err := admin.Run(fmt.Sprintf("%s:%d", cfg().Admin.Host, cfg().Admin.Port)); err != nil {
+                    fmt.Println("\nWarning: admin server stopped:", err)
+                }
+            }()
+        }
+
         app.Run(fmt.Sprintf("%s:%d", host, port))
-    }
+    }, app, admin
 }
\ No newline at end of file
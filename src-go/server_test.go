@@ -0,0 +1,213 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// newAPI serves a tree holding files through the HTTP API, and returns the
+// handler and the root of the tree.
+func newAPI(t *testing.T, files map[string]string, edit func(c *Config)) (http.Handler, string) {
+    root := t.TempDir()
+    writeFiles(t, root, files)
+    useConfig(t, func(c *Config) {
+        c.Tree.DefaultFlag = "readwrite"
+        if edit != nil {
+            edit(c)
+        }
+    })
+    _, app, _ := newServer(root, nil)
+    return app, root
+}
+
+// apiRequest sends a request with body as JSON, unless it is nil, and
+// returns the response and the error code it reports, if any.
+func apiRequest(app http.Handler, method string, target string, body any, headers ...string) (*httptest.ResponseRecorder, string) {
+    data := []byte{}
+    if body != nil {
+        data, _ = json.Marshal(body)
+    }
+    r := httptest.NewRequest(method, target, bytes.NewReader(data))
+    for i := 0; i + 1 < len(headers); i += 2 {
+        r.Header.Set(headers[i], headers[i+1])
+    }
+    w := httptest.NewRecorder()
+    app.ServeHTTP(w, r)
+    result := struct {
+        Error    *APIError    `json:"error"`
+    }{}
+    json.Unmarshal(w.Body.Bytes(), &result)
+    if result.Error == nil {
+        return w, ""
+    }
+    return w, result.Error.Code
+}
+
+// trashed lists the entries in the trash of the tree at root.
+func trashed(t *testing.T, root string) []os.DirEntry {
+    entries, err := os.ReadDir(filepath.Join(root, trashName))
+    if err != nil && !os.IsNotExist(err) {
+        t.Fatal(err)
+    }
+    return entries
+}
+
+func TestMoveOntoItself(t *testing.T) {
+    app, root := newAPI(t, map[string]string{ "a.txt": "a" }, nil)
+    move := TransferRequest{ From: []string{ "a.txt" }, To: []string{ "a.txt" } }
+    if w, code := apiRequest(app, "POST", "/move", move); w.Code != http.StatusOK {
+        t.Fatalf("moving onto itself: %d %s", w.Code, code)
+    }
+    if _, code := apiRequest(app, "POST", "/copy", move); code != "same_entry" {
+        t.Fatalf("copying onto itself: %s", code)
+    }
+    tree := CreateTree(root)
+    b := &Batch{ tree: tree, trash: OpenTrash(tree, OpenVersions(tree)), locks: NewLockManager() }
+    results, _ := b.Run([]BatchOp{
+        { Op: "move", From: move.From, To: move.To },
+        { Op: "copy", From: move.From, To: move.To },
+    }, "continue")
+    if results[0].Status != http.StatusOK || results[1].Error == nil || results[1].Error.Code != "same_entry" {
+        t.Fatalf("batch: %+v", results)
+    }
+    if contents := readFiles(t, root, "a.txt"); contents["a.txt"] != "a" {
+        t.Fatalf("the file is gone: %v", contents)
+    }
+    if entries := trashed(t, root); len(entries) > 0 {
+        t.Fatalf("the file was trashed: %v", entries)
+    }
+}
+
+func TestFailedCopyRestoresTarget(t *testing.T) {
+    app, root := newAPI(t, map[string]string{ "b.txt": "b" }, nil)
+    // Files of /proc claim to be empty, so copies of them fail their check.
+    if err := os.Symlink("/proc/self/status", filepath.Join(root, "status")); err != nil {
+        t.Skip(err)
+    }
+    copy := TransferRequest{ From: []string{ "status" }, To: []string{ "b.txt" } }
+    if _, code := apiRequest(app, "POST", "/copy", copy); code != "mismatch" {
+        t.Fatalf("copying: %s", code)
+    }
+    if contents := readFiles(t, root, "b.txt"); contents["b.txt"] != "b" {
+        t.Fatalf("after the copy: %v", contents)
+    }
+    if entries := trashed(t, root); len(entries) > 0 {
+        t.Fatalf("the target was left in the trash: %v", entries)
+    }
+}
+
+func TestPreconditions(t *testing.T) {
+    app, root := newAPI(t, map[string]string{ "a.txt": "a", "b.txt": "b", "c.txt": "c" }, nil)
+    etag := func(name string) string {
+        info, err := os.Stat(filepath.Join(root, name))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return fileETag(info)
+    }
+    stale := "\"0-0\""
+
+    move := TransferRequest{ From: []string{ "a.txt" }, To: []string{ "b.txt" }, IfMatch: stale }
+    if w, code := apiRequest(app, "POST", "/move", move); w.Code != http.StatusPreconditionFailed || code != "precondition_failed" {
+        t.Errorf("moving with a stale etag: %d %s", w.Code, code)
+    }
+    copy := TransferRequest{ From: []string{ "a.txt" }, To: []string{ "b.txt" } }
+    if w, code := apiRequest(app, "POST", "/copy", copy, "If-Match", stale); w.Code != http.StatusPreconditionFailed {
+        t.Errorf("copying with a stale etag: %d %s", w.Code, code)
+    }
+    copy.IfNoneMatch = "*"
+    if w, code := apiRequest(app, "POST", "/copy", copy); w.Code != http.StatusPreconditionFailed {
+        t.Errorf("copying onto an existing file: %d %s", w.Code, code)
+    }
+    if w, code := apiRequest(app, "POST", "/delete/c.txt", nil, "If-Match", stale); w.Code != http.StatusPreconditionFailed {
+        t.Errorf("deleting with a stale etag: %d %s", w.Code, code)
+    }
+    if contents := readFiles(t, root, "a.txt", "b.txt", "c.txt"); len(contents) != 3 || contents["b.txt"] != "b" {
+        t.Fatalf("files changed: %v", contents)
+    }
+
+    move.IfMatch = etag("b.txt")
+    if w, code := apiRequest(app, "POST", "/move", move); w.Code != http.StatusOK {
+        t.Errorf("moving with the current etag: %d %s", w.Code, code)
+    }
+    if w, code := apiRequest(app, "POST", "/delete/c.txt", nil, "If-Match", etag("c.txt")); w.Code != http.StatusOK {
+        t.Errorf("deleting with the current etag: %d %s", w.Code, code)
+    }
+    if contents := readFiles(t, root, "a.txt", "b.txt", "c.txt"); len(contents) != 1 || contents["b.txt"] != "a" {
+        t.Errorf("after the changes: %v", contents)
+    }
+}
+
+func TestLockRefreshPath(t *testing.T) {
+    app, _ := newAPI(t, map[string]string{ "a.txt": "a", "b.txt": "b" }, nil)
+    w, code := apiRequest(app, "POST", "/lock/a.txt", LockRequest{ Owner: "me" })
+    if w.Code != http.StatusOK {
+        t.Fatalf("locking: %d %s", w.Code, code)
+    }
+    result := struct {
+        Data    LockResult    `json:"data"`
+    }{}
+    json.Unmarshal(w.Body.Bytes(), &result)
+    refresh := LockRequest{ Token: result.Data.Token }
+    if _, code := apiRequest(app, "POST", "/lock/b.txt", refresh); code != "no_such_lock" {
+        t.Errorf("refreshing through another path: %s", code)
+    }
+    if w, code := apiRequest(app, "POST", "/lock/a.txt", refresh); w.Code != http.StatusOK {
+        t.Errorf("refreshing: %d %s", w.Code, code)
+    }
+}
+
+func TestRulesAdmin(t *testing.T) {
+    app, root := newAPI(t, map[string]string{ "docs/a.txt": "a" }, func(c *Config) { c.Admin.Token = "secret" })
+    auth := []string{ "Authorization", "Bearer secret" }
+    put := func(body string) (*httptest.ResponseRecorder, string) {
+        r := httptest.NewRequest("PUT", "/rules/docs", strings.NewReader(body))
+        r.Header.Set(auth[0], auth[1])
+        w := httptest.NewRecorder()
+        app.ServeHTTP(w, r)
+        result := struct {
+            Error    *APIError    `json:"error"`
+        }{}
+        json.Unmarshal(w.Body.Bytes(), &result)
+        if result.Error == nil {
+            return w, ""
+        }
+        return w, result.Error.Code
+    }
+    if w, code := put(strings.Repeat("#", maxRulesSize + 1)); w.Code != http.StatusRequestEntityTooLarge || code != "max_size" {
+        t.Errorf("putting too large rules: %d %s", w.Code, code)
+    }
+    if _, err := os.Stat(filepath.Join(root, "docs", ".rules.yml")); err == nil {
+        t.Error("too large rules were written")
+    }
+
+    // Rules are reloaded while requests read them.
+    done := make(chan bool)
+    go func() {
+        for i := 0; i < 20; i++ {
+            put("readonly: [a.txt]")
+            put("invisible: [a.txt]")
+        }
+        close(done)
+    }()
+    for running := true; running; {
+        select {
+        case <-done:
+            running = false
+        default:
+            apiRequest(app, "GET", "/tree/docs", nil)
+        }
+    }
+    if w, _ := apiRequest(app, "GET", "/file/docs/a.txt", nil); w.Code != http.StatusNotFound {
+        t.Errorf("reading an invisible file: %d", w.Code)
+    }
+    if w, code := apiRequest(app, "GET", "/rules/docs", nil, auth...); w.Code != http.StatusOK || w.Body.String() != "invisible: [a.txt]" {
+        t.Errorf("getting the rules: %d %s %q", w.Code, code, w.Body)
+    }
+}
\ No newline at end of file
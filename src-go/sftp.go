@@ -0,0 +1,566 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net"
+    "net/http"
+    "net/netip"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+)
+
+// sftpHandler maps SFTP requests onto the tree, applying the same rules as
+// the HTTP API. Each connection gets its own copy naming its user.
+type sftpHandler struct {
+    tree    *Tree
+    index    *Index
+    trash    *Trash
+    locks    *LockManager
+    audit    *Audit
+    limits    *Limiter
+    user    string
+    client    string
+}
+
+type sftpFile struct {
+    *os.File
+    handler    *sftpHandler
+    parts    []string
+    written    atomic.Int64
+    maxSize    int64
+    room    int64 // How large the file may grow if full is set.
+    full    error // Fails writes past room, nil if there is no limit.
+    rejected    atomic.Pointer[TypeError] // Set if the content has the wrong type.
+    done    func() // Gives the upload slot and the lock back.
+}
+
+type sftpReader struct {
+    *os.File
+    handler    *sftpHandler
+    parts    []string
+    read    atomic.Int64
+}
+
+type sftpLister []fs.FileInfo
+
+var sftpActions = map[string]string{
+    "Setstat": "setstat",
+    "Rename": "move",
+    "PosixRename": "move",
+    "Remove": "delete",
+    "Rmdir": "delete",
+    "Mkdir": "mkdir",
+}
+
+func ServeSftp(tree *Tree, index *Index, trash *Trash, locks *LockManager, audit *Audit, limits *Limiter) error {
+    config, err := sftpConfig()
+    if err != nil {
+        return err
+    }
+    listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg().Sftp.Host, cfg().Sftp.Port))
+    if err != nil {
+        return err
+    }
+    handler := &sftpHandler{ tree: tree, index: index, trash: trash, locks: locks, audit: audit, limits: limits }
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            return err
+        }
+        release, ok := limits.Connect()
+        if !ok {
+            conn.Close()
+            continue
+        }
+        go func() {
+            defer release()
+            serveSftpConn(conn, config, handler)
+        }()
+    }
+}
+
+func sftpConfig() (*ssh.ServerConfig, error) {
+    authorized := map[string]bool{}
+    if len(cfg().Sftp.AuthorizedKeys) > 0 {
+        data, err := os.ReadFile(os.ExpandEnv(cfg().Sftp.AuthorizedKeys))
+        if err != nil {
+            return nil, fmt.Errorf("cannot read authorized keys: %v", err)
+        }
+        for len(bytes.TrimSpace(data)) > 0 {
+            key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+            if err != nil {
+                return nil, fmt.Errorf("cannot parse authorized keys: %v", err)
+            }
+            authorized[string(key.Marshal())] = true
+            data = rest
+        }
+    }
+    if len(authorized) == 0 && len(cfg().Sftp.Users) == 0 {
+        return nil, fmt.Errorf("no users or authorized keys configured")
+    }
+    config := &ssh.ServerConfig{
+        PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+            expected, ok := cfg().Sftp.Users[conn.User()]
+            if ok && subtle.ConstantTimeCompare([]byte(expected), password) == 1 {
+                return nil, nil
+            }
+            return nil, fmt.Errorf("password rejected for %s", conn.User())
+        },
+        PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+            if authorized[string(key.Marshal())] {
+                return nil, nil
+            }
+            return nil, fmt.Errorf("unknown public key for %s", conn.User())
+        },
+    }
+    signer, err := loadHostKey(os.ExpandEnv(cfg().Sftp.HostKey))
+    if err != nil {
+        return nil, fmt.Errorf("cannot load host key: %v", err)
+    }
+    config.AddHostKey(signer)
+    return config, nil
+}
+
+// loadHostKey reads the host key at path, generating one on first start.
+func loadHostKey(path string) (ssh.Signer, error) {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, fs.ErrNotExist) {
+        _, key, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        block, err := ssh.MarshalPrivateKey(key, "sagasu")
+        if err != nil {
+            return nil, err
+        }
+        data = pem.EncodeToMemory(block)
+        if err := os.WriteFile(path, data, 0o600); err != nil {
+            return nil, err
+        }
+    } else if err != nil {
+        return nil, err
+    }
+    return ssh.ParsePrivateKey(data)
+}
+
+func serveSftpConn(conn net.Conn, config *ssh.ServerConfig, template *sftpHandler) {
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(30 * time.Second))
+    sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+    if err != nil {
+        return
+    }
+    conn.SetDeadline(time.Time{})
+    handler := *template
+    handler.user, handler.client = sconn.User(), remoteHost(conn.RemoteAddr().String())
+    addr, _ := netip.ParseAddr(handler.client)
+    handler.tree = template.tree.For(addr)
+    handlers := sftp.Handlers{
+        FileGet: &handler,
+        FilePut: &handler,
+        FileCmd: &handler,
+        FileList: &handler,
+    }
+    go ssh.DiscardRequests(reqs)
+    for newChannel := range chans {
+        if newChannel.ChannelType() != "session" {
+            newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+            continue
+        }
+        channel, requests, err := newChannel.Accept()
+        if err != nil {
+            continue
+        }
+        go func(in <-chan *ssh.Request) {
+            for req := range in {
+                // The payload of a subsystem request is a length-prefixed name.
+                ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+                req.Reply(ok, nil)
+            }
+        }(requests)
+        go func() {
+            server := sftp.NewRequestServer(channel, handlers)
+            server.Serve()
+            server.Close()
+        }()
+    }
+}
+
+// sftpError converts tree resolution errors to SFTP status codes.
+func sftpError(err error) error {
+    if errors.Is(err, ErrForbidden) || errors.Is(err, fs.ErrPermission) {
+        return sftp.ErrSSHFxPermissionDenied
+    }
+    return fsError(err)
+}
+
+// log records a request in the audit log.
+func (h *sftpHandler) log(action string, parts []string, target []string, bytes int64, err error) {
+    if err == sftp.ErrSSHFxPermissionDenied {
+        err = fs.ErrPermission
+    }
+    h.audit.Log(AuditEntry{
+        Client: h.client,
+        User: h.user,
+        Via: "sftp",
+        Action: action,
+        Path: strings.Join(parts, "/"),
+        Target: strings.Join(target, "/"),
+        Bytes: bytes,
+        Outcome: auditOutcomeOf(err),
+    })
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+    parts := splitPath(r.Filepath)
+    _, loc, err := h.tree.Locate(parts, PermRead, true)
+    if err != nil {
+        h.log("file", parts, nil, 0, err)
+        return nil, sftpError(err)
+    }
+    fp, err := os.Open(loc)
+    if err != nil {
+        h.log("file", parts, nil, 0, err)
+        return nil, err
+    }
+    return &sftpReader{ File: fp, handler: h, parts: parts }, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+    parts := splitPath(r.Filepath)
+    done, ok := h.limits.StartUpload(h.client)
+    if !ok {
+        h.log("upload", parts, nil, 0, ErrTooMany)
+        return nil, sftp.ErrSSHFxFailure
+    }
+    release, err := h.acquire(parts)
+    if err != nil {
+        done()
+        h.log("upload", parts, nil, 0, err)
+        return nil, err
+    }
+    fp, err := h.filewrite(r, parts)
+    if err != nil {
+        release()
+        done()
+        h.log("upload", parts, nil, 0, err)
+        return nil, err
+    }
+    finish := func() {
+        release()
+        done()
+    }
+    file := &sftpFile{ File: fp, handler: h, parts: parts, maxSize: h.tree.MaxSizeAt(parts), done: finish }
+    file.room, file.full = h.tree.SpaceLeft(parts)
+    return file, nil
+}
+
+func (h *sftpHandler) filewrite(r *sftp.Request, parts []string) (*os.File, error) {
+    _, loc, err := h.tree.Locate(parts, PermWrite, false)
+    if err != nil {
+        return nil, sftpError(err)
+    }
+    // The size is unknown yet, but a full quota or disk rejects any write.
+    if err := h.tree.CheckSpace(parts, 0, nil); err != nil {
+        return nil, err
+    }
+    if err := h.tree.CheckType(parts, ""); err != nil {
+        return nil, err
+    }
+    oflag := os.O_WRONLY | os.O_CREATE
+    if pflags := r.Pflags(); pflags.Trunc {
+        if err := h.trash.Replace(h.tree, parts, loc); err != nil {
+            return nil, err
+        }
+        oflag |= os.O_TRUNC
+    } else if pflags.Excl {
+        oflag |= os.O_EXCL
+    }
+    return os.OpenFile(loc, oflag, 0o644)
+}
+
+// acquire locks the named entries for the duration of a command. SFTP has no
+// lock tokens, so entries locked through WebDAV or the HTTP API are refused.
+func (h *sftpHandler) acquire(names ...[]string) (func(), error) {
+    lockNames := []string{}
+    for _, parts := range names {
+        lockNames = append(lockNames, lockName(parts))
+    }
+    return h.locks.Acquire("", lockNames...)
+}
+
+// PosixRename lets renames overwrite their target. Without it, the server
+// handles them as plain renames.
+func (h *sftpHandler) PosixRename(r *sftp.Request) error {
+    return h.Filecmd(r)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+    err := h.filecmd(r)
+    if action := sftpActions[r.Method]; action != "" {
+        target := []string(nil)
+        if action == "move" {
+            target = splitPath(r.Target)
+        }
+        h.log(action, splitPath(r.Filepath), target, 0, err)
+    }
+    return err
+}
+
+func (h *sftpHandler) filecmd(r *sftp.Request) error {
+    parts := splitPath(r.Filepath)
+    if len(parts) == 0 {
+        return sftp.ErrSSHFxPermissionDenied
+    }
+    switch r.Method {
+    case "Setstat":
+        _, loc, err := h.tree.Locate(parts, PermWrite, true)
+        if err != nil {
+            return sftpError(err)
+        }
+        release, err := h.acquire(parts)
+        if err != nil {
+            return err
+        }
+        defer release()
+        flags, attrs := r.AttrFlags(), r.Attributes()
+        if flags.Size {
+            if err := h.truncate(parts, loc, int64(attrs.Size)); err != nil {
+                return err
+            }
+        }
+        if flags.Acmodtime {
+            return os.Chtimes(loc, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+        }
+        return nil
+    case "Rename", "PosixRename":
+        target := splitPath(r.Target)
+        _, from, err := h.tree.Locate(parts, PermDelete, true)
+        if err != nil {
+            return sftpError(err)
+        }
+        _, to, err := h.tree.Locate(target, PermWrite, false)
+        if err != nil {
+            return sftpError(err)
+        }
+        // Renaming an entry onto itself, such as to change the case of its
+        // name, replaces nothing.
+        same := sameEntry(h.tree.Storage(), from, to)
+        if _, err := os.Stat(to); err == nil && r.Method == "Rename" && !same {
+            return fs.ErrExist
+        }
+        if err := h.tree.CheckTypeOf(target, from); err != nil {
+            return err
+        }
+        release, err := h.acquire(parts, target)
+        if err != nil {
+            return err
+        }
+        defer release()
+        var restore Undo
+        if !same {
+            if restore, err = h.trash.replace(h.tree, target, to); err != nil {
+                return err
+            }
+        }
+        if err := moveEntry(h.tree.Storage(), from, to, nil); err != nil {
+            if restore != nil {
+                restore()
+            }
+            return err
+        }
+        h.index.Refresh(parts)
+        h.index.Refresh(target)
+        return nil
+    case "Remove", "Rmdir":
+        _, loc, err := h.tree.Locate(parts, PermDelete, true)
+        if err != nil {
+            return sftpError(err)
+        }
+        info, err := os.Stat(loc)
+        if err != nil {
+            return err
+        }
+        if info.IsDir() != (r.Method == "Rmdir") {
+            return sftp.ErrSSHFxFailure
+        }
+        release, err := h.acquire(parts)
+        if err != nil {
+            return err
+        }
+        defer release()
+        if err := h.trash.Delete(h.tree, parts); err != nil {
+            return sftpError(err)
+        }
+        h.index.Refresh(parts)
+        return nil
+    case "Mkdir":
+        _, loc, err := h.tree.Locate(parts, PermCreate, false)
+        if err != nil {
+            return sftpError(err)
+        }
+        return os.Mkdir(loc, 0o755)
+    }
+    return sftp.ErrSSHFxOpUnsupported
+}
+
+// truncate cuts or extends the file at loc to size. What is cut off is kept
+// like the content of overwritten files, by putting a copy of the file back
+// in its place.
+func (h *sftpHandler) truncate(parts []string, loc string, size int64) error {
+    info, err := os.Stat(loc)
+    if err != nil {
+        return err
+    }
+    if size > info.Size() {
+        if err := h.tree.CheckSpace(parts, size, nil); err != nil {
+            return err
+        }
+    } else if size < info.Size() {
+        tmp, err := os.CreateTemp("", "")
+        if err != nil {
+            return err
+        }
+        tmp.Close()
+        if err := copyFile(OSStorage, loc, tmp.Name(), &transfer{}); err != nil {
+            os.Remove(tmp.Name())
+            return err
+        }
+        if err := h.trash.Replace(h.tree, parts, loc); err != nil {
+            os.Remove(tmp.Name())
+            return err
+        }
+        // The temporary directory may be on another volume than the tree.
+        if err := moveEntry(h.tree.Storage(), tmp.Name(), loc, nil); err != nil {
+            os.Remove(tmp.Name())
+            return err
+        }
+    }
+    return os.Truncate(loc, size)
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+    if r.Method == "List" && !h.limits.AllowMetadata(h.client) {
+        h.log("tree", splitPath(r.Filepath), nil, 0, ErrTooMany)
+        return nil, sftp.ErrSSHFxFailure
+    }
+    lister, err := h.filelist(r)
+    if r.Method == "List" {
+        h.log("tree", splitPath(r.Filepath), nil, 0, err)
+    }
+    return lister, err
+}
+
+func (h *sftpHandler) filelist(r *sftp.Request) (sftp.ListerAt, error) {
+    parts := splitPath(r.Filepath)
+    loc := h.tree.AbsPath()
+    if len(parts) > 0 {
+        var err error
+        if _, loc, err = h.tree.Locate(parts, 0, true); err != nil {
+            return nil, sftpError(err)
+        }
+    }
+    switch r.Method {
+    case "Stat":
+        info, err := h.tree.Storage().Stat(loc)
+        if err != nil {
+            return nil, err
+        }
+        return sftpLister{ info }, nil
+    case "List":
+        t, err := h.tree.Enter(parts)
+        if err != nil {
+            return nil, sftpError(err)
+        }
+        entries, err := h.tree.Storage().ReadDir(loc)
+        if err != nil {
+            return nil, err
+        }
+        infos := sftpLister{}
+        for _, entry := range entries {
+            if t.Hidden(entry.Name()) { continue }
+            if info, err := entry.Info(); err == nil {
+                infos = append(infos, info)
+            }
+        }
+        return infos, nil
+    }
+    return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (l sftpLister) ListAt(infos []fs.FileInfo, offset int64) (int, error) {
+    if offset >= int64(len(l)) {
+        return 0, io.EOF
+    }
+    n := copy(infos, l[offset:])
+    if n < len(infos) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+    if f.maxSize > 0 && off + int64(len(p)) > f.maxSize {
+        return 0, &SpaceError{ Reason: "max_size", Limit: f.maxSize }
+    }
+    if f.full != nil && off + int64(len(p)) > f.room {
+        return 0, f.full
+    }
+    if off == 0 && len(p) > 0 {
+        var terr *TypeError
+        if errors.As(f.handler.tree.CheckType(f.parts, mediaType(http.DetectContentType(p))), &terr) {
+            f.rejected.Store(terr)
+            return 0, terr
+        }
+    }
+    f.handler.limits.WaitUpload(f.handler.client, len(p))
+    n, err := f.File.WriteAt(p, off)
+    f.written.Add(int64(n))
+    return n, err
+}
+
+func (f *sftpFile) Close() error {
+    err := f.File.Close()
+    f.done()
+    if terr := f.rejected.Load(); terr != nil {
+        // Nothing was written, so only a file created by the open is left.
+        if info, err := os.Stat(f.File.Name()); err == nil && info.Size() == 0 {
+            os.Remove(f.File.Name())
+        }
+        err = terr
+    }
+    f.handler.log("upload", f.parts, nil, f.written.Load(), err)
+    metrics.Transfer("upload", "sftp", f.written.Load())
+    f.handler.index.Refresh(f.parts)
+    if cfg().Tree.CachePolicy == "upload" {
+        f.handler.tree.Reload()
+    }
+    return err
+}
+
+func (f *sftpReader) ReadAt(p []byte, off int64) (int, error) {
+    f.handler.limits.WaitDownload(f.handler.client, len(p))
+    n, err := f.File.ReadAt(p, off)
+    f.read.Add(int64(n))
+    return n, err
+}
+
+func (f *sftpReader) Close() error {
+    err := f.File.Close()
+    f.handler.log("file", f.parts, nil, f.read.Load(), err)
+    metrics.Transfer("download", "sftp", f.read.Load())
+    return err
+}
\ No newline at end of file
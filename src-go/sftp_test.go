@@ -0,0 +1,201 @@
+package main
+
+import (
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/pkg/sftp"
+)
+
+// newSftpClient serves a tree holding files over SFTP to a client connected
+// through a pipe, and returns the client, the handler serving it and the
+// root of the tree.
+func newSftpClient(t *testing.T, files map[string]string, edit func(c *Config)) (*sftp.Client, *sftpHandler, string) {
+    root := t.TempDir()
+    writeFiles(t, root, files)
+    useConfig(t, func(c *Config) {
+        c.Tree.DefaultFlag = "readwrite"
+        c.Trash.Enabled = false
+        if edit != nil {
+            edit(c)
+        }
+    })
+    tree := CreateTree(root)
+    handler := &sftpHandler{ tree: tree, trash: OpenTrash(tree, OpenVersions(tree)), locks: NewLockManager(), limits: NewLimiter() }
+    handlers := sftp.Handlers{ FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler }
+    serverConn, clientConn := net.Pipe()
+    server := sftp.NewRequestServer(serverConn, handlers)
+    go server.Serve()
+    client, err := sftp.NewClientPipe(clientConn, clientConn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        client.Close()
+        server.Close()
+    })
+    return client, handler, root
+}
+
+// sftpWrite replaces the file at name with content through client.
+func sftpWrite(client *sftp.Client, name string, content string) error {
+    fp, err := client.Create(name)
+    if err != nil {
+        return err
+    }
+    _, err = io.WriteString(fp, content)
+    if cerr := fp.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+func TestSftpRules(t *testing.T) {
+    client, _, root := newSftpClient(t, map[string]string{
+        ".rules.yml": "readonly: [ro.txt]\ninvisible: [secret.txt]\ndropbox: [inbox]",
+        "ro.txt": "ro",
+        "rw.txt": "rw",
+        "secret.txt": "secret",
+        "inbox/theirs.txt": "theirs",
+    }, nil)
+    content := func(name string) string {
+        data, _ := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+        return string(data)
+    }
+
+    infos, err := client.ReadDir("/")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, info := range infos {
+        if info.Name() == "secret.txt" || info.Name() == ".rules.yml" {
+            t.Errorf("%s is listed", info.Name())
+        }
+    }
+    if infos, _ := client.ReadDir("/inbox"); len(infos) != 0 {
+        t.Errorf("the entries of the dropbox are listed: %v", infos)
+    }
+    for _, name := range []string{ "/secret.txt", "/inbox/theirs.txt" } {
+        if fp, err := client.Open(name); err == nil {
+            fp.Close()
+            t.Errorf("%s can be read", name)
+        }
+    }
+    if fp, err := client.Open("/ro.txt"); err != nil {
+        t.Errorf("reading a readonly file: %v", err)
+    } else {
+        data, _ := io.ReadAll(fp)
+        fp.Close()
+        if string(data) != "ro" {
+            t.Errorf("read %q", data)
+        }
+    }
+
+    if err := sftpWrite(client, "/ro.txt", "changed"); err == nil || content("ro.txt") != "ro" {
+        t.Errorf("writing a readonly file: %v", err)
+    }
+    if err := client.Remove("/ro.txt"); err == nil || content("ro.txt") != "ro" {
+        t.Errorf("deleting a readonly file: %v", err)
+    }
+    if err := client.PosixRename("/rw.txt", "/ro.txt"); err == nil || content("ro.txt") != "ro" || content("rw.txt") != "rw" {
+        t.Errorf("moving onto a readonly file: %v", err)
+    }
+    if err := client.Rename("/ro.txt", "/moved.txt"); err == nil || content("ro.txt") != "ro" {
+        t.Errorf("moving a readonly file: %v", err)
+    }
+    if err := sftpWrite(client, "/.rules.yml", "readwrite: [\"*\"]"); err == nil {
+        t.Error("the rules file was written")
+    }
+    if err := sftpWrite(client, "/inbox/theirs.txt", "mine"); err == nil || content("inbox/theirs.txt") != "theirs" {
+        t.Errorf("overwriting a file of the dropbox: %v", err)
+    }
+
+    if err := sftpWrite(client, "/inbox/mine.txt", "mine"); err != nil || content("inbox/mine.txt") != "mine" {
+        t.Errorf("dropping a file: %v", err)
+    }
+    if err := client.Rename("/rw.txt", "/moved.txt"); err != nil || content("moved.txt") != "rw" {
+        t.Errorf("moving a writable file: %v", err)
+    }
+    if err := client.Mkdir("/new"); err != nil {
+        t.Errorf("making a directory: %v", err)
+    }
+}
+
+func TestSftpKeepsReplaced(t *testing.T) {
+    client, _, root := newSftpClient(t, map[string]string{
+        "a.txt": "a",
+        "b.txt": "b",
+        "c.txt": "long content",
+    }, func(c *Config) { c.Trash.Enabled = true })
+    if err := client.Rename("/a.txt", "/a.txt"); err != nil {
+        t.Errorf("renaming onto itself: %v", err)
+    }
+    if err := client.PosixRename("/a.txt", "/b.txt"); err != nil {
+        t.Fatal(err)
+    }
+    if err := client.Truncate("/c.txt", 4); err != nil {
+        t.Fatal(err)
+    }
+    if contents := readFiles(t, root, "b.txt", "c.txt"); contents["b.txt"] != "a" || contents["c.txt"] != "long" {
+        t.Fatalf("after the changes: %v", contents)
+    }
+    // Each item of the trash comes with a file describing it.
+    if entries := trashed(t, root); len(entries) != 4 {
+        t.Fatalf("the replaced files were not kept: %v", entries)
+    }
+}
+
+func TestSftpLocks(t *testing.T) {
+    client, handler, root := newSftpClient(t, map[string]string{ "a.txt": "a", "b.txt": "b" }, nil)
+    token, err := handler.locks.Lock("/a.txt", "someone", -1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := sftpWrite(client, "/a.txt", "changed"); err == nil {
+        t.Error("a locked file was written")
+    }
+    if err := client.Truncate("/a.txt", 0); err == nil {
+        t.Error("a locked file was truncated")
+    }
+    if err := client.PosixRename("/b.txt", "/a.txt"); err == nil {
+        t.Error("a locked file was replaced")
+    }
+    if err := client.Rename("/a.txt", "/c.txt"); err == nil {
+        t.Error("a locked file was moved")
+    }
+    if err := client.Remove("/a.txt"); err == nil {
+        t.Error("a locked file was deleted")
+    }
+    if contents := readFiles(t, root, "a.txt", "b.txt"); contents["a.txt"] != "a" || contents["b.txt"] != "b" {
+        t.Fatalf("files changed: %v", contents)
+    }
+
+    handler.locks.Unlock(time.Now(), token)
+    if err := sftpWrite(client, "/a.txt", "changed"); err != nil || readFiles(t, root, "a.txt")["a.txt"] != "changed" {
+        t.Errorf("writing once unlocked: %v", err)
+    }
+}
+
+func TestSftpSpace(t *testing.T) {
+    client, _, root := newSftpClient(t, map[string]string{
+        // The rules file takes up 9 of the 25 bytes.
+        ".rules.yml": "quota: 25",
+        "a.txt": "aaaaaaaaaa",
+    }, nil)
+    if err := sftpWrite(client, "/b.txt", "0123456789"); err == nil {
+        t.Error("writing past the quota")
+    }
+    if err := client.Truncate("/a.txt", 100); err == nil {
+        t.Error("truncating past the quota")
+    }
+    if contents := readFiles(t, root, "a.txt"); contents["a.txt"] != "aaaaaaaaaa" {
+        t.Errorf("after truncating: %v", contents)
+    }
+    if err := sftpWrite(client, "/c.txt", "0123"); err != nil {
+        t.Errorf("writing within the quota: %v", err)
+    }
+}
\ No newline at end of file
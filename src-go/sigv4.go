@@ -0,0 +1,279 @@
+package main
+
+import (
+    "bufio"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "io"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    sigv4Algorithm = "AWS4-HMAC-SHA256"
+    sigv4TimeFormat = "20060102T150405Z"
+    emptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Auth is the outcome of verifying a SigV4 signed request.
+type s3Auth struct {
+    User        string
+    payload        string // Value of x-amz-content-sha256.
+    key            []byte // Derived signing key.
+    date        string
+    scope        string
+    signature    string
+}
+
+func hmacSha256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// awsEscape percent-encodes s as required by SigV4: everything except the
+// unreserved characters, and slashes only if escapeSlash is set.
+func awsEscape(s string, escapeSlash bool) string {
+    sb := strings.Builder{}
+    for _, b := range []byte(s) {
+        if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' ||
+            b == '-' || b == '.' || b == '_' || b == '~' || b == '/' && !escapeSlash {
+            sb.WriteByte(b)
+        } else {
+            fmt.Fprintf(&sb, "%%%02X", b)
+        }
+    }
+    return sb.String()
+}
+
+// s3Authenticate verifies the SigV4 signature of r, carried either in the
+// Authorization header or in the query string of a presigned URL.
+func s3Authenticate(r *http.Request) (*s3Auth, error) {
+    var credential, signedHeaders, signature, date string
+    query := r.URL.Query()
+    presigned := query.Get("X-Amz-Algorithm") != ""
+    if presigned {
+        if query.Get("X-Amz-Algorithm") != sigv4Algorithm {
+            return nil, errS3AuthMalformed
+        }
+        credential = query.Get("X-Amz-Credential")
+        signedHeaders = query.Get("X-Amz-SignedHeaders")
+        signature = query.Get("X-Amz-Signature")
+        date = query.Get("X-Amz-Date")
+    } else {
+        header, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigv4Algorithm + " ")
+        if !ok {
+            return nil, errS3AccessDenied
+        }
+        for _, field := range strings.Split(header, ",") {
+            name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+            switch name {
+            case "Credential":
+                credential = value
+            case "SignedHeaders":
+                signedHeaders = value
+            case "Signature":
+                signature = value
+            }
+        }
+        date = r.Header.Get("X-Amz-Date")
+    }
+
+    scopeParts := strings.Split(credential, "/")
+    if len(scopeParts) != 5 || scopeParts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+        return nil, errS3AuthMalformed
+    }
+    stamp, err := time.Parse(sigv4TimeFormat, date)
+    if err != nil || !strings.HasPrefix(date, scopeParts[1]) {
+        return nil, errS3AuthMalformed
+    }
+    if presigned {
+        expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+        if err != nil || time.Now().After(stamp.Add(time.Duration(expires) * time.Second)) {
+            return nil, errS3AccessDenied
+        }
+    } else if skew := time.Since(stamp); skew > 15*time.Minute || skew < -15*time.Minute {
+        return nil, errS3TimeSkewed
+    }
+
+    auth := &s3Auth{
+        date: date,
+        scope: strings.Join(scopeParts[1:], "/"),
+        signature: signature,
+    }
+    var secret string
+    for name, user := range cfg().S3.Users {
+        if user.AccessKey == scopeParts[0] {
+            auth.User, secret = name, user.SecretKey
+            break
+        }
+    }
+    if auth.User == "" {
+        return nil, errS3InvalidKey
+    }
+
+    if presigned {
+        auth.payload = "UNSIGNED-PAYLOAD"
+    } else if auth.payload = r.Header.Get("X-Amz-Content-Sha256"); auth.payload == "" {
+        return nil, errS3AuthMalformed
+    }
+
+    params := []string{}
+    for name, values := range query {
+        if name == "X-Amz-Signature" {
+            continue
+        }
+        for _, value := range values {
+            params = append(params, awsEscape(name, true) + "=" + awsEscape(value, true))
+        }
+    }
+    slices.Sort(params)
+    headers := strings.Builder{}
+    for _, name := range strings.Split(signedHeaders, ";") {
+        var value string
+        switch name {
+        case "host":
+            value = r.Host
+        case "content-length":
+            value = strconv.FormatInt(r.ContentLength, 10)
+        default:
+            values := slices.Clone(r.Header.Values(name))
+            for i := range values {
+                values[i] = strings.Join(strings.Fields(values[i]), " ")
+            }
+            value = strings.Join(values, ",")
+        }
+        headers.WriteString(name + ":" + value + "\n")
+    }
+    canonical := strings.Join([]string{
+        r.Method,
+        awsEscape(r.URL.Path, false),
+        strings.Join(params, "&"),
+        headers.String(),
+        signedHeaders,
+        auth.payload,
+    }, "\n")
+
+    auth.key = []byte("AWS4" + secret)
+    for _, part := range scopeParts[1:] {
+        auth.key = hmacSha256(auth.key, part)
+    }
+    toSign := strings.Join([]string{ sigv4Algorithm, date, auth.scope, sha256Hex([]byte(canonical)) }, "\n")
+    if !hmac.Equal([]byte(hex.EncodeToString(hmacSha256(auth.key, toSign))), []byte(signature)) {
+        return nil, errS3SignatureMismatch
+    }
+    return auth, nil
+}
+
+// Body wraps the request body so that the payload is checked against the
+// signature as it is read.
+func (a *s3Auth) Body(r *http.Request) io.ReadCloser {
+    switch a.payload {
+    case "UNSIGNED-PAYLOAD":
+        return r.Body
+    case "STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER":
+        return &s3ChunkedReader{ body: r.Body, r: bufio.NewReader(r.Body), auth: a, prev: a.signature }
+    case "STREAMING-UNSIGNED-PAYLOAD-TRAILER":
+        return &s3ChunkedReader{ body: r.Body, r: bufio.NewReader(r.Body) }
+    }
+    return &s3HashReader{ ReadCloser: r.Body, hash: sha256.New(), want: a.payload }
+}
+
+type s3HashReader struct {
+    io.ReadCloser
+    hash    hash.Hash
+    want    string
+}
+
+func (h *s3HashReader) Read(p []byte) (int, error) {
+    n, err := h.ReadCloser.Read(p)
+    h.hash.Write(p[:n])
+    if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.want {
+        return n, errS3ContentMismatch
+    }
+    return n, err
+}
+
+// s3ChunkedReader decodes the aws-chunked content encoding, verifying the
+// signature chain of every chunk if auth is set. Trailing checksums are not
+// verified.
+type s3ChunkedReader struct {
+    body    io.Closer
+    r        *bufio.Reader
+    auth    *s3Auth
+    prev    string
+    chunk    []byte
+    done    bool
+}
+
+func (c *s3ChunkedReader) Read(p []byte) (int, error) {
+    for len(c.chunk) == 0 {
+        if c.done {
+            return 0, io.EOF
+        }
+        if err := c.next(); err != nil {
+            return 0, err
+        }
+    }
+    n := copy(p, c.chunk)
+    c.chunk = c.chunk[n:]
+    return n, nil
+}
+
+func (c *s3ChunkedReader) Close() error {
+    return c.body.Close()
+}
+
+func (c *s3ChunkedReader) next() error {
+    line, err := c.r.ReadString('\n')
+    if err != nil {
+        return io.ErrUnexpectedEOF
+    }
+    sizeHex, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+    size, err := strconv.ParseInt(sizeHex, 16, 64)
+    if err != nil || size < 0 || size > 64 << 20 {
+        return errS3IncompleteBody
+    }
+    data := make([]byte, size)
+    if _, err := io.ReadFull(c.r, data); err != nil {
+        return io.ErrUnexpectedEOF
+    }
+    if c.auth != nil {
+        signature, _ := strings.CutPrefix(ext, "chunk-signature=")
+        toSign := strings.Join([]string{
+            sigv4Algorithm + "-PAYLOAD", c.auth.date, c.auth.scope, c.prev, emptySha256, sha256Hex(data),
+        }, "\n")
+        if !hmac.Equal([]byte(hex.EncodeToString(hmacSha256(c.auth.key, toSign))), []byte(signature)) {
+            return errS3SignatureMismatch
+        }
+        c.prev = signature
+    }
+    if size == 0 {
+        // Skip trailing headers up to the terminating empty line.
+        for {
+            line, err := c.r.ReadString('\n')
+            if err != nil || strings.TrimSpace(line) == "" {
+                break
+            }
+        }
+        c.done = true
+        return nil
+    }
+    if crlf, err := c.r.Peek(2); err != nil || string(crlf) != "\r\n" {
+        return errS3IncompleteBody
+    }
+    c.r.Discard(2)
+    c.chunk = data
+    return nil
+}
\ No newline at end of file
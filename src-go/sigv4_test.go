@@ -0,0 +1,130 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// signedRequest returns a GET request of target signed in the Authorization
+// header at date, also signing the header extra if given.
+func signedRequest(target string, secret string, date time.Time, extra string) *http.Request {
+    r := httptest.NewRequest(http.MethodGet, target, nil)
+    stamp := date.UTC().Format(sigv4TimeFormat)
+    scope := stamp[:8] + "/us-east-1/s3/aws4_request"
+    r.Header.Set("X-Amz-Date", stamp)
+    r.Header.Set("X-Amz-Content-Sha256", emptySha256)
+    headers, signed := "host:" + r.Host + "\nx-amz-content-sha256:" + emptySha256 + "\nx-amz-date:" + stamp + "\n", "host;x-amz-content-sha256;x-amz-date"
+    if extra != "" {
+        r.Header.Set("X-Amz-Meta-Note", extra)
+        headers += "x-amz-meta-note:" + strings.Join(strings.Fields(extra), " ") + "\n"
+        signed += ";x-amz-meta-note"
+    }
+    canonical := strings.Join([]string{
+        http.MethodGet, r.URL.EscapedPath(), r.URL.Query().Encode(), headers, signed, emptySha256,
+    }, "\n")
+    r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDALICE/" + scope +
+        ",SignedHeaders=" + signed + ",Signature=" + signature(signingKey(secret, stamp[:8]), stamp, scope, canonical))
+    return r
+}
+
+// presignedRequest returns a GET request of target presigned at date for
+// expires seconds.
+func presignedRequest(target string, date time.Time, expires string) *http.Request {
+    r := httptest.NewRequest(http.MethodGet, target, nil)
+    stamp := date.UTC().Format(sigv4TimeFormat)
+    scope := stamp[:8] + "/us-east-1/s3/aws4_request"
+    query := r.URL.Query()
+    query.Set("X-Amz-Algorithm", sigv4Algorithm)
+    query.Set("X-Amz-Credential", "AKIDALICE/" + scope)
+    query.Set("X-Amz-Date", stamp)
+    query.Set("X-Amz-Expires", expires)
+    query.Set("X-Amz-SignedHeaders", "host")
+    canonical := strings.Join([]string{
+        http.MethodGet, r.URL.EscapedPath(), query.Encode(), "host:" + r.Host + "\n", "host", "UNSIGNED-PAYLOAD",
+    }, "\n")
+    query.Set("X-Amz-Signature", signature(signingKey("alice-secret", stamp[:8]), stamp, scope, canonical))
+    r.URL.RawQuery = query.Encode()
+    return r
+}
+
+func useS3Users(t *testing.T) {
+    useConfig(t, func(c *Config) {
+        c.S3.Users["alice"] = S3User{ AccessKey: "AKIDALICE", SecretKey: "alice-secret" }
+    })
+}
+
+func TestSigV4Header(t *testing.T) {
+    useS3Users(t)
+    now := time.Now()
+    auth, err := s3Authenticate(signedRequest("/sagasu?list-type=2&prefix=a/b&delimiter=/", "alice-secret", now, "  two   words "))
+    if err != nil || auth.User != "alice" {
+        t.Fatalf("valid request: %v", err)
+    }
+    for name, test := range map[string]struct {
+        r        *http.Request
+        err        error
+    }{
+        "wrong secret": { signedRequest("/sagasu/a.txt", "bob-secret", now, ""), errS3SignatureMismatch },
+        "skewed": { signedRequest("/sagasu/a.txt", "alice-secret", now.Add(-20 * time.Minute), ""), errS3TimeSkewed },
+        "future": { signedRequest("/sagasu/a.txt", "alice-secret", now.Add(20 * time.Minute), ""), errS3TimeSkewed },
+    } {
+        if _, err := s3Authenticate(test.r); err != test.err {
+            t.Errorf("%s: %v", name, err)
+        }
+    }
+
+    r := signedRequest("/sagasu/a.txt", "alice-secret", now, "note")
+    r.Header.Set("X-Amz-Meta-Note", "changed")
+    if _, err := s3Authenticate(r); err != errS3SignatureMismatch {
+        t.Errorf("changed header: %v", err)
+    }
+    r = signedRequest("/sagasu/a.txt", "alice-secret", now, "")
+    r.URL.RawQuery = "versionId=1"
+    if _, err := s3Authenticate(r); err != errS3SignatureMismatch {
+        t.Errorf("changed query: %v", err)
+    }
+    r = signedRequest("/sagasu/a.txt", "alice-secret", now, "")
+    r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "/aws4_request", "/aws5_request", 1))
+    if _, err := s3Authenticate(r); err != errS3AuthMalformed {
+        t.Errorf("malformed credential: %v", err)
+    }
+    r = signedRequest("/sagasu/a.txt", "alice-secret", now, "")
+    r.Header.Set("X-Amz-Date", now.Add(48 * time.Hour).UTC().Format(sigv4TimeFormat))
+    if _, err := s3Authenticate(r); err != errS3AuthMalformed {
+        t.Errorf("date outside the scope: %v", err)
+    }
+}
+
+func TestSigV4Presigned(t *testing.T) {
+    useS3Users(t)
+    now := time.Now()
+    if auth, err := s3Authenticate(presignedRequest("/sagasu/a.txt", now, "60")); err != nil || auth.payload != "UNSIGNED-PAYLOAD" {
+        t.Fatalf("valid URL: %v", err)
+    }
+    if _, err := s3Authenticate(presignedRequest("/sagasu/a.txt", now.Add(-2 * time.Minute), "60")); err != errS3AccessDenied {
+        t.Errorf("expired URL: %v", err)
+    }
+    if _, err := s3Authenticate(presignedRequest("/sagasu/a.txt", now, "forever")); err != errS3AccessDenied {
+        t.Errorf("invalid expiry: %v", err)
+    }
+    r := presignedRequest("/sagasu/a.txt", now, "60")
+    query := r.URL.Query()
+    query.Set("X-Amz-Expires", "3600")
+    r.URL.RawQuery = query.Encode()
+    if _, err := s3Authenticate(r); err != errS3SignatureMismatch {
+        t.Errorf("extended URL: %v", err)
+    }
+    r = presignedRequest("/sagasu/a.txt", now, "60")
+    r.URL.Path = "/sagasu/b.txt"
+    if _, err := s3Authenticate(r); err != errS3SignatureMismatch {
+        t.Errorf("other key: %v", err)
+    }
+    r = presignedRequest("/sagasu/a.txt", now, "60")
+    r.URL.RawQuery = strings.Replace(r.URL.RawQuery, "AWS4-HMAC-SHA256", "AWS4-HMAC-SHA1", 1)
+    if _, err := s3Authenticate(r); err != errS3AuthMalformed {
+        t.Errorf("other algorithm: %v", err)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// File is an open file of a storage. Directories opened for reading list
+// their entries through Readdir.
+type File interface {
+    io.Reader
+    io.ReaderAt
+    io.Writer
+    io.Seeker
+    io.Closer
+    Readdir(count int) ([]fs.FileInfo, error)
+    Stat() (fs.FileInfo, error)
+}
+
+// Storage is where a tree keeps its entries. Names are the locations built
+// by the tree, joining the path of its root with those of the entries, and
+// errors are those of package os, so that fs.ErrNotExist and the like can
+// be told apart the same way for every storage.
+type Storage interface {
+    ReadDir(name string) ([]fs.DirEntry, error)
+    Stat(name string) (fs.FileInfo, error)
+    Open(name string) (File, error)
+    Create(name string) (File, error)
+    OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+    Rename(from string, to string) error
+    Remove(name string) error
+    RemoveAll(name string) error
+    Mkdir(name string, perm fs.FileMode) error
+    ReadOnly() bool
+}
+
+type osStorage struct{}
+
+// OSStorage keeps entries on the local disk, where names are absolute paths.
+var OSStorage Storage = osStorage{}
+
+// Local reports whether st keeps entries on the local disk, which the
+// features keeping data next to the tree or handing paths to other libraries
+// require. Below the root of a namespace, locations are those of the disk.
+func Local(st Storage) bool {
+    switch st.(type) {
+    case osStorage, *mountStorage:
+        return true
+    }
+    return false
+}
+
+func (osStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+    return os.ReadDir(name)
+}
+
+func (osStorage) Stat(name string) (fs.FileInfo, error) {
+    return os.Stat(name)
+}
+
+func (osStorage) Open(name string) (File, error) {
+    fp, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    return fp, nil
+}
+
+func (osStorage) Create(name string) (File, error) {
+    fp, err := os.Create(name)
+    if err != nil {
+        return nil, err
+    }
+    return fp, nil
+}
+
+func (osStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+    fp, err := os.OpenFile(name, flag, perm)
+    if err != nil {
+        return nil, err
+    }
+    return fp, nil
+}
+
+func (osStorage) Rename(from string, to string) error {
+    return os.Rename(from, to)
+}
+
+func (osStorage) Remove(name string) error {
+    return os.Remove(name)
+}
+
+func (osStorage) RemoveAll(name string) error {
+    return os.RemoveAll(name)
+}
+
+func (osStorage) Mkdir(name string, perm fs.FileMode) error {
+    return os.Mkdir(name, perm)
+}
+
+func (osStorage) ReadOnly() bool {
+    return false
+}
+
+// storageKey turns a location into the slash-separated form used by the
+// storages that are not on disk, "." being their root.
+func storageKey(name string) string {
+    name = strings.TrimPrefix(path.Clean("/" + filepath.ToSlash(name)), "/")
+    if name == "" {
+        return "."
+    }
+    return name
+}
+
+// readFile reads the whole file at name.
+func readFile(st Storage, name string) ([]byte, error) {
+    fp, err := st.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    defer fp.Close()
+    return io.ReadAll(fp)
+}
+
+// writeFile replaces the file at name with data.
+func writeFile(st Storage, name string, data []byte) error {
+    fp, err := st.Create(name)
+    if err != nil {
+        return err
+    }
+    _, err = fp.Write(data)
+    if cerr := fp.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// importFile moves the local file at tmp to name in st, copying it if st is
+// not the local disk or name is on another volume than tmp.
+func importFile(st Storage, tmp string, name string) error {
+    if Local(st) {
+        return moveEntry(st, tmp, name, nil)
+    }
+    src, err := os.Open(tmp)
+    if err != nil {
+        return err
+    }
+    dst, err := st.Create(name)
+    if err != nil {
+        src.Close()
+        return err
+    }
+    _, err = io.Copy(dst, src)
+    src.Close()
+    if cerr := dst.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    return os.Remove(tmp)
+}
\ No newline at end of file
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "archive/zip"
+    "errors"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+var storageFiles = map[string]string{
+    "a.txt": "apple",
+    "dir/b.txt": "banana",
+    "dir/sub/c.txt": "cherry",
+}
+
+// storageCase is a storage holding storageFiles below root.
+type storageCase struct {
+    st        Storage
+    root    string
+}
+
+// writableStorages returns the storages that can be written, by name.
+func writableStorages(t *testing.T) map[string]storageCase {
+    root := t.TempDir()
+    writeFiles(t, root, storageFiles)
+    mem := memTree(t, storageFiles)
+    return map[string]storageCase{
+        "os": { OSStorage, root },
+        "mem": { mem.Storage(), "." },
+    }
+}
+
+// archive writes storageFiles to a zip archive, compressed so that its
+// entries cannot seek.
+func archive(t *testing.T) string {
+    file := filepath.Join(t.TempDir(), "files.zip")
+    fp, err := os.Create(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    zw := zip.NewWriter(fp)
+    for name, content := range storageFiles {
+        w, err := zw.Create(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        io.WriteString(w, content)
+    }
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    fp.Close()
+    return file
+}
+
+func TestStoragesRead(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    storages := writableStorages(t)
+    zipped, err := OpenArchive(archive(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    storages["zip"] = storageCase{ zipped, "." }
+
+    for name, s := range storages {
+        tree := CreateTreeOn(s.st, s.root)
+        if tree == nil {
+            t.Fatalf("%s: no tree", name)
+        }
+        dir, _ := tree.Walk([]string{ "dir" })
+        if dir == nil {
+            t.Fatalf("%s: cannot walk into dir", name)
+        }
+        files, dirs, _, err := dir.Scan()
+        if err != nil || len(files) != 1 || files[0].Name != "b.txt" || files[0].Size != 6 || len(dirs) != 1 || dirs[0].Name != "sub" {
+            t.Fatalf("%s: scanned %+v %+v, %v", name, files, dirs, err)
+        }
+
+        _, loc, err := tree.Locate([]string{ "dir", "sub", "c.txt" }, PermRead, true)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        fp, err := s.st.Open(loc)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        buf := make([]byte, 3)
+        if n, err := fp.ReadAt(buf, 3); n != 3 || string(buf) != "rry" {
+            t.Errorf("%s: read at 3: %q, %v", name, buf[:n], err)
+        }
+        if _, err := fp.Seek(1, io.SeekStart); err != nil {
+            t.Errorf("%s: seek: %v", name, err)
+        }
+        if data, _ := io.ReadAll(fp); string(data) != "herry" {
+            t.Errorf("%s: read after seek: %q", name, data)
+        }
+        fp.Close()
+
+        if _, err := s.st.Stat(tree.Location("missing.txt")); !errors.Is(err, fs.ErrNotExist) {
+            t.Errorf("%s: stat of a missing file: %v", name, err)
+        }
+    }
+}
+
+func TestStoragesWrite(t *testing.T) {
+    useConfig(t, nil)
+    for name, s := range writableStorages(t) {
+        loc := func(name string) string { return filepath.Join(s.root, filepath.FromSlash(name)) }
+        if err := s.st.Mkdir(loc("new"), 0o755); err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        if err := s.st.Mkdir(loc("new"), 0o755); !errors.Is(err, fs.ErrExist) {
+            t.Errorf("%s: making an existing directory: %v", name, err)
+        }
+        if err := writeFile(s.st, loc("new/d.txt"), []byte("date")); err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        if err := s.st.Rename(loc("dir"), loc("new/moved")); err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        if data, err := readFile(s.st, loc("new/moved/sub/c.txt")); err != nil || string(data) != "cherry" {
+            t.Fatalf("%s: entries were not moved along: %q, %v", name, data, err)
+        }
+        if err := s.st.Rename(loc("missing"), loc("other")); !errors.Is(err, fs.ErrNotExist) {
+            t.Errorf("%s: moving a missing entry: %v", name, err)
+        }
+        if err := s.st.Remove(loc("new")); err == nil {
+            t.Errorf("%s: removed a directory that is not empty", name)
+        }
+        if err := s.st.RemoveAll(loc("new")); err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        entries, err := s.st.ReadDir(s.root)
+        if err != nil || len(entries) != 1 || entries[0].Name() != "a.txt" {
+            t.Fatalf("%s: left %v, %v", name, entries, err)
+        }
+    }
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    zipped, err := OpenArchive(archive(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for op, err := range map[string]error{
+        "create": func() error { _, err := zipped.Create("new.txt"); return err }(),
+        "open for writing": func() error { _, err := zipped.OpenFile("a.txt", os.O_WRONLY, 0); return err }(),
+        "rename": zipped.Rename("a.txt", "b.txt"),
+        "remove": zipped.Remove("a.txt"),
+        "mkdir": zipped.Mkdir("new", 0o755),
+    } {
+        if !errors.Is(err, fs.ErrPermission) {
+            t.Errorf("%s: %v", op, err)
+        }
+    }
+    // Whatever the rules say, the tree only grants reading.
+    tree := CreateTreeOn(zipped, ".")
+    if perms := tree.PermsOf("a.txt"); perms != PermList | PermRead {
+        t.Errorf("permissions: %b", perms)
+    }
+    if _, _, err := tree.Locate([]string{ "a.txt" }, PermWrite, true); !errors.Is(err, ErrForbidden) {
+        t.Errorf("writing: %v", err)
+    }
+    if data, err := readFile(zipped, "dir/b.txt"); err != nil || string(data) != "banana" {
+        t.Errorf("reading: %q, %v", data, err)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+)
+
+// progressStep is how many bytes are copied between progress reports.
+const progressStep = 4 << 20
+
+var (
+    ErrMismatch = errors.New("copy does not match the source")
+    ErrIsDirectory = errors.New("is a directory")
+    ErrSameEntry = errors.New("source and target are the same")
+)
+
+// TransferRequest is the body of /move and /copy.
+type TransferRequest struct {
+    From    []string    `json:"from"`
+    To      []string    `json:"to"`
+    IfMatch    string    `json:"ifMatch"`
+    IfNoneMatch    string    `json:"ifNoneMatch"`
+    LockToken    string    `json:"lockToken"`
+}
+
+// UploadRequest is the first message of /upload, before the chunks.
+type UploadRequest struct {
+    Count    int        `json:"count"`
+    Size    *int64    `json:"size"`
+    Key        string    `json:"key"`
+    IfMatch    string    `json:"ifMatch"`
+    IfNoneMatch    string    `json:"ifNoneMatch"`
+    LockToken    string    `json:"lockToken"`
+}
+
+// Progress is told how many of the total bytes of a transfer are done.
+type Progress func(done int64, total int64)
+
+// transfer counts the bytes written through it and reports them every
+// progressStep bytes.
+type transfer struct {
+    done        int64
+    total        int64
+    reported    int64
+    progress    Progress
+}
+
+func (t *transfer) Write(p []byte) (int, error) {
+    t.done += int64(len(p))
+    if t.progress != nil && t.done - t.reported >= progressStep {
+        t.reported = t.done
+        t.progress(t.done, t.total)
+    }
+    return len(p), nil
+}
+
+// sameEntry reports whether from and to are the same entry of st, as names
+// differing only in case are on disks that ignore it.
+func sameEntry(st Storage, from string, to string) bool {
+    if from == to {
+        return true
+    }
+    a, err := st.Stat(from)
+    if err != nil {
+        return false
+    }
+    b, err := st.Stat(to)
+    return err == nil && os.SameFile(a, b)
+}
+
+// moveEntry renames from to to. Renames cannot cross devices, such as the
+// mounts of a namespace on different volumes, so then the entry is copied
+// and verified before from is deleted. A failed copy leaves from as it was
+// and removes what was copied.
+func moveEntry(st Storage, from string, to string, progress Progress) error {
+    err := st.Rename(from, to)
+    if err == nil || !isCrossDevice(err) {
+        return err
+    }
+    t := &transfer{ total: diskUsage(st, from), progress: progress }
+    if err := copyEntry(st, from, to, t); err != nil {
+        return err
+    }
+    return st.RemoveAll(from)
+}
+
+// copyEntry copies the file or directory at from to to, which must not be
+// an existing directory.
+func copyEntry(st Storage, from string, to string, t *transfer) error {
+    info, err := st.Stat(from)
+    if err != nil {
+        return err
+    }
+    if !info.IsDir() {
+        return copyFile(st, from, to, t)
+    }
+    if err := st.Mkdir(to, info.Mode().Perm()); err != nil {
+        return err
+    }
+    entries, err := st.ReadDir(from)
+    if err == nil {
+        for _, entry := range entries {
+            if err = copyEntry(st, filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name()), t); err != nil {
+                break
+            }
+        }
+    }
+    if err != nil {
+        st.RemoveAll(to)
+        return err
+    }
+    // Copying the entries changed the time of the directory.
+    keepMetadata(st, to, info)
+    return nil
+}
+
+// copyFile copies the file at from to to, replacing it, and checks that the
+// copy reads back the same. The partial copy is removed on failure.
+func copyFile(st Storage, from string, to string, t *transfer) error {
+    src, err := st.Open(from)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    info, err := src.Stat()
+    if err != nil {
+        return err
+    }
+    if info.IsDir() {
+        return &fs.PathError{ Op: "copy", Path: from, Err: ErrIsDirectory }
+    }
+    dst, err := st.OpenFile(to, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, info.Mode().Perm())
+    if err != nil {
+        return err
+    }
+    sum := sha256.New()
+    size, err := io.Copy(io.MultiWriter(dst, sum, t), src)
+    if cerr := dst.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = verifyCopy(st, to, size, sum.Sum(nil), info.Size())
+    }
+    if err != nil {
+        st.Remove(to)
+        return err
+    }
+    keepMetadata(st, to, info)
+    return nil
+}
+
+// verifyCopy reads the copy at name back and compares it with the size and
+// hash of what was read from the source, which must also have kept its size.
+func verifyCopy(st Storage, name string, size int64, hash []byte, expected int64) error {
+    if size != expected {
+        return fmt.Errorf("%w: read %d of %d bytes", ErrMismatch, size, expected)
+    }
+    fp, err := st.Open(name)
+    if err != nil {
+        return err
+    }
+    defer fp.Close()
+    sum := sha256.New()
+    copied, err := io.Copy(sum, fp)
+    if err != nil {
+        return err
+    }
+    if copied != size || !bytes.Equal(sum.Sum(nil), hash) {
+        return fmt.Errorf("%w: %s", ErrMismatch, name)
+    }
+    return nil
+}
+
+// keepMetadata gives the copy at name the permissions and modification time
+// of the source, as far as the storage keeps them.
+func keepMetadata(st Storage, name string, info fs.FileInfo) {
+    if !Local(st) {
+        return
+    }
+    os.Chmod(name, info.Mode().Perm())
+    os.Chtimes(name, info.ModTime(), info.ModTime())
+}
\ No newline at end of file
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "golang.org/x/sys/windows"
+)
+
+// crossDevice is a storage whose renames fail as they do across volumes,
+// and which fails to write the files named fail.
+type crossDevice struct {
+    Storage
+    fail    string
+}
+
+var errWrite = errors.New("write failed")
+
+func (st crossDevice) Rename(from string, to string) error {
+    return &os.LinkError{ Op: "rename", Old: from, New: to, Err: windows.ERROR_NOT_SAME_DEVICE }
+}
+
+func (st crossDevice) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+    if filepath.Base(name) == st.fail && flag & os.O_WRONLY != 0 {
+        return nil, &fs.PathError{ Op: "open", Path: name, Err: errWrite }
+    }
+    return st.Storage.OpenFile(name, flag, perm)
+}
+
+func TestMoveAcrossDevices(t *testing.T) {
+    root := t.TempDir()
+    writeFiles(t, root, storageFiles)
+    st := crossDevice{ Storage: OSStorage }
+    err := moveEntry(st, filepath.Join(root, "dir"), filepath.Join(root, "moved"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(filepath.Join(root, "dir")); !errors.Is(err, fs.ErrNotExist) {
+        t.Errorf("source kept: %v", err)
+    }
+    got := readFiles(t, root, "moved/b.txt", "moved/sub/c.txt")
+    if got["moved/b.txt"] != "banana" || got["moved/sub/c.txt"] != "cherry" {
+        t.Errorf("moved files: %v", got)
+    }
+}
+
+func TestMoveAcrossDevicesFails(t *testing.T) {
+    root := t.TempDir()
+    writeFiles(t, root, storageFiles)
+    st := crossDevice{ Storage: OSStorage, fail: "c.txt" }
+    err := moveEntry(st, filepath.Join(root, "dir"), filepath.Join(root, "moved"), nil)
+    if !errors.Is(err, errWrite) {
+        t.Fatalf("move: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(root, "moved")); !errors.Is(err, fs.ErrNotExist) {
+        t.Errorf("partial target kept: %v", err)
+    }
+    got := readFiles(t, root, "dir/b.txt", "dir/sub/c.txt")
+    if got["dir/b.txt"] != "banana" || got["dir/sub/c.txt"] != "cherry" {
+        t.Errorf("source files: %v", got)
+    }
+    // A single file fails the same way, without leaving an empty copy.
+    err = moveEntry(st, filepath.Join(root, "dir/sub/c.txt"), filepath.Join(root, "c.txt"), nil)
+    if !errors.Is(err, errWrite) {
+        t.Fatalf("move file: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(root, "c.txt")); !errors.Is(err, fs.ErrNotExist) {
+        t.Errorf("partial file kept: %v", err)
+    }
+}
\ No newline at end of file
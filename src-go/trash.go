@@ -0,0 +1,403 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+const trashName = ".sagasu-trash"
+
+var ErrConflict = errors.New("conflict")
+
+type TrashItem struct {
+    ID        string        `json:"id"`
+    Path    []string    `json:"path"`
+    Dir        bool        `json:"dir"`
+    Size    int64        `json:"size"`
+    Time    time.Time    `json:"time"` // When the entry was discarded.
+    Reason    string        `json:"reason"` // deleted or overwritten.
+    dir        string // The trash directory holding the entry.
+}
+
+// RestoreRequest is the body of /trash/restore.
+type RestoreRequest struct {
+    ID    string        `json:"id"`
+    To    []string    `json:"to"`
+}
+
+// PurgeRequest is the body of /trash/purge.
+type PurgeRequest struct {
+    IDs    []string    `json:"ids"`
+}
+
+// Trash keeps deleted and overwritten entries until they expire. Every
+// entry is stored under a random id, next to an id.json file describing
+// where it came from. Each mount of a namespace has a trash directory of its
+// own, so that entries are moved rather than copied there, which is only
+// created when the first entry is discarded. Entries are removed for good if
+// the trash is disabled or its directory cannot be created, and the trash is
+// always disabled unless the tree is on the local disk. Paths are resolved in
+// the tree of the client given to each method.
+type Trash struct {
+    mu        sync.Mutex
+    versions    *Versions
+    dirs    map[string]string // Trash directories by anchor.
+    failed    map[string]bool // Trash directories that could not be created.
+    holds    map[int]time.Time // When each hold was taken, by id.
+    nextHold    int
+}
+
+func OpenTrash(tree *Tree, versions *Versions) *Trash {
+    trash := &Trash{ versions: versions, dirs: map[string]string{}, failed: map[string]bool{}, holds: map[int]time.Time{} }
+    if !cfg().Trash.Enabled || !Local(tree.Storage()) {
+        return trash
+    }
+    for _, anchor := range tree.Anchors() {
+        root, _ := filepath.Abs(anchor)
+        dir := filepath.Join(root, trashName)
+        if loc := os.ExpandEnv(cfg().Trash.Location); loc != "" {
+            dir = filepath.Join(loc, Hash(root))
+        } else {
+            tree.Reserve(trashName)
+        }
+        trash.dirs[anchor] = dir
+    }
+    go trash.run()
+    return trash
+}
+
+func (x *Trash) Enabled() bool {
+    return len(x.dirs) > 0
+}
+
+// dirOf returns the trash directory for the entry named by parts, creating
+// it if needed, or "" if entries there are removed for good. A directory
+// that cannot be created is warned about once, and tried again each time.
+func (x *Trash) dirOf(t *Tree, parts []string) string {
+    dir, ok := x.dirs[t.AnchorOf(parts)]
+    if !ok {
+        return ""
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        if !x.failed[dir] {
+            fmt.Println("Warning: cannot create trash, deleting for good:", err)
+        }
+        x.failed[dir] = true
+        return ""
+    }
+    delete(x.failed, dir)
+    return dir
+}
+
+// Keeps reports whether entries named by parts would go to the trash.
+func (x *Trash) Keeps(t *Tree, parts []string) bool {
+    return x.dirOf(t, parts) != ""
+}
+
+// Hold keeps the entries discarded from now on from expiring until release
+// is called, so that the steps of a batch can still be undone.
+func (x *Trash) Hold() (release func()) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    id := x.nextHold
+    x.nextHold++
+    x.holds[id] = time.Now()
+    return func() {
+        x.mu.Lock()
+        delete(x.holds, id)
+        x.mu.Unlock()
+        x.expire()
+    }
+}
+
+func (x *Trash) run() {
+    for {
+        x.expire()
+        time.Sleep(time.Hour)
+    }
+}
+
+// Delete discards the entry named by parts, resolved in t, the tree of the
+// client. Directories may only be deleted if everything below them is
+// writable.
+func (x *Trash) Delete(t *Tree, parts []string) error {
+    _, err := x.delete(t, parts)
+    return err
+}
+
+// Undo puts back an entry that was deleted or replaced.
+type Undo func() error
+
+// delete is Delete, also returning how to undo it, or nil if the entry is
+// gone for good.
+func (x *Trash) delete(t *Tree, parts []string) (Undo, error) {
+    t, loc, err := t.Locate(parts, PermDelete, true)
+    if err != nil {
+        return nil, err
+    }
+    info, err := t.Storage().Stat(loc)
+    if err != nil {
+        return nil, err
+    }
+    name := parts[len(parts)-1]
+    if info.IsDir() {
+        if sub := t.Next(name); sub == nil || !removable(sub) {
+            return nil, &LocateError{ Segment: name, Path: parts, Err: ErrForbidden }
+        }
+    }
+    return x.discard(t, parts, loc, "deleted")
+}
+
+// Replace keeps the file at loc before it is overwritten, as a version if
+// the rules ask for one and in the trash otherwise. Nothing happens if there
+// is no such file.
+func (x *Trash) Replace(t *Tree, parts []string, loc string) error {
+    _, err := x.replace(t, parts, loc)
+    return err
+}
+
+// replace is Replace, also returning how to put the file back, or nil if
+// there is none or it is left to be overwritten.
+func (x *Trash) replace(t *Tree, parts []string, loc string) (Undo, error) {
+    if info, err := t.Storage().Stat(loc); err != nil || info.IsDir() {
+        return nil, nil
+    }
+    kept, err := x.versions.Snapshot(t, parts, loc)
+    if err != nil {
+        return nil, err
+    } else if kept != "" {
+        return func() error { return os.Rename(kept, loc) }, nil
+    }
+    if !x.Keeps(t, parts) {
+        return nil, nil
+    }
+    return x.discard(t, parts, loc, "overwritten")
+}
+
+func (x *Trash) discard(t *Tree, parts []string, loc string, reason string) (Undo, error) {
+    dir := x.dirOf(t, parts)
+    if dir == "" {
+        return nil, t.Storage().RemoveAll(loc)
+    }
+    info, err := os.Stat(loc)
+    if err != nil {
+        return nil, err
+    }
+    idbin := make([]byte, 8)
+    rand.Read(idbin)
+    item := TrashItem{
+        ID: hex.EncodeToString(idbin),
+        Path: parts,
+        Dir: info.IsDir(),
+        Size: diskUsage(t.Storage(), loc),
+        Time: time.Now(),
+        Reason: reason,
+    }
+    meta, _ := json.Marshal(item)
+    x.mu.Lock()
+    // The description goes first so that no entry is left without one.
+    err = os.WriteFile(filepath.Join(dir, item.ID + ".json"), meta, 0o644)
+    if err == nil {
+        // The trash may be on another volume than the tree.
+        if err = moveEntry(t.Storage(), loc, filepath.Join(dir, item.ID), nil); err != nil {
+            os.Remove(filepath.Join(dir, item.ID + ".json"))
+        }
+    }
+    x.mu.Unlock()
+    if err != nil {
+        return nil, err
+    }
+    x.expire()
+    return func() error {
+        x.mu.Lock()
+        defer x.mu.Unlock()
+        if err := moveEntry(t.Storage(), filepath.Join(dir, item.ID), loc, nil); err != nil {
+            return err
+        }
+        return os.Remove(filepath.Join(dir, item.ID + ".json"))
+    }, nil
+}
+
+// items reads the descriptions of all entries, oldest first.
+func (x *Trash) items() []TrashItem {
+    items := []TrashItem{}
+    for _, dir := range x.dirs {
+        entries, err := os.ReadDir(dir)
+        if err != nil {
+            continue
+        }
+        for _, entry := range entries {
+            id, ok := strings.CutSuffix(entry.Name(), ".json")
+            if !ok {
+                continue
+            }
+            data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+            if err != nil {
+                continue
+            }
+            item := TrashItem{ dir: dir }
+            if json.Unmarshal(data, &item) != nil || item.ID != id || len(item.Path) == 0 {
+                continue
+            }
+            items = append(items, item)
+        }
+    }
+    slices.SortFunc(items, func(a TrashItem, b TrashItem) int { return a.Time.Compare(b.Time) })
+    return items
+}
+
+// accessible reports whether the original location of item is currently
+// readable and writable, which is required to see, restore or purge it.
+func (x *Trash) accessible(t *Tree, item TrashItem) bool {
+    _, _, err := t.Locate(item.Path, PermRead | PermWrite, false)
+    return err == nil
+}
+
+// List returns the entries accessible in t, most recent first.
+func (x *Trash) List(t *Tree) []TrashItem {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    items := []TrashItem{}
+    for _, item := range x.items() {
+        if x.accessible(t, item) {
+            items = append(items, item)
+        }
+    }
+    slices.Reverse(items)
+    return items
+}
+
+func (x *Trash) find(t *Tree, id string) (TrashItem, error) {
+    for _, item := range x.items() {
+        if item.ID == id && x.accessible(t, item) {
+            return item, nil
+        }
+    }
+    return TrashItem{}, ErrNotFound
+}
+
+// Restore moves an entry back to its original location, or to the path named
+// by to if given. Existing entries are never overwritten, and the entry has
+// to meet the type rules and quotas there like any other file written.
+func (x *Trash) Restore(t *Tree, id string, to []string) ([]string, error) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    item, err := x.find(t, id)
+    if err != nil {
+        return nil, err
+    }
+    if len(to) == 0 {
+        to = item.Path
+    }
+    _, loc, err := t.Locate(to, PermWrite, false)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := os.Lstat(loc); err == nil {
+        return nil, ErrConflict
+    }
+    src := filepath.Join(item.dir, item.ID)
+    if err := t.CheckTypeOf(to, src); err != nil {
+        return nil, err
+    }
+    if err := t.CheckSpace(to, item.Size, nil); err != nil {
+        return nil, err
+    }
+    if err := moveEntry(t.Storage(), src, loc, nil); err != nil {
+        return nil, err
+    }
+    os.Remove(filepath.Join(item.dir, item.ID + ".json"))
+    return to, nil
+}
+
+// Purge removes the given entries for good, or all accessible ones if ids
+// is empty. It returns the number of entries removed.
+func (x *Trash) Purge(t *Tree, ids []string) (int, error) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    count := 0
+    for _, item := range x.items() {
+        if len(ids) > 0 && !slices.Contains(ids, item.ID) || !x.accessible(t, item) {
+            continue
+        }
+        if err := x.remove(item); err != nil {
+            return count, err
+        }
+        count++
+    }
+    return count, nil
+}
+
+func (x *Trash) remove(item TrashItem) error {
+    if err := os.RemoveAll(filepath.Join(item.dir, item.ID)); err != nil {
+        return err
+    }
+    return os.Remove(filepath.Join(item.dir, item.ID + ".json"))
+}
+
+// expire removes entries older than Trash.MaxAge days, then the oldest ones
+// until the trash fits in Trash.MaxSize bytes. Zero disables either limit.
+// Entries discarded since the earliest hold still taken are left alone.
+func (x *Trash) expire() {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    items := x.items()
+    total := int64(0)
+    for _, item := range items {
+        total += item.Size
+    }
+    held := time.Time{}
+    for _, since := range x.holds {
+        held = earlier(held, since)
+    }
+    deadline := time.Now().AddDate(0, 0, -cfg().Trash.MaxAge)
+    for _, item := range items {
+        if !held.IsZero() && !item.Time.Before(held) {
+            continue
+        }
+        old := cfg().Trash.MaxAge > 0 && item.Time.Before(deadline)
+        full := cfg().Trash.MaxSize > 0 && total > cfg().Trash.MaxSize
+        if !old && !full {
+            break
+        }
+        if x.remove(item) == nil {
+            total -= item.Size
+        }
+    }
+}
+
+// diskUsage sums the sizes of the files at or below loc in st.
+func diskUsage(st Storage, loc string) int64 {
+    info, err := st.Stat(loc)
+    if err != nil {
+        return 0
+    }
+    if !info.IsDir() {
+        return info.Size()
+    }
+    entries, err := st.ReadDir(loc)
+    if err != nil {
+        return 0
+    }
+    size := int64(0)
+    for _, entry := range entries {
+        // Like filepath.WalkDir, links to directories are not followed.
+        if entry.IsDir() {
+            size += diskUsage(st, filepath.Join(loc, entry.Name()))
+        } else if info, err := entry.Info(); err == nil {
+            size += info.Size()
+        }
+    }
+    return size
+}
\ No newline at end of file
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// newTrash opens the trash of a tree on disk holding files.
+func newTrash(t *testing.T, files map[string]string, edit func(c *Config)) (*Trash, *Tree, string) {
+    root := t.TempDir()
+    writeFiles(t, root, files)
+    useConfig(t, func(c *Config) {
+        c.Tree.DefaultFlag = "readwrite"
+        c.Trash.Enabled = true
+        if edit != nil {
+            edit(c)
+        }
+    })
+    tree := CreateTree(root)
+    return OpenTrash(tree, OpenVersions(tree)), tree, root
+}
+
+func TestTrashRestore(t *testing.T) {
+    trash, tree, root := newTrash(t, map[string]string{ "a.txt": "a", "b.txt": "b" }, nil)
+    for _, name := range []string{ "a.txt", "b.txt" } {
+        if err := trash.Delete(tree, []string{ name }); err != nil {
+            t.Fatal(err)
+        }
+    }
+    items := trash.List(tree)
+    if len(items) != 2 || items[0].Path[0] != "b.txt" || items[0].Reason != "deleted" {
+        t.Fatalf("listing: %+v", items)
+    }
+
+    writeFiles(t, root, map[string]string{ "b.txt": "new" })
+    if _, err := trash.Restore(tree, items[0].ID, nil); !errors.Is(err, ErrConflict) {
+        t.Errorf("restoring onto an existing file: %v", err)
+    }
+    if to, err := trash.Restore(tree, items[0].ID, []string{ "c.txt" }); err != nil || to[0] != "c.txt" {
+        t.Errorf("restoring elsewhere: %v %v", to, err)
+    }
+    if _, err := trash.Restore(tree, items[1].ID, nil); err != nil {
+        t.Error(err)
+    }
+    if _, err := trash.Restore(tree, items[1].ID, nil); !errors.Is(err, ErrNotFound) {
+        t.Errorf("restoring twice: %v", err)
+    }
+    if contents := readFiles(t, root, "a.txt", "b.txt", "c.txt"); contents["a.txt"] != "a" || contents["b.txt"] != "new" || contents["c.txt"] != "b" {
+        t.Errorf("after restoring: %v", contents)
+    }
+    if entries := trashed(t, root); len(entries) != 0 {
+        t.Errorf("left in the trash: %v", entries)
+    }
+}
+
+func TestTrashPurge(t *testing.T) {
+    trash, tree, root := newTrash(t, map[string]string{ "a.txt": "a", "b.txt": "b", "c.txt": "c" }, nil)
+    for _, name := range []string{ "a.txt", "b.txt", "c.txt" } {
+        if err := trash.Delete(tree, []string{ name }); err != nil {
+            t.Fatal(err)
+        }
+    }
+    items := trash.List(tree)
+    if count, err := trash.Purge(tree, []string{ items[0].ID, "unknown" }); count != 1 || err != nil {
+        t.Errorf("purging one: %d %v", count, err)
+    }
+    if items := trash.List(tree); len(items) != 2 {
+        t.Errorf("after purging one: %+v", items)
+    }
+    if count, err := trash.Purge(tree, nil); count != 2 || err != nil {
+        t.Errorf("purging all: %d %v", count, err)
+    }
+    if entries := trashed(t, root); len(entries) != 0 {
+        t.Errorf("left in the trash: %v", entries)
+    }
+}
+
+func TestTrashExpiry(t *testing.T) {
+    trash, tree, _ := newTrash(t, map[string]string{
+        "old.txt": "old",
+        "a.txt": "aaaa",
+        "b.txt": "bbbbb",
+    }, func(c *Config) {
+        c.Trash.MaxAge = 1
+        c.Trash.MaxSize = 8
+    })
+    for _, name := range []string{ "old.txt", "a.txt" } {
+        if err := trash.Delete(tree, []string{ name }); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // Make the first entry older than Trash.MaxAge.
+    item := trash.List(tree)[1]
+    item.Time = time.Now().AddDate(0, 0, -2)
+    data, _ := json.Marshal(item)
+    if err := os.WriteFile(filepath.Join(item.dir, item.ID + ".json"), data, 0o644); err != nil {
+        t.Fatal(err)
+    }
+    trash.expire()
+    if items := trash.List(tree); len(items) != 1 || items[0].Path[0] != "a.txt" {
+        t.Fatalf("after the first entry expired: %+v", items)
+    }
+
+    // Both entries do not fit in Trash.MaxSize, so the oldest goes.
+    if err := trash.Delete(tree, []string{ "b.txt" }); err != nil {
+        t.Fatal(err)
+    }
+    trash.expire()
+    if items := trash.List(tree); len(items) != 1 || items[0].Path[0] != "b.txt" {
+        t.Fatalf("after the trash filled up: %+v", items)
+    }
+}
\ No newline at end of file
@@ -1,21 +1,47 @@
 package main
 
 import (
-    "os"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/netip"
     "path/filepath"
+    "slices"
+    "strings"
+    "sync"
     "time"
 
     "gopkg.in/yaml.v3"
 )
 
-var Flags = U16Enum{ "undefined", "invisible", "visible", "readonly", "readwrite" };
+var Flags = U16Enum{ "undefined", "invisible", "visible", "readonly", "readwrite", "dropbox" };
+
+// Permission bits granted by the flags, checked instead of comparing flags
+// since dropbox is not ordered with the others.
+const (
+    PermList uint16 = 1 << iota // Shown in listings and walked into.
+    PermRead // Contents can be read, or copied elsewhere.
+    PermWrite // Existing files can be overwritten or modified.
+    PermDelete // Can be deleted or moved away.
+    PermCreate // New entries can be created.
+)
+
+const PermAll = PermList | PermRead | PermWrite | PermDelete | PermCreate
+
+// flagPerms are the permission bits of each flag. A dropbox folder itself
+// is also listed, while the entries inherit it and stay hidden, so that new
+// files can be dropped into it without seeing the others.
+var flagPerms = []uint16{ 0, 0, PermList, PermList | PermRead, PermAll, PermCreate }
 
 type FileItem struct {
     Name    string         `json:"name"`
     Size     int64        `json:"size"`
     Time     time.Time    `json:"time"`
+    ETag    string        `json:"etag"`
+    Lock    *LockInfo    `json:"lock"`
     Assoc    *string         `json:"assoc"`
     Flag    uint16        `json:"flag"`
+    Perms    uint16        `json:"perms"`
     Effect    *Effect        `json:"effect"`
 }
 
@@ -23,54 +49,352 @@ type DirItem struct {
     Name    string        `json:"name"`
     Time    time.Time    `json:"time"`
     Flag    uint16        `json:"flag"`
+    Perms    uint16        `json:"perms"`
     Effect    *Effect        `json:"effect"`
 }
 
 type RuleItem struct {
     Flag    uint16
     Modes    []string
+    Clients    []netip.Prefix // Nil if the item applies to every client.
+    From    time.Time // Zero if the item applies from the start.
+    Until    time.Time // Zero if the item never expires.
+    Schedule    *Schedule // Nil if the item applies at all times.
+    Policy    bool // Defined by the central policy rather than a rules file.
 }
 
 type Rules []RuleItem
 
-func (r *Rules) FlagOf(name string) uint16 {
-    for _, item := range *r {
-        for _, mode := range item.Modes {
-            if matched, _ := filepath.Match(mode, name); matched {
-                return item.Flag
+// RuleSet holds what the rules of a directory define.
+type RuleSet struct {
+    Rules    Rules
+    Versions    []VersionRule
+    MaxSizes    []SizeRule
+    Quota    int64 // Bytes allowed below this directory, 0 if unlimited.
+    Types    []TypeRule
+}
+
+// VersionRule keeps up to Keep previous versions of files matching Patterns.
+type VersionRule struct {
+    Keep        int            `yaml:"keep"`
+    Patterns    []string    `yaml:"patterns"`
+}
+
+// SizeRule limits the size of files matching Patterns, or of all files at or
+// below the rules file if there are none.
+type SizeRule struct {
+    Size        int64
+    Patterns    []string
+}
+
+func (r *SizeRule) UnmarshalYAML(node *yaml.Node) error {
+    raw := struct {
+        Size        string        `yaml:"size"`
+        Patterns    []string    `yaml:"patterns"`
+    }{}
+    if err := node.Decode(&raw); err != nil {
+        return err
+    }
+    size, err := parseSize(raw.Size)
+    if err != nil {
+        return err
+    }
+    r.Size, r.Patterns = size, raw.Patterns
+    return nil
+}
+
+// parseClient reads an IP address or a CIDR range.
+func parseClient(value string) (netip.Prefix, error) {
+    if strings.Contains(value, "/") {
+        prefix, err := netip.ParsePrefix(value)
+        return prefix.Masked(), err
+    }
+    addr, err := netip.ParseAddr(value)
+    if err != nil {
+        return netip.Prefix{}, err
+    }
+    addr = addr.Unmap()
+    return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseTime reads a point in time given as RFC 3339 or as a local date with
+// an optional time of day.
+func parseTime(value string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    for _, layout := range []string{ "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02" } {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, errors.New("invalid time " + value)
+}
+
+func (item *RuleItem) accepts(client netip.Addr) bool {
+    if item.Clients == nil {
+        return true
+    }
+    for _, prefix := range item.Clients {
+        if prefix.Contains(client) {
+            return true
+        }
+    }
+    return false
+}
+
+func (item *RuleItem) timed() bool {
+    return !item.From.IsZero() || !item.Until.IsZero() || item.Schedule != nil
+}
+
+func (item *RuleItem) active(now time.Time) bool {
+    if !item.From.IsZero() && now.Before(item.From) || !item.Until.IsZero() && !now.Before(item.Until) {
+        return false
+    }
+    return item.Schedule == nil || item.Schedule.Match(now)
+}
+
+// next returns when the item starts or stops applying after now, or the
+// zero time if it never does.
+func (item *RuleItem) next(now time.Time) time.Time {
+    if !item.From.IsZero() && now.Before(item.From) {
+        return item.From
+    }
+    if !item.Until.IsZero() && !now.Before(item.Until) {
+        return time.Time{}
+    }
+    next := time.Time{}
+    if item.Schedule != nil {
+        next = item.Schedule.Next(now)
+    }
+    return earlier(next, item.Until)
+}
+
+// earlier returns the earlier of two times, where zero means never.
+func earlier(a time.Time, b time.Time) time.Time {
+    if a.IsZero() || !b.IsZero() && b.Before(a) {
+        return b
+    }
+    return a
+}
+
+// Match returns the first item matching name that applies to the client,
+// whose address is invalid if unknown, at time now, or nil if there is none.
+// It also returns the earliest time at which a timed item up to the one
+// found changes, which is when the result may change, or zero if it cannot.
+func (r *Rules) Match(name string, client netip.Addr, now time.Time) (*RuleItem, time.Time) {
+    next := time.Time{}
+    for i := range *r {
+        item := &(*r)[i]
+        if !item.accepts(client) || !item.matches(name) {
+            continue
+        }
+        if item.timed() {
+            next = earlier(next, item.next(now))
+            if !item.active(now) {
+                continue
             }
         }
+        return item, next
     }
-    return Flags.Find("undefined")
+    return nil, next
+}
+
+func (item *RuleItem) matches(name string) bool {
+    for _, mode := range item.Modes {
+        if matched, _ := filepath.Match(mode, name); matched {
+            return true
+        }
+    }
+    return false
 }
 
 type Effect struct {
     Definition    string    `json:"definition"`
     Direct        bool    `json:"direct"`
     Cause        string    `json:"cause"`
+    Next        *time.Time    `json:"next"` // When the flag may change, nil if never.
+    Policy        bool    `json:"policy"` // Definition is a section of the central policy.
+}
+
+func effectOf(item *RuleItem, p *Tree, direct bool, cause string, next *time.Time) *Effect {
+    effect := &Effect{
+        Definition: filepath.Join(p.RelPath(p.Root()), p.rulesFile()),
+        Direct: direct,
+        Cause: cause,
+        Next: next,
+        Policy: item.Policy,
+    }
+    if item.Policy {
+        effect.Definition = p.RelPath(p.Root())
+    }
+    return effect
+}
+
+var (
+    ErrNotFound = errors.New("not found")
+    ErrForbidden = errors.New("forbidden")
+)
+
+// LocateError reports the path segment at which resolution failed.
+type LocateError struct {
+    Segment    string
+    Path    []string // The path down to Segment.
+    Err        error
+    Effect    *Effect // Where the flag denying access was defined, if ErrForbidden.
+}
+
+func (e *LocateError) Error() string {
+    return e.Segment + ": " + e.Err.Error()
+}
+
+func (e *LocateError) Unwrap() error {
+    return e.Err
 }
 
 type Tree struct {
     prev    *Tree
+    origin    *Tree // The cached tree this is a view of, nil if not a view.
+    client    netip.Addr // The client rules are evaluated for, invalid if unknown.
+    mu        *sync.Mutex // Guards cache and rules, shared with views.
     cache    map[string]*Tree
     Path    string // Absolute path for root, folder name for subtree.
-    Rules    Rules
+    rules    *RuleSet
+    reserved    map[string]bool // Names owned by the server, root only.
+    storage    Storage // Root only.
+    mounts    map[string]*Mount // Entries of a namespace by name, root only.
 }
 
+// CreateTree opens the directory at path on the local disk.
 func CreateTree(path string) *Tree {
-    if stat, err := os.Stat(path); err != nil || !stat.IsDir() {
+    path, _ = filepath.Abs(path)
+    return CreateTreeOn(OSStorage, path)
+}
+
+// CreateTreeOn opens the directory at path in the given storage.
+func CreateTreeOn(storage Storage, path string) *Tree {
+    if stat, err := storage.Stat(path); err != nil || !stat.IsDir() {
         return nil
     }
     tree := &Tree{
         prev: nil,
+        mu: &sync.Mutex{},
         cache: map[string]*Tree {},
         Path: path,
-        Rules: nil,
+        reserved: map[string]bool{},
+        storage: storage,
     }
     tree.loadRules()
     return tree
 }
 
+// Storage returns where the entries of the tree are kept.
+func (t *Tree) Storage() Storage {
+    return t.Root().storage
+}
+
+// Reserve hides name at the root, or at every mount of a namespace, from
+// clients regardless of rules and ShowHidden. It must be called before the
+// tree is served.
+func (t *Tree) Reserve(name string) {
+    t.Root().reserved[name] = true
+}
+
+// Reserved reports whether the entry name of t is owned by the server: the
+// names reserved at the root and the rules files of every directory.
+// Clients can neither see nor touch those, whatever the rules say. At the
+// root of a namespace only the mounts exist.
+func (t *Tree) Reserved(name string) bool {
+    if t.Virtual() {
+        return t.mounts[name] == nil
+    }
+    return t.anchored() && t.Root().reserved[name] || strings.EqualFold(name, t.rulesFile())
+}
+
+// Virtual reports whether t is the root of a namespace, which has no
+// directory of its own.
+func (t *Tree) Virtual() bool {
+    return t.IsRoot() && t.mounts != nil
+}
+
+// anchored reports whether t is where reserved names live: the root, or a
+// mount of a namespace.
+func (t *Tree) anchored() bool {
+    if t.IsRoot() {
+        return t.mounts == nil
+    }
+    return t.prev.Virtual()
+}
+
+// mount returns the mount t is in, or nil outside of a namespace.
+func (t *Tree) mount() *Mount {
+    for p := t; !p.IsRoot(); p = p.prev {
+        if p.prev.IsRoot() {
+            return p.prev.mounts[p.Path]
+        }
+    }
+    return nil
+}
+
+// rulesFile is the name of the rules files of t.
+func (t *Tree) rulesFile() string {
+    if m := t.mount(); m != nil {
+        return m.RulesFile
+    }
+    return cfg().Tree.RulesFile
+}
+
+// defaultFlag is the flag of the entry name of t when no rule applies. The
+// mounts of a namespace have their own.
+func (t *Tree) defaultFlag(name string) uint16 {
+    m := t.mount()
+    if t.Virtual() {
+        m = t.mounts[name]
+    }
+    if m != nil {
+        return Flags.Find(m.DefaultFlag)
+    }
+    return Flags.Find(cfg().Tree.DefaultFlag)
+}
+
+// Anchors returns the directories that data kept next to the entries goes
+// into: the root, or every mount of a namespace.
+func (t *Tree) Anchors() []string {
+    root := t.Root()
+    if root.mounts == nil {
+        return []string{ root.Path }
+    }
+    anchors := []string{}
+    for _, m := range root.mounts {
+        anchors = append(anchors, m.Path)
+    }
+    slices.Sort(anchors)
+    return anchors
+}
+
+// AnchorOf returns the anchor the entry named by parts is kept under, or ""
+// if there is none.
+func (t *Tree) AnchorOf(parts []string) string {
+    root := t.Root()
+    if root.mounts == nil {
+        return root.Path
+    }
+    if len(parts) > 0 {
+        if m := root.mounts[parts[0]]; m != nil {
+            return m.Path
+        }
+    }
+    return ""
+}
+
+// Hidden reports whether the entry name of t must not be shown to clients.
+func (t *Tree) Hidden(name string) bool {
+    if t.Reserved(name) {
+        return true
+    }
+    return !cfg().Tree.ShowHidden && t.PermsOf(name) & PermList == 0
+}
+
 func (t *Tree) IsRoot() bool {
     return t.prev == nil
 }
@@ -81,38 +405,235 @@ func (t *Tree) Root() *Tree {
     return p
 }
 
+// For returns a view of t that evaluates rules for the client at addr.
+// Views share the cache of t, and the subtrees reached from a view are views
+// for the same client.
+func (t *Tree) For(addr netip.Addr) *Tree {
+    t.mu.Lock()
+    view := *t
+    t.mu.Unlock()
+    view.origin, view.client = t.base(), addr.Unmap()
+    return &view
+}
+
+// base returns the cached tree t is a view of, or t itself. Rules are read
+// from it, since those of a view are not reloaded.
+func (t *Tree) base() *Tree {
+    if t.origin != nil {
+        return t.origin
+    }
+    return t
+}
+
 func (t *Tree) Next(name string) *Tree {
-    for namecache, treecache := range t.cache {
-        if namecache == name {
-            return treecache
+    // Visibility depends on the client, so cached subtrees are checked too.
+    if t.Hidden(name) {
+        return nil
+    }
+    b := t.base()
+    b.mu.Lock()
+    tree, ok := b.cache[name]
+    b.mu.Unlock()
+    if ok {
+        metrics.treeHits.Add(1)
+    } else {
+        metrics.treeMisses.Add(1)
+        if stat, err := b.Storage().Stat(b.Location(name)); err != nil || !stat.IsDir() {
+            return nil
+        }
+        tree = &Tree{
+            prev: b,
+            mu: &sync.Mutex{},
+            cache: map[string]*Tree {},
+            Path: name,
+        }
+        tree.loadRules()
+        if cfg().Tree.CachePolicy != "never" {
+            b.mu.Lock()
+            b.cache[name] = tree
+            b.mu.Unlock()
         }
     }
-    if stat, err := os.Stat(filepath.Join(t.AbsPath(), name)); err != nil || !stat.IsDir() {
-        return nil
+    if t.origin != nil {
+        return tree.For(t.client)
     }
-    if flag, _ := t.FlagOf(name); flag <= Flags.Find("invisible") && !cfg().Tree.ShowHidden {
-        return nil
+    return tree
+}
+
+// Walk descends into the directories named by parts. On failure it returns
+// nil and the first segment that could not be entered.
+func (t *Tree) Walk(parts []string) (*Tree, string) {
+    t, i := t.walk(parts)
+    if t == nil {
+        return nil, parts[i]
     }
-    tree := &Tree{
-        prev: t,
-        cache: map[string]*Tree {},
-        Path: name,
-        Rules: nil,
+    return t, ""
+}
+
+// Enter is Walk failing with a LocateError.
+func (t *Tree) Enter(parts []string) (*Tree, error) {
+    t, i := t.walk(parts)
+    if t == nil {
+        return nil, &LocateError{ Segment: parts[i], Path: parts[:i+1], Err: ErrNotFound }
     }
-    tree.loadRules()
-    if cfg().Tree.CachePolicy != "never" {
-        t.cache[name] = tree
+    return t, nil
+}
+
+// walk is Walk returning the index of the segment that could not be entered.
+func (t *Tree) walk(parts []string) (*Tree, int) {
+    for i, segment := range parts {
+        t = t.Next(segment)
+        if t == nil {
+            return nil, i
+        }
     }
-    return tree
+    return t, -1
+}
+
+// Locate resolves the file named by parts and checks that it grants the
+// permission bits in need. Writing to a missing file creates it, which takes
+// PermCreate instead of PermWrite. It returns the containing tree and the
+// absolute location of the file.
+func (t *Tree) Locate(parts []string, need uint16, checkExists bool) (*Tree, string, error) {
+    if len(parts) == 0 {
+        return nil, "", &LocateError{ Segment: "", Err: ErrNotFound }
+    }
+    name := parts[len(parts)-1]
+    t, err := t.Enter(parts[:len(parts)-1])
+    if err != nil {
+        return nil, "", err
+    }
+    if t.Reserved(name) || checkExists && t.Hidden(name) {
+        return nil, "", &LocateError{ Segment: name, Path: parts, Err: ErrNotFound }
+    }
+    loc := t.Location(name)
+    _, err = t.Storage().Stat(loc)
+    if need & PermWrite != 0 && err != nil {
+        need = need &^ PermWrite | PermCreate
+    }
+    if flag, effect := t.FlagOf(name); t.permsOf(name, flag, effect) & need != need {
+        return nil, "", &LocateError{ Segment: name, Path: parts, Err: ErrForbidden, Effect: effect }
+    } else if checkExists && err != nil {
+        return nil, "", &LocateError{ Segment: name, Path: parts, Err: ErrNotFound }
+    }
+    return t, loc, nil
+}
+
+var ErrInvalidRules = errors.New("invalid rules")
+
+// RulesFileOf returns the location of the rules file of the directory named
+// by parts. It bypasses the rules and is meant for administration only.
+func (t *Tree) RulesFileOf(parts []string) (string, error) {
+    root := t.Root()
+    dir, name := root.AbsPath(), cfg().Tree.RulesFile
+    if root.mounts != nil {
+        // The root of a namespace has no rules file.
+        if len(parts) == 0 || root.mounts[parts[0]] == nil {
+            return "", ErrNotFound
+        }
+        m := root.mounts[parts[0]]
+        dir, name, parts = m.Path, m.RulesFile, parts[1:]
+    }
+    dir = filepath.Join(append([]string{ dir }, parts...)...)
+    if stat, err := t.Storage().Stat(dir); err != nil || !stat.IsDir() {
+        return "", ErrNotFound
+    }
+    return filepath.Join(dir, name), nil
+}
+
+// maxRulesSize is how large a rules file written through SetRules may be.
+const maxRulesSize = 1 << 20
+
+// SetRules replaces the rules file of the directory named by parts, or
+// removes it if data is nil, and reloads the rules of the directory if it is
+// cached. Like RulesFileOf it is meant for administration only.
+func (t *Tree) SetRules(parts []string, data []byte) error {
+    loc, err := t.RulesFileOf(parts)
+    if err != nil {
+        return err
+    }
+    if data == nil {
+        if err := t.Storage().Remove(loc); err != nil && !errors.Is(err, fs.ErrNotExist) {
+            return err
+        }
+    } else {
+        nodes := map[string]yaml.Node {}
+        if err := yaml.Unmarshal(data, &nodes); err != nil {
+            return fmt.Errorf("%w: %v", ErrInvalidRules, err)
+        }
+        if err := writeFile(t.Storage(), loc, data); err != nil {
+            return err
+        }
+    }
+    // Only cached subtrees hold rules to refresh, others load them on use.
+    p := t.Root().base()
+    for _, segment := range parts {
+        p.mu.Lock()
+        next := p.cache[segment]
+        p.mu.Unlock()
+        if next == nil {
+            return nil
+        }
+        p = next
+    }
+    p.loadRules()
+    return nil
 }
 
 func (t *Tree) Reload() {
+    t = t.base()
     t.loadRules()
+    t.mu.Lock()
+    defer t.mu.Unlock()
     for _, tree := range t.cache {
         tree.loadRules()
     }
 }
 
+// MaxSizeOf returns the largest size allowed for the entry name of t, or 0
+// if there is no limit. The nearest rules file with a matching rule decides.
+func (t *Tree) MaxSizeOf(name string) int64 {
+    t = t.base()
+    for p := t; p != nil; p = p.prev {
+        rel := filepath.Join(t.RelPath(p), name)
+        for _, rule := range p.ruleSet().MaxSizes {
+            if len(rule.Patterns) == 0 {
+                return rule.Size
+            }
+            for _, pattern := range rule.Patterns {
+                if matched, _ := filepath.Match(pattern, rel); matched {
+                    return rule.Size
+                }
+            }
+        }
+    }
+    return 0
+}
+
+// Parts returns the path segments leading from the root to t.
+func (t *Tree) Parts() []string {
+    parts := []string{}
+    for p := t; !p.IsRoot(); p = p.prev {
+        parts = append([]string{ p.Path }, parts...)
+    }
+    return parts
+}
+
+// CacheSize counts the subtrees cached below t.
+func (t *Tree) CacheSize() int {
+    t.mu.Lock()
+    children := make([]*Tree, 0, len(t.cache))
+    for _, tree := range t.cache {
+        children = append(children, tree)
+    }
+    t.mu.Unlock()
+    size := len(children)
+    for _, tree := range children {
+        size += tree.CacheSize()
+    }
+    return size
+}
+
 func (t *Tree) RelPath(to *Tree) string {
     s := ""
     for p := t; p != to; p = p.prev {
@@ -122,78 +643,302 @@ func (t *Tree) RelPath(to *Tree) string {
 }
 
 func (t *Tree) AbsPath() string {
-    return filepath.Join(t.Root().Path, t.RelPath(t.Root()))
+    if t.IsRoot() {
+        return t.Path
+    }
+    return t.prev.Location(t.Path)
 }
 
+// Location returns where the entry name of t is kept in the storage.
+func (t *Tree) Location(name string) string {
+    if m := t.mounts[name]; m != nil {
+        return m.Path
+    }
+    return filepath.Join(t.AbsPath(), name)
+}
+
+// loadRules reads the rules file of t and merges in the section of the
+// central policy, or only uses the latter if the policy replaces rules files.
 func (t *Tree) loadRules() {
-    rulesfile := filepath.Join(t.AbsPath(), cfg().Tree.RulesFile)
-    rulesbin, err := os.ReadFile(rulesfile)
-    if err != nil { return }
-    rules := map[string]([]string) {}
-    yaml.Unmarshal(rulesbin, &rules)
-    for flag, modes := range rules {
-        if ok, flagvalue := Flags.TryFind(flag); ok {
-            t.Rules = append(t.Rules, RuleItem{ Flag: flagvalue, Modes: modes })
+    set := RuleSet{}
+    if policy == nil || cfg().Tree.PolicyMode != "replace" {
+        rulesfile := filepath.Join(t.AbsPath(), t.rulesFile())
+        if rulesbin, err := readFile(t.Storage(), rulesfile); err == nil {
+            metrics.rulesLoads.Add(1)
+            nodes := map[string]yaml.Node {}
+            yaml.Unmarshal(rulesbin, &nodes)
+            set = parseRules(nodes)
         }
     }
+    if policy != nil {
+        if section := policy.Section(t.RelPath(t.Root())); section != nil {
+            set = section.merge(set)
+        }
+    }
+    t.mu.Lock()
+    t.rules = &set
+    t.mu.Unlock()
+}
+
+// ruleSet returns what the rules of t define. Reloading replaces the set
+// rather than changing it, so it may be read without holding the lock.
+func (t *Tree) ruleSet() *RuleSet {
+    t = t.base()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.rules
+}
+
+// merge combines the rules of a policy section with those of a rules file,
+// the former taking precedence.
+func (r *RuleSet) merge(file RuleSet) RuleSet {
+    quota := r.Quota
+    if quota == 0 {
+        quota = file.Quota
+    }
+    return RuleSet{
+        Rules: append(slices.Clip(r.Rules), file.Rules...),
+        Versions: append(slices.Clip(r.Versions), file.Versions...),
+        MaxSizes: append(slices.Clip(r.MaxSizes), file.MaxSizes...),
+        Quota: quota,
+        Types: append(slices.Clip(r.Types), file.Types...),
+    }
+}
+
+func parseRules(nodes map[string]yaml.Node) RuleSet {
+    rules := Rules{}
+    scoped := Rules{}
+    versions := []VersionRule{}
+    sizes := []SizeRule{}
+    quota := int64(0)
+    types := []TypeRule{}
+    for key, node := range nodes {
+        if key == "versions" {
+            // Either a single rule or a list of them.
+            if node.Kind == yaml.SequenceNode {
+                node.Decode(&versions)
+            } else {
+                rule := VersionRule{}
+                if node.Decode(&rule) == nil {
+                    versions = append(versions, rule)
+                }
+            }
+            continue
+        }
+        if key == "max_size" {
+            // A size for all files, a single rule or a list of them.
+            switch node.Kind {
+            case yaml.ScalarNode:
+                if size, err := parseSize(node.Value); err == nil {
+                    sizes = append(sizes, SizeRule{ Size: size })
+                }
+            case yaml.SequenceNode:
+                node.Decode(&sizes)
+            default:
+                rule := SizeRule{}
+                if node.Decode(&rule) == nil {
+                    sizes = append(sizes, rule)
+                }
+            }
+            continue
+        }
+        if key == "quota" {
+            quota, _ = parseSize(node.Value)
+            continue
+        }
+        if key == "types" {
+            // Either a single rule or a list of them.
+            if node.Kind == yaml.SequenceNode {
+                node.Decode(&types)
+            } else {
+                rule := TypeRule{}
+                if node.Decode(&rule) == nil {
+                    types = append(types, rule)
+                }
+            }
+            continue
+        }
+        ok, flagvalue := Flags.TryFind(key)
+        items := []yaml.Node{}
+        if !ok || node.Decode(&items) != nil {
+            continue
+        }
+        modes := []string{}
+        for _, item := range items {
+            if item.Kind == yaml.ScalarNode {
+                modes = append(modes, item.Value)
+                continue
+            }
+            // Patterns applying to some clients or at some times only.
+            raw := struct {
+                Patterns    []string    `yaml:"patterns"`
+                Clients        []string    `yaml:"clients"`
+                From        string        `yaml:"from"`
+                Until        string        `yaml:"until"`
+                Schedule    string        `yaml:"schedule"`
+            }{}
+            if item.Decode(&raw) != nil {
+                continue
+            }
+            rule := RuleItem{ Flag: flagvalue, Modes: raw.Patterns }
+            if raw.Clients != nil {
+                rule.Clients = []netip.Prefix{}
+            }
+            for _, value := range raw.Clients {
+                if prefix, err := parseClient(value); err == nil {
+                    rule.Clients = append(rule.Clients, prefix)
+                }
+            }
+            // Items with an unreadable time never apply rather than always.
+            var err error
+            if raw.From != "" {
+                if rule.From, err = parseTime(raw.From); err != nil {
+                    continue
+                }
+            }
+            if raw.Until != "" {
+                if rule.Until, err = parseTime(raw.Until); err != nil {
+                    continue
+                }
+            }
+            if raw.Schedule != "" {
+                if rule.Schedule, err = ParseSchedule(raw.Schedule); err != nil {
+                    continue
+                }
+            }
+            scoped = append(scoped, rule)
+        }
+        rules = append(rules, RuleItem{ Flag: flagvalue, Modes: modes })
+    }
+    // Conditional items take precedence over those applying always.
+    rules = append(scoped, rules...)
+    return RuleSet{ Rules: rules, Versions: versions, MaxSizes: sizes, Quota: quota, Types: types }
 }
 
+// FlagOf returns the flag of the entry name of t, as evaluated for the client
+// of t at the current time, and where it was defined.
 func (t *Tree) FlagOf(name string) (uint16, *Effect) {
+    client, now, next := t.client, time.Now(), time.Time{}
+    var changes *time.Time
+    t = t.base()
     for p := t; p != nil; p = p.prev {
-        if mode := p.Rules.FlagOf(filepath.Join(t.RelPath(p), name)); mode != Flags.Find("undefined") {
-            return mode, &Effect{
-                Definition: filepath.Join(p.RelPath(p.Root()), cfg().Tree.RulesFile),
-                Direct: true,
-                Cause: "",
-            }
+        item, n := p.ruleSet().Rules.Match(filepath.Join(t.RelPath(p), name), client, now)
+        if next = earlier(next, n); !next.IsZero() {
+            changes = &next
+        }
+        if item != nil && item.Flag != Flags.Find("undefined") {
+            return item.Flag, effectOf(item, p, true, "", changes)
         }
     }
     for p := t; !p.IsRoot(); p = p.prev {
         for q := p.prev; q != nil; q = q.prev {
-            if mode := q.Rules.FlagOf(filepath.Join(p.prev.RelPath(q), p.Path)); mode != Flags.Find("undefined") {
-                return mode, &Effect{
-                    Definition: filepath.Join(q.RelPath(q.Root()), cfg().Tree.RulesFile),
-                    Direct: false,
-                    Cause: p.RelPath(p.Root()),
+            item, n := q.ruleSet().Rules.Match(filepath.Join(p.prev.RelPath(q), p.Path), client, now)
+            if next = earlier(next, n); !next.IsZero() {
+                changes = &next
+            }
+            if item != nil && item.Flag != Flags.Find("undefined") {
+                return item.Flag, effectOf(item, q, false, p.RelPath(p.Root()), changes)
+            }
+        }
+    }
+    return t.defaultFlag(name), nil
+}
+
+// PermsOf returns the permission bits of the entry name of t.
+func (t *Tree) PermsOf(name string) uint16 {
+    flag, effect := t.FlagOf(name)
+    return t.permsOf(name, flag, effect)
+}
+
+// permsOf returns the permission bits granted by flag to the entry name of
+// t. Rules files get none, since they decide what clients may do, nothing
+// can be changed on a read-only storage, and mounts stay where they are.
+func (t *Tree) permsOf(name string, flag uint16, effect *Effect) uint16 {
+    if strings.EqualFold(name, t.rulesFile()) {
+        return 0
+    }
+    perms := flagPerms[flag]
+    if flag == Flags.Find("dropbox") && (effect == nil || effect.Direct) {
+        // Directories can be listed, showing none of their entries, while
+        // files can only be created.
+        perms = PermCreate
+        if info, err := t.Storage().Stat(t.Location(name)); err == nil && info.IsDir() {
+            perms |= PermList
+        }
+    }
+    if t.Storage().ReadOnly() || t.Virtual() {
+        perms &= PermList | PermRead
+    }
+    return perms
+}
+
+// VersionsOf returns how many previous versions of the file name are kept,
+// as set by the nearest rules file with a matching pattern.
+func (t *Tree) VersionsOf(name string) int {
+    t = t.base()
+    for p := t; p != nil; p = p.prev {
+        rel := filepath.Join(t.RelPath(p), name)
+        for _, rule := range p.ruleSet().Versions {
+            for _, pattern := range rule.Patterns {
+                if matched, _ := filepath.Match(pattern, rel); matched {
+                    return rule.Keep
                 }
             }
         }
     }
-    return Flags.Find(cfg().Tree.DefaultFlag), nil
+    return 0
+}
+
+// ScanError reports an entry whose metadata could not be read.
+type ScanError struct {
+    Name    string    `json:"name"`
+    Error    string    `json:"error"`
 }
 
-func (t *Tree) Scan() ([]FileItem, []DirItem, error) {
-    entries, err := os.ReadDir(t.AbsPath())
+// Scan lists the visible entries of the directory. Entries that cannot be
+// inspected are reported individually instead of failing the whole scan.
+// File associations are left for the caller to fill in.
+func (t *Tree) Scan() ([]FileItem, []DirItem, []ScanError, error) {
+    entries, err := t.Storage().ReadDir(t.AbsPath())
     if err != nil {
-        return nil, nil, err
+        return nil, nil, nil, err
     }
     files := []FileItem{}
     dirs := []DirItem{}
+    errs := []ScanError{}
     for _, entry := range entries {
+        if t.Hidden(entry.Name()) { continue }
+        flag, effect := t.FlagOf(entry.Name())
+        perms := t.permsOf(entry.Name(), flag, effect)
         info, err := entry.Info()
         if err != nil {
-            return nil, nil, err
+            // Do not leak the absolute path of the root to clients.
+            var perr *fs.PathError
+            if errors.As(err, &perr) {
+                err = perr.Err
+            }
+            errs = append(errs, ScanError{ Name: entry.Name(), Error: err.Error() })
+            continue
         }
-        flag, effect := t.FlagOf(entry.Name())
-        if !cfg().Tree.ShowHidden && flag <= Flags.Find("invisible") { continue }
         if entry.IsDir() {
             dirs = append(dirs, DirItem{
                 Name: entry.Name(),
                 Time: info.ModTime(),
                 Flag: flag,
+                Perms: perms,
                 Effect: effect,
             })
         } else {
-            assoc, _ := GetAssoc(entry.Name())
             files = append(files, FileItem{
                 Name: entry.Name(),
                 Size: info.Size(),
                 Time: info.ModTime(),
-                Assoc: &assoc.Name,
+                ETag: fileETag(info),
                 Flag: flag,
+                Perms: perms,
                 Effect: effect,
             })
         }
     }
-    return files, dirs, nil
+    return files, dirs, errs, nil
 }
\ No newline at end of file
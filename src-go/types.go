@@ -0,0 +1,174 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "path"
+    "path/filepath"
+    "slices"
+    "strings"
+)
+
+// TypeRule restricts the types of files matching Patterns, or of all files at
+// or below the rules file if there are none, that may be written. Types are
+// extensions like .exe or MIME types like image/*.
+type TypeRule struct {
+    Allow        []string    `yaml:"allow"`
+    Deny        []string    `yaml:"deny"`
+    Patterns    []string    `yaml:"patterns"`
+}
+
+// TypeError rejects a write for the type of the file.
+type TypeError struct {
+    Reason    string // denied or not_allowed.
+    Type    string // The type that was denied or not allowed.
+}
+
+func (e *TypeError) Error() string {
+    if e.Reason == "denied" {
+        return fmt.Sprintf("files of type %s are denied here", e.Type)
+    }
+    return fmt.Sprintf("files of type %s are not allowed here", e.Type)
+}
+
+// mediaType strips the parameters from a MIME type.
+func mediaType(value string) string {
+    value, _, _ = strings.Cut(value, ";")
+    return strings.TrimSpace(value)
+}
+
+// sniffFile detects the MIME type of the file at loc in st from its first
+// bytes, returning an empty string for directories and unreadable files.
+func sniffFile(st Storage, loc string) string {
+    fp, err := st.Open(loc)
+    if err != nil {
+        return ""
+    }
+    defer fp.Close()
+    head := make([]byte, 512)
+    n, err := io.ReadFull(fp, head)
+    if err != nil && n == 0 {
+        return ""
+    }
+    return mediaType(http.DetectContentType(head[:n]))
+}
+
+// typeMatches tells whether the entry of a rule covers a file with extension
+// ext and MIME type mimeType.
+func typeMatches(entry string, ext string, mimeType string) bool {
+    if strings.HasPrefix(entry, ".") {
+        return strings.EqualFold(entry, ext)
+    }
+    matched, _ := path.Match(strings.ToLower(entry), mimeType)
+    return mimeType != "" && matched
+}
+
+// check applies the rule to a file. The MIME type guessed from the extension
+// is used until the content has been sniffed, which then prevails for allow
+// lists while deny lists reject either.
+func (r *TypeRule) check(ext string, sniffed string) error {
+    byExt := mediaType(mime.TypeByExtension(ext))
+    for _, entry := range r.Deny {
+        if typeMatches(entry, ext, byExt) || sniffed != "" && typeMatches(entry, ext, sniffed) {
+            return &TypeError{ Reason: "denied", Type: entry }
+        }
+    }
+    if len(r.Allow) == 0 {
+        return nil
+    }
+    actual := byExt
+    if sniffed != "" {
+        actual = sniffed
+    }
+    for _, entry := range r.Allow {
+        if typeMatches(entry, ext, actual) {
+            return nil
+        }
+    }
+    if strings.HasPrefix(r.Allow[0], ".") || actual == "" {
+        return &TypeError{ Reason: "not_allowed", Type: ext }
+    }
+    return &TypeError{ Reason: "not_allowed", Type: actual }
+}
+
+// typeParent returns the deepest existing directory on the way to the path
+// named by parts, whose rules and those above it apply there, and the path
+// relative to it. Directories yet to be created have no rules of their own.
+func (t *Tree) typeParent(parts []string) (*Tree, string) {
+    dirs := parts[:len(parts)-1]
+    parent, i := t.walk(dirs)
+    if parent == nil {
+        if parent, _ = t.walk(dirs[:i]); parent == nil {
+            return nil, ""
+        }
+        return parent.base(), filepath.Join(parts[i:]...)
+    }
+    return parent.base(), parts[len(parts)-1]
+}
+
+// CheckType tells whether a file may be written to the path named by parts.
+// The first matching rule of every rules file on the way must accept it, so
+// that a type denied at the root is denied everywhere. sniffed is the MIME
+// type of the content if known.
+func (t *Tree) CheckType(parts []string, sniffed string) error {
+    if len(parts) == 0 {
+        return nil
+    }
+    parent, name := t.typeParent(parts)
+    if parent == nil {
+        return nil
+    }
+    ext := strings.ToLower(filepath.Ext(name))
+    for p := parent; p != nil; p = p.prev {
+        rel := filepath.Join(parent.RelPath(p), name)
+        for _, rule := range p.ruleSet().Types {
+            matched := len(rule.Patterns) == 0
+            for _, pattern := range rule.Patterns {
+                if ok, _ := filepath.Match(pattern, rel); ok {
+                    matched = true
+                    break
+                }
+            }
+            if matched {
+                if err := rule.check(ext, sniffed); err != nil {
+                    return err
+                }
+                break
+            }
+        }
+    }
+    return nil
+}
+
+// CheckTypeOf tells whether the entry at loc may be moved or copied to the
+// path named by parts. Every file below a directory is checked at the path
+// it would end up at, unless no type rules apply there.
+func (t *Tree) CheckTypeOf(parts []string, loc string) error {
+    info, err := t.Storage().Stat(loc)
+    if err != nil || len(parts) == 0 {
+        return nil
+    }
+    if !info.IsDir() {
+        return t.CheckType(parts, sniffFile(t.Storage(), loc))
+    }
+    parent, _ := t.typeParent(parts)
+    typed := false
+    for p := parent; p != nil && !typed; p = p.prev {
+        typed = len(p.ruleSet().Types) > 0
+    }
+    if !typed {
+        return nil
+    }
+    entries, err := t.Storage().ReadDir(loc)
+    if err != nil {
+        return err
+    }
+    for _, entry := range entries {
+        if err := t.CheckTypeOf(append(slices.Clip(parts), entry.Name()), filepath.Join(loc, entry.Name())); err != nil {
+            return err
+        }
+    }
+    return nil
+}
\ No newline at end of file
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "errors"
+    "path/filepath"
+    "testing"
+)
+
+func TestCheckTypeOfDirectory(t *testing.T) {
+    root := t.TempDir()
+    writeFiles(t, root, map[string]string{
+        "photos/.rules.yml": "types:\n  deny: [\".exe\"]\n",
+        "bin/tools/setup.exe": "MZ",
+        "pics/a.txt": "text",
+    })
+    useConfig(t, func(c *Config) { c.Tree.DefaultFlag = "readwrite" })
+    tree := CreateTree(root)
+
+    var terr *TypeError
+    err := tree.CheckTypeOf([]string{ "photos", "bin" }, filepath.Join(root, "bin"))
+    if !errors.As(err, &terr) || terr.Reason != "denied" || terr.Type != ".exe" {
+        t.Fatalf("moving a folder of executables: %v", err)
+    }
+    if err := tree.CheckTypeOf([]string{ "photos", "pics" }, filepath.Join(root, "pics")); err != nil {
+        t.Fatalf("moving a folder of text: %v", err)
+    }
+    if err := tree.CheckTypeOf([]string{ "elsewhere" }, filepath.Join(root, "bin")); err != nil {
+        t.Fatalf("moving outside the rule: %v", err)
+    }
+}
\ No newline at end of file
@@ -2,14 +2,19 @@ package main
 
 import (
     "encoding/binary"
+    "errors"
     "fmt"
     "hash/adler32"
+    "io/fs"
     "net"
     "os"
+    "path"
+    "strings"
     "syscall"
     "unsafe"
 
     "github.com/gonutz/w32"
+    "golang.org/x/sys/windows"
 )
 
 type U16Enum []string
@@ -40,6 +45,26 @@ func Hash(name string) string {
     return fmt.Sprintf("%.8x", adler32.Checksum([]byte(name)));
 }
 
+// fsError converts tree resolution errors to their io/fs counterparts.
+func fsError(err error) error {
+    switch {
+    case errors.Is(err, ErrNotFound):
+        return fs.ErrNotExist
+    case errors.Is(err, ErrForbidden):
+        return fs.ErrPermission
+    }
+    return err
+}
+
+// splitPath splits a slash-separated path into its segments.
+func splitPath(name string) []string {
+    name = strings.Trim(path.Clean("/" + name), "/")
+    if name == "" {
+        return nil
+    }
+    return strings.Split(name, "/")
+}
+
 func getIP() string {
     dial, err := net.Dial("udp", "8.8.8.8:domain")
     if err != nil {
@@ -194,3 +219,28 @@ func saveIconToFile(hIcon w32.HICON, filePath string) error {
     return nil
 }
 
+
+
+// freeSpace returns the bytes available to the user on the disk holding dir.
+func freeSpace(dir string) (uint64, error) {
+    name, err := windows.UTF16PtrFromString(dir)
+    if err != nil {
+        return 0, err
+    }
+    var free uint64
+    if err := windows.GetDiskFreeSpaceEx(name, &free, nil, nil); err != nil {
+        return 0, err
+    }
+    return free, nil
+}
+
+// isCrossDevice reports whether a rename failed because the locations are
+// on different volumes.
+func isCrossDevice(err error) bool {
+    return errors.Is(err, windows.ERROR_NOT_SAME_DEVICE)
+}
+
+// isDiskFull reports whether a write failed because the volume is full.
+func isDiskFull(err error) bool {
+    return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL) || errors.Is(err, syscall.ENOSPC)
+}
\ No newline at end of file
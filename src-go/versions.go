@@ -0,0 +1,197 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "os"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const versionsName = ".sagasu-versions"
+
+type Version struct {
+    ID        string        `json:"id"`
+    Size    int64        `json:"size"`
+    Time    time.Time    `json:"time"` // Modification time of the content.
+    Saved    time.Time    `json:"saved"` // When the content was replaced.
+}
+
+// RollbackRequest is the body of /rollback.
+type RollbackRequest struct {
+    Path    []string    `json:"path"`
+    ID        string        `json:"id"`
+    IfMatch    string    `json:"ifMatch"`
+    IfNoneMatch    string    `json:"ifNoneMatch"`
+    LockToken    string    `json:"lockToken"`
+}
+
+// Versions stores previous contents of files whose rules ask for a history.
+// The versions of a file live in a directory named after the hash of its
+// path, each one named by the time it was replaced, below the root or the
+// mount of a namespace holding the file, which is only created when a file
+// is first replaced. Versions are only kept for trees on the local disk.
+type Versions struct {
+    mu        sync.Mutex
+    enabled    bool
+}
+
+func OpenVersions(tree *Tree) *Versions {
+    if !Local(tree.Storage()) {
+        return &Versions{}
+    }
+    tree.Reserve(versionsName)
+    return &Versions{ enabled: true }
+}
+
+func (x *Versions) dirOf(t *Tree, parts []string) string {
+    sum := sha256.Sum256([]byte(strings.Join(parts, "/")))
+    return filepath.Join(t.AnchorOf(parts), versionsName, hex.EncodeToString(sum[:16]))
+}
+
+// Snapshot moves the file at loc into its history if the rules keep versions
+// of it, and returns where it went, or "" if it did not.
+func (x *Versions) Snapshot(t *Tree, parts []string, loc string) (string, error) {
+    t, _ = t.Walk(parts[:len(parts)-1])
+    if t == nil {
+        return "", nil
+    }
+    keep := t.VersionsOf(parts[len(parts)-1])
+    if keep <= 0 || !x.enabled {
+        return "", nil
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    dir := x.dirOf(t, parts)
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return "", err
+    }
+    id := strconv.FormatInt(time.Now().UnixNano(), 10)
+    if err := os.Rename(loc, filepath.Join(dir, id)); err != nil {
+        return "", err
+    }
+    versions := x.list(dir)
+    for len(versions) > keep {
+        os.Remove(filepath.Join(dir, versions[len(versions)-1].ID))
+        versions = versions[:len(versions)-1]
+    }
+    return filepath.Join(dir, id), nil
+}
+
+// list returns the versions stored in dir, most recent first.
+func (x *Versions) list(dir string) []Version {
+    versions := []Version{}
+    if !x.enabled {
+        return versions
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return versions
+    }
+    for _, entry := range entries {
+        saved, err := strconv.ParseInt(entry.Name(), 10, 64)
+        if err != nil {
+            continue
+        }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        versions = append(versions, Version{
+            ID: entry.Name(),
+            Size: info.Size(),
+            Time: info.ModTime(),
+            Saved: time.Unix(0, saved),
+        })
+    }
+    slices.SortFunc(versions, func(a Version, b Version) int { return b.Saved.Compare(a.Saved) })
+    return versions
+}
+
+// List returns the stored versions of the file named by parts, which need
+// not exist anymore but has to be readable.
+func (x *Versions) List(t *Tree, parts []string) ([]Version, error) {
+    if _, _, err := t.Locate(parts, PermRead, false); err != nil {
+        return nil, err
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    return x.list(x.dirOf(t, parts)), nil
+}
+
+// Open returns the location of a stored version of the file named by parts.
+func (x *Versions) Open(t *Tree, parts []string, id string) (string, error) {
+    if _, _, err := t.Locate(parts, PermRead, false); err != nil {
+        return "", err
+    }
+    if _, err := strconv.ParseInt(id, 10, 64); err != nil || !x.enabled {
+        return "", ErrNotFound
+    }
+    loc := filepath.Join(x.dirOf(t, parts), id)
+    if _, err := os.Stat(loc); err != nil {
+        return "", ErrNotFound
+    }
+    return loc, nil
+}
+
+// Rollback replaces the file named by parts with a copy of a stored version.
+// The replaced content is kept like on any other overwrite, so rolling back
+// can itself be undone.
+func (x *Versions) Rollback(t *Tree, parts []string, id string, trash *Trash) error {
+    src, err := x.Open(t, parts, id)
+    if err != nil {
+        return err
+    }
+    _, loc, err := t.Locate(parts, PermWrite, false)
+    if err != nil {
+        return err
+    }
+    tmp, err := x.copy(src)
+    if err != nil {
+        return err
+    }
+    if err := trash.Replace(t, parts, loc); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err := os.Rename(tmp, loc); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}
+
+// copy duplicates a version next to the history it belongs to, keeping its
+// modification time, so that it can be renamed into the tree.
+func (x *Versions) copy(src string) (string, error) {
+    in, err := os.Open(src)
+    if err != nil {
+        return "", err
+    }
+    defer in.Close()
+    info, err := in.Stat()
+    if err != nil {
+        return "", err
+    }
+    out, err := os.CreateTemp(filepath.Dir(filepath.Dir(src)), "")
+    if err != nil {
+        return "", err
+    }
+    _, err = io.Copy(out, in)
+    if cerr := out.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Chtimes(out.Name(), info.ModTime(), info.ModTime())
+    }
+    if err != nil {
+        os.Remove(out.Name())
+        return "", err
+    }
+    return out.Name(), nil
+}
\ No newline at end of file
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "path/filepath"
+    "testing"
+)
+
+func TestRollback(t *testing.T) {
+    app, root := newAPI(t, map[string]string{
+        ".rules.yml": "versions:\n    keep: 2\n    patterns: [\"*.txt\"]",
+        "a.txt": "v1",
+    }, nil)
+    tree := CreateTree(root)
+    trash := OpenTrash(tree, OpenVersions(tree))
+    for _, content := range []string{ "v2", "v3", "v4" } {
+        if err := trash.Replace(tree, []string{ "a.txt" }, filepath.Join(root, "a.txt")); err != nil {
+            t.Fatal(err)
+        }
+        writeFiles(t, root, map[string]string{ "a.txt": content })
+    }
+    list := func() []Version {
+        w, code := apiRequest(app, "GET", "/versions/a.txt", nil)
+        if w.Code != http.StatusOK {
+            t.Fatalf("listing: %d %s", w.Code, code)
+        }
+        result := struct {
+            Data    []Version    `json:"data"`
+        }{}
+        json.Unmarshal(w.Body.Bytes(), &result)
+        return result.Data
+    }
+    versions := list()
+    if len(versions) != 2 || versions[0].Size != 2 {
+        t.Fatalf("only the latest two versions should be kept: %+v", versions)
+    }
+
+    // The second version holds v2, which the current content replaces.
+    rollback := RollbackRequest{ Path: []string{ "a.txt" }, ID: versions[1].ID }
+    if w, code := apiRequest(app, "POST", "/rollback", rollback); w.Code != http.StatusOK {
+        t.Fatalf("rolling back: %d %s", w.Code, code)
+    }
+    if contents := readFiles(t, root, "a.txt"); contents["a.txt"] != "v2" {
+        t.Errorf("after rolling back: %v", contents)
+    }
+    if w, _ := apiRequest(app, "GET", "/version/" + list()[0].ID + "/a.txt", nil); w.Body.String() != "v4" {
+        t.Errorf("the replaced content was not kept: %q", w.Body)
+    }
+
+    rollback.ID = "1"
+    if _, code := apiRequest(app, "POST", "/rollback", rollback); code != "not_found" {
+        t.Errorf("rolling back to a missing version: %s", code)
+    }
+}
\ No newline at end of file
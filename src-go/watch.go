@@ -0,0 +1,123 @@
+package main
+
+import (
+    "path/filepath"
+    "sync"
+
+    "github.com/fsnotify/fsnotify"
+)
+
+type WatchEvent struct {
+    Type    string    `json:"type"` // created, modified, deleted or renamed.
+    Name    string    `json:"name"`
+    Flag    uint16    `json:"flag"`
+    Perms    uint16    `json:"perms"`
+}
+
+// Watcher multiplexes a single fsnotify watcher between all clients
+// watching directories. A directory is watched as long as it has at least
+// one subscriber.
+type Watcher struct {
+    mu        sync.Mutex
+    fsw        *fsnotify.Watcher
+    subs    map[string]map[chan fsnotify.Event]struct{}
+}
+
+func NewWatcher() (*Watcher, error) {
+    fsw, err := fsnotify.NewWatcher()
+    if err != nil {
+        return nil, err
+    }
+    w := &Watcher{
+        fsw: fsw,
+        subs: map[string]map[chan fsnotify.Event]struct{}{},
+    }
+    go w.run()
+    return w, nil
+}
+
+func (w *Watcher) run() {
+    for {
+        select {
+        case ev, ok := <-w.fsw.Events:
+            if !ok {
+                return
+            }
+            w.mu.Lock()
+            for ch := range w.subs[filepath.Dir(ev.Name)] {
+                // Slow subscribers miss events rather than stall everyone.
+                select {
+                case ch <- ev:
+                default:
+                }
+            }
+            w.mu.Unlock()
+        case _, ok := <-w.fsw.Errors:
+            if !ok {
+                return
+            }
+        }
+    }
+}
+
+func (w *Watcher) Subscribe(dir string) (chan fsnotify.Event, error) {
+    ch := make(chan fsnotify.Event, 64)
+    if err := w.Feed(dir, ch); err != nil {
+        return nil, err
+    }
+    return ch, nil
+}
+
+// Feed sends the events of dir to ch, which may be fed several directories.
+// It is undone by Unsubscribe.
+func (w *Watcher) Feed(dir string, ch chan fsnotify.Event) error {
+    dir = filepath.Clean(dir)
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    subs, ok := w.subs[dir]
+    if !ok {
+        if err := w.fsw.Add(dir); err != nil {
+            return err
+        }
+        subs = map[chan fsnotify.Event]struct{}{}
+        w.subs[dir] = subs
+    }
+    subs[ch] = struct{}{}
+    return nil
+}
+
+func (w *Watcher) Unsubscribe(dir string, ch chan fsnotify.Event) {
+    dir = filepath.Clean(dir)
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    subs := w.subs[dir]
+    delete(subs, ch)
+    if len(subs) == 0 {
+        delete(w.subs, dir)
+        w.fsw.Remove(dir)
+    }
+}
+
+// WatchEventOf translates an event in the directory of t for clients,
+// reporting false for entries the client must not learn about.
+func (t *Tree) WatchEventOf(ev fsnotify.Event) (*WatchEvent, bool) {
+    name := filepath.Base(ev.Name)
+    if t.Hidden(name) {
+        return nil, false
+    }
+    flag, effect := t.FlagOf(name)
+    event := &WatchEvent{ Name: name, Flag: flag, Perms: t.permsOf(name, flag, effect) }
+    switch {
+    case ev.Has(fsnotify.Create):
+        event.Type = "created"
+    case ev.Has(fsnotify.Remove):
+        event.Type = "deleted"
+    case ev.Has(fsnotify.Rename):
+        event.Type = "renamed"
+    case ev.Has(fsnotify.Write), ev.Has(fsnotify.Chmod):
+        event.Type = "modified"
+    default:
+        return nil, false
+    }
+    return event, true
+}
\ No newline at end of file
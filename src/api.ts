@@ -6,32 +6,105 @@ export enum Flag {
     INVISIBLE,
     VISIBLE,
     READONLY,
-    READWRITE
+    READWRITE,
+    DROPBOX
+}
+
+export enum Perm {
+    LIST = 1,
+    READ = 2,
+    WRITE = 4,
+    DELETE = 8,
+    CREATE = 16
 }
 
 export interface Effect {
     definition: string,
     direct: boolean,
-    cause: string
+    cause: string,
+    next: Date | null,
+    policy: boolean
 }
 
 export interface DirItem {
     name: string,
     time: Date,
     flag: Flag,
+    perms: number,
     effect: Effect | null
 }
 
+export interface LockInfo {
+    owner: string,
+    expiry: Date | null,
+    depth: '0' | 'infinity'
+}
+
 export interface FileItem extends DirItem {
     size: number,
+    etag: string,
+    lock: LockInfo | null,
     assoc: string
 }
 
+export interface ScanError {
+    name: string,
+    error: string
+}
+
 export type TreeResult = { 
     files: FileItem[], 
-    dirs: DirItem[] 
+    dirs: DirItem[],
+    errors: ScanError[],
+    total: number,
+    next: string | null
 };
 
+export interface TrashItem {
+    id: string,
+    path: string[],
+    dir: boolean,
+    size: number,
+    time: Date,
+    reason: 'deleted' | 'overwritten'
+}
+
+export interface Version {
+    id: string,
+    size: number,
+    time: Date,
+    saved: Date
+}
+
+export interface ErrorInfo {
+    code: string,
+    message: string,
+    path?: string[],
+    effect?: Effect
+}
+
+export class ApiError extends Error {
+    status: number;
+    info: ErrorInfo;
+
+    constructor(status: number, info: ErrorInfo) {
+        super(info.message);
+        this.status = status;
+        this.info = info;
+    }
+}
+
+export type BatchOp =
+    { op: 'move' | 'copy', from: string[], to: string[], ifMatch?: string, ifNoneMatch?: string } |
+    { op: 'delete' | 'mkdir', path: string[], ifMatch?: string, ifNoneMatch?: string };
+
+export interface BatchResult {
+    status: number,
+    error?: ErrorInfo
+}
+
+export type BatchMode = 'stopOnError' | 'continue' | 'transaction';
+
 export type Progress = (index: number, total: number) => void;
 
 export interface Backend {
@@ -44,6 +117,15 @@ export interface Backend {
     copy(from: string[], to: string[]): Promise<void>
     move(from: string[], to: string[]): Promise<void>
     delete(...path: string[]): Promise<void>
+    batch(mode: BatchMode, ...ops: BatchOp[]): Promise<BatchResult[]>
+    versions(...path: string[]): Promise<Version[]>
+    versionUrl(id: string, ...path: string[]): string
+    rollback(id: string, ...path: string[]): Promise<void>
+    lock(owner: string, timeout: number, ...path: string[]): Promise<string>
+    unlock(token: string): Promise<void>
+    trash(): Promise<TrashItem[]>
+    restore(id: string, to?: string[]): Promise<string[]>
+    purge(...ids: string[]): Promise<number>
 }
 
 const base = import.meta.env.DEV ? "http://localhost:8080" : "";
@@ -57,16 +139,38 @@ function getWsBase(): string {
     return `ws://${location.host}`
 }
 
+async function failure(resp: Response): Promise<ApiError> {
+    const body = await resp.json().catch(() => null);
+    return new ApiError(resp.status, body?.error ?? { code: 'internal', message: resp.statusText });
+}
+
+// closeStatus maps the close code of an upload to the HTTP status it mirrors.
+function closeStatus(code: number): number {
+    if (code >= 4000) {
+        return code - 4000;
+    }
+    return code === 1008 /* policy violation */ ? 400 : 500;
+}
+
 const backend: Backend = {
     async tree(...path) {
         const fullPath = path.join('/');
         const resp = await fetch(`${base}/tree/${fullPath}`);
         if (resp.status !== 200) {
-            throw resp.status;
+            throw await failure(resp);
         }
         const data = (await resp.json()).data;
-        data.files = data.files.map((f: any) => ({ ...f, time: new Date(f.time)}));
-        data.dirs = data.dirs.map((f: any) => ({ ...f, time: new Date(f.time)}));
+        data.files = data.files.map((f: any) => ({
+            ...f,
+            time: new Date(f.time),
+            lock: f.lock && { ...f.lock, expiry: f.lock.expiry && new Date(f.lock.expiry) },
+            effect: f.effect && { ...f.effect, next: f.effect.next && new Date(f.effect.next) }
+        }));
+        data.dirs = data.dirs.map((f: any) => ({
+            ...f,
+            time: new Date(f.time),
+            effect: f.effect && { ...f.effect, next: f.effect.next && new Date(f.effect.next) }
+        }));
         return data;
     },
     iconSrc(...path) {
@@ -90,7 +194,8 @@ const backend: Backend = {
         ws.addEventListener('open', () => {
             ws.send(JSON.stringify({
                 key: key.toString('hex'),
-                count
+                count,
+                size: blob.size
             }))
         });
         return new Promise((resolve, reject) => {
@@ -117,7 +222,11 @@ const backend: Backend = {
             });
             ws.addEventListener('close', ev => {
                 if (ev.code != 1000) {
-                    reject(ev.code);
+                    let info: ErrorInfo = { code: 'internal', message: ev.reason };
+                    try {
+                        info = JSON.parse(ev.reason);
+                    } catch {}
+                    reject(new ApiError(closeStatus(ev.code), info));
                 }
                 else {
                     resolve();
@@ -136,7 +245,7 @@ const backend: Backend = {
             })
         });
         if (resp.status !== 200) {
-            throw resp.status;
+            throw await failure(resp);
         }
     },
     async move(from, to) {
@@ -150,9 +259,24 @@ const backend: Backend = {
             })
         });
         if (resp.status !== 200) {
-            throw resp.status;
+            throw await failure(resp);
         }
     },
+    async batch(mode, ...ops) {
+        const resp = await fetch(`${base}/batch`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                mode, ops
+            })
+        });
+        if (resp.status !== 200) {
+            throw await failure(resp);
+        }
+        return (await resp.json()).data;
+    },
     async delete(...path) {
         const fullPath = path.join('/');
         const resp = await fetch(`${base}/delete/${fullPath}`, {
@@ -162,8 +286,103 @@ const backend: Backend = {
             }
         });
         if (resp.status !== 200) {
-            throw resp.status;
+            throw await failure(resp);
+        }
+    },
+    async versions(...path) {
+        const fullPath = path.join('/');
+        const resp = await fetch(`${base}/versions/${fullPath}`);
+        if (resp.status !== 200) {
+            throw await failure(resp);
+        }
+        const data = (await resp.json()).data;
+        return data.map((v: any) => ({ ...v, time: new Date(v.time), saved: new Date(v.saved)}));
+    },
+    versionUrl(id, ...path) {
+        const fullPath = path.join('/');
+        return `${base}/version/${id}/${fullPath}?download=true`;
+    },
+    async rollback(id, ...path) {
+        const resp = await fetch(`${base}/rollback`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                path, id
+            })
+        });
+        if (resp.status !== 200) {
+            throw await failure(resp);
+        }
+    },
+    async lock(owner, timeout, ...path) {
+        const fullPath = path.join('/');
+        const resp = await fetch(`${base}/lock/${fullPath}`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                owner, timeout
+            })
+        });
+        if (resp.status !== 200) {
+            throw await failure(resp);
+        }
+        return (await resp.json()).data.token;
+    },
+    async unlock(token) {
+        const resp = await fetch(`${base}/unlock`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                token
+            })
+        });
+        if (resp.status !== 200) {
+            throw await failure(resp);
+        }
+    },
+    async trash() {
+        const resp = await fetch(`${base}/trash`);
+        if (resp.status !== 200) {
+            throw await failure(resp);
+        }
+        const data = (await resp.json()).data;
+        return data.map((item: any) => ({ ...item, time: new Date(item.time)}));
+    },
+    async restore(id, to) {
+        const resp = await fetch(`${base}/trash/restore`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                id, to
+            })
+        });
+        if (resp.status !== 200) {
+            throw await failure(resp);
+        }
+        return (await resp.json()).data;
+    },
+    async purge(...ids) {
+        const resp = await fetch(`${base}/trash/purge`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                ids
+            })
+        });
+        if (resp.status !== 200) {
+            throw await failure(resp);
         }
+        return (await resp.json()).data;
     },
 }
 